@@ -1,700 +1,533 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"math"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
 )
 
-type Torrent struct {
-	Announce string
-	Info     Info
-}
-
-type Info struct {
-	Name        string
-	Length      int
-	PieceLength int
-	Pieces      string
-	sha1Hash    []byte
+// printPieceMap prints present as rows of ✓/✗ marks followed by the
+// equivalent hex bitfield.
+func printPieceMap(present []bool) {
+	const perRow = 32
+	bitfield := torrent.NewBitfield(len(present))
+	have := 0
+	for index, ok := range present {
+		if index%perRow == 0 {
+			if index > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%6d ", index)
+		}
+		if ok {
+			have++
+			bitfield.SetPiece(index)
+			fmt.Print("✓")
+		} else {
+			fmt.Print("✗")
+		}
+	}
+	fmt.Println()
+	fmt.Printf("Bitfield: %x\n", bitfield)
+	fmt.Printf("%d/%d pieces present\n", have, len(present))
 }
 
-type trackerRequest struct {
-	URL        string
-	InfoHash   string
-	PeerID     string
-	Port       int
-	Uploaded   int
-	Downloaded int
-	Left       int
-	Compact    int
+// printVerifySummary prints how many pieces matched their hashes and the
+// indices of those that didn't, and reports whether all matched.
+func printVerifySummary(present []bool) bool {
+	var mismatched []int
+	for index, ok := range present {
+		if !ok {
+			mismatched = append(mismatched, index)
+		}
+	}
+	fmt.Printf("Matched: %d/%d pieces\n", len(present)-len(mismatched), len(present))
+	if len(mismatched) > 0 {
+		fmt.Println("Mismatched pieces:", mismatched)
+		return false
+	}
+	fmt.Println("All pieces match")
+	return true
 }
 
-type RequestMessage struct {
-	lengthPrefix uint32
-	id           uint8
-	index        uint32
-	begin        uint32
-	length       uint32
+// verifyLocal hashes the data of tor at path, a file or a directory, with
+// workers pieces at a time and prints which pieces match. It reports whether
+// they all do.
+func verifyLocal(tor torrent.Torrent, path string, workers int) (matched bool, err error) {
+	if len(tor.Info.Files) == 0 {
+		if info, err := os.Stat(path); err == nil && info.Size() != int64(tor.Info.Length) {
+			fmt.Printf("%s is %d bytes, the torrent says %d\n", path, info.Size(), tor.Info.Length)
+		}
+	}
+	files, err := torrent.OpenFiles(path, tor)
+	if err != nil {
+		return false, err
+	}
+	present, err := torrent.CheckPiecesAt(tor, files, workers)
+	files.Close()
+	if err != nil {
+		return false, err
+	}
+	return printVerifySummary(present), nil
 }
 
-func verifyPiece(pieceData []byte, expectedHash []byte) bool {
-	hash := sha1.New()
-	hash.Write(pieceData)
-	return bytes.Equal(hash.Sum(nil), expectedHash)
+// torrentInfo is the metadata the info command prints with -json.
+type torrentInfo struct {
+	Announce     string     `json:"announce"`
+	AnnounceList [][]string `json:"announce_list,omitempty"`
+	Name         string     `json:"name"`
+	Length       int        `json:"length"`
+	PieceLength  int        `json:"piece_length"`
+	PieceCount   int        `json:"piece_count"`
+	InfoHash     string     `json:"info_hash"`
+	// Files is only set for multi-file torrents.
+	Files []torrentInfoFile `json:"files,omitempty"`
 }
 
-func getPieceHash(torrent Torrent, index int) []byte {
-	start := index * 20
-	return []byte(torrent.Info.Pieces[start : start+20])
+type torrentInfoFile struct {
+	Path   []string `json:"path"`
+	Length int      `json:"length"`
 }
 
-func decode(b string, st int) (x interface{}, i int, err error) {
-	// fmt.Println(st)
-	if st == len(b) {
-		return nil, st, io.ErrUnexpectedEOF
-	}
-	i = st
-	switch {
-	case b[i] == 'l':
-		return decodeList(b, i)
-	case b[i] == 'i':
-		return decodeInt(b, i)
-	case b[i] >= '0' && b[i] <= '9':
-		return decodeString(b, i)
-	case b[i] == 'd':
-		return decodeDict(b, i)
-	default:
-		return nil, st, fmt.Errorf("unexpected value: %q", b[i])
+func newTorrentInfo(tor torrent.Torrent) torrentInfo {
+	info := torrentInfo{
+		Announce:     tor.Announce,
+		AnnounceList: tor.AnnounceList,
+		Name:         tor.Info.Name,
+		Length:       tor.Info.Length,
+		PieceLength:  tor.Info.PieceLength,
+		PieceCount:   tor.PieceCount(),
+		InfoHash:     hex.EncodeToString(tor.Info.InfoHash),
+	}
+	for _, file := range tor.Info.Files {
+		info.Files = append(info.Files, torrentInfoFile{Path: file.Path, Length: file.Length})
 	}
+	return info
 }
 
-func decodeString(b string, st int) (x string, i int, err error) {
-	var l int
-	i = st
-	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
-		l = l*10 + (int(b[i]) - '0')
-		i++
-	}
-	if i == len(b) || b[i] != ':' {
-		return "", st, fmt.Errorf("bad string")
-	}
-	i++
-	if i+l > len(b) {
-		return "", st, fmt.Errorf("bad string: out of bounds")
-	}
-	x = b[i : i+l]
-	i += l
-	return x, i, nil
+// addTrackerFlags registers the flags that configure tracker requests.
+func addTrackerFlags(flags *flag.FlagSet, client *torrent.Client) {
+	flags.BoolVar(&client.TrackerTLSConfig.InsecureSkipVerify, "insecure", false, "don't verify https tracker certificates (for self-signed private trackers and testing)")
 }
 
-func decodeInt(b string, st int) (x int, i int, err error) {
-	i = st
-	i++ // 'i'
-	if i == len(b) {
-		return 0, st, fmt.Errorf("bad int")
-	}
-	neg := false
-	if b[i] == '-' {
-		neg = true
-		i++
-	}
-	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
-		x = x*10 + (int(b[i]) - '0')
-		i++
-	}
-	if i == len(b) || b[i] != 'e' {
-		return 0, st, fmt.Errorf("bad int")
-	}
-	i++
-	if neg {
-		x = -x
-	}
-	return x, i, nil
+// addRateFlags registers the flags that cap the download rate.
+func addRateFlags(flags *flag.FlagSet, client *torrent.Client) {
+	flags.IntVar(&client.MaxDownloadRate, "max-download-rate", 0, "cap the download rate across all peers, in bytes per second (0 for no limit)")
+	flags.IntVar(&client.MaxPeerDownloadRate, "max-peer-download-rate", 0, "cap the download rate from each peer, in bytes per second (0 for no limit)")
 }
-func decodeList(b string, st int) (l []interface{}, i int, err error) {
-	i = st
-	i++ // 'l'
-	l = make([]interface{}, 0)
-	for {
-		if i >= len(b) {
-			return nil, st, fmt.Errorf("bad list")
-		}
-		if b[i] == 'e' {
-			break
-		}
-		var x interface{}
-		x, i, err = decode(b, i)
-		if err != nil {
-			return nil, i, err
-		}
-		l = append(l, x)
-	}
-	i++
-	return l, i, nil
+
+// stopOnInterrupt announces "stopped" to the torrent's trackers before
+// exiting on an interrupt.
+func stopOnInterrupt(client *torrent.Client, tor torrent.Torrent) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		fmt.Println("Interrupted, telling trackers we stopped")
+		client.AnnounceLifecycle(tor, "stopped")
+		os.Exit(130)
+	}()
 }
 
-func decodeDict(b string, st int) (m map[string]interface{}, i int, err error) {
-	i = st
-	i++
-	m = make(map[string]interface{})
-	for {
-		if i >= len(b) {
-			return nil, st, fmt.Errorf("bad dictionary")
-		}
-		if b[i] == 'e' {
-			break
-		}
-		var key string
-		key, i, err = decodeString(b, i)
-		if err != nil {
-			return nil, i, err
-		}
-		var value interface{}
-		value, i, err = decode(b, i)
-		if err != nil {
-			return nil, i, err
-		}
-		m[key] = value
+// handlePauseSignals toggles gate on each pauseSignals signal, telling the
+// torrent's tracker we paused ("paused" event) or resumed ("started").
+func handlePauseSignals(client *torrent.Client, tor torrent.Torrent, gate *torrent.PauseGate) {
+	if len(pauseSignals) == 0 {
+		return
 	}
-	return m, i, nil
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignals...)
+	go func() {
+		for range signals {
+			event := "started"
+			if gate.Toggle() {
+				event = "paused"
+				fmt.Println("Download paused")
+			} else {
+				fmt.Println("Download resumed")
+			}
+			if err := client.AnnounceEvent(tor, tor.Announce, event); err != nil {
+				fmt.Printf("Announcing %s failed: %v\n", event, err)
+			}
+		}
+	}()
 }
 
-func peersList(torrent Torrent) (peers []string, err error) {
-	baseURL := torrent.Announce
-
-	u, err := url.Parse(baseURL)
-
-	params := url.Values{}
-	params.Add("info_hash", string(torrent.Info.sha1Hash))
-	params.Add("peer_id", "00112233445566778899")
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", strconv.Itoa(torrent.Info.Length))
-	params.Add("compact", "1")
-
-	u.RawQuery = params.Encode()
+// outputFlags are the flags every download command uses to pick its output
+// file.
+type outputFlags struct {
+	path   *string
+	force  *bool
+	rename *bool
+}
 
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return peers, err
+func addOutputFlags(flags *flag.FlagSet) outputFlags {
+	return outputFlags{
+		path:   flags.String("o", "", "output file path"),
+		force:  flags.Bool("force", false, "overwrite the output file if it already exists"),
+		rename: flags.Bool("rename", false, "if the output file exists, write to the first free name.1, name.2, ..."),
 	}
-	defer resp.Body.Close()
-
-	resBody, err := io.ReadAll(resp.Body)
+}
 
-	decodedResp, _, err := decodeDict(string(resBody), 0)
+// resolve returns the path to write to, applying the collision policy, and
+// creates its parent directories.
+func (o outputFlags) resolve() (string, error) {
+	outputPath, err := resolveOutputCollision(*o.path, *o.force, *o.rename)
 	if err != nil {
-		return peers, err
+		return "", err
 	}
+	return outputPath, prepareOutputPath(outputPath)
+}
 
-	peersData := []byte(decodedResp["peers"].(string))
-
-	if len(peersData)%6 != 0 {
-		fmt.Println("invalid peersData length")
-		return peers, err
+// resolveOutputCollision decides where to write when outputPath may already
+// exist: refuse by default so user data is never silently destroyed,
+// overwrite with force, or pick outputPath.1, outputPath.2, ... with rename.
+func resolveOutputCollision(outputPath string, force bool, rename bool) (string, error) {
+	if _, err := os.Stat(outputPath); os.IsNotExist(err) || force {
+		return outputPath, nil
 	}
-
-	for i := 0; i < len(peersData); i += 6 {
-		peer := peersData[i : i+6]
-
-		ip := net.IPv4(peer[0], peer[1], peer[2], peer[3])
-
-		port := binary.BigEndian.Uint16(peer[4:6])
-
-		p := fmt.Sprintf("%s:%d", ip, port)
-
-		peers = append(peers, p)
-		fmt.Println(p)
+	if !rename {
+		return "", fmt.Errorf("output file %s already exists (use --force to overwrite or --rename to pick a new name)", outputPath)
 	}
-
-	return peers, err
-}
-
-func executeHandshake(torrent Torrent, peerAddress string, conn net.Conn) (recievedHandshake []byte, err error) {
-
-	pstrlen := byte(19)
-	pstr := []byte("BitTorrent protocol")
-	reserved := make([]byte, 8)
-	handshake := append([]byte{pstrlen}, pstr...)
-	handshake = append(handshake, reserved...)
-	handshake = append(handshake, torrent.Info.sha1Hash...)
-	handshake = append(handshake, []byte{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9}...)
-
-	_, err = conn.Write(handshake)
-	if err != nil {
-		fmt.Println("Failed to write handshake:", err)
-		return recievedHandshake, err
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d", outputPath, i)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
 	}
+}
 
-	recievedHandshake = make([]byte, 68)
-
-	_, err = conn.Read(recievedHandshake)
-
-	if err != nil {
-		fmt.Println("Failed to read handshake:", err)
-		return recievedHandshake, err
+// prepareOutputPath creates any missing parent directories of outputPath so
+// the final write doesn't fail on a nested path.
+func prepareOutputPath(outputPath string) error {
+	dir := filepath.Dir(outputPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create output directory %s: %v", dir, err)
 	}
-	return recievedHandshake, err
+	return nil
 }
 
-func downloadTorrent(conn net.Conn, torrent Torrent, index int) (pieceData []byte, err error) {
-
-	//wait for bitfield message
-	buf := make([]byte, 4)
-	_, err = conn.Read(buf)
+// finishEmptyTorrent completes a zero-length torrent, which has no pieces and
+// so needs no tracker or peers: it creates the empty output file, or files,
+// and runs the completion hook, if any.
+func finishEmptyTorrent(outputPath string, tor torrent.Torrent, onComplete string) error {
+	files, err := torrent.CreateFiles(outputPath, tor)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	fmt.Println("bitfield message recieved:", index)
-
-	//payload
-	bitpayload := make([]byte, binary.BigEndian.Uint32(buf))
-	_, err = conn.Read(bitpayload)
-	if err != nil {
-		fmt.Println(err)
-		return
+	if err := files.Close(); err != nil {
+		return err
 	}
-
-	//constructed interested
-	message := make([]byte, 5)
-	message[4] = byte(2)
-	binary.BigEndian.PutUint32(message[0:4], uint32(1))
-
-	//send interested
-	_, err = conn.Write(message)
-	if err != nil {
-		fmt.Println(err)
-		return
+	if err := torrent.VerifyFileChecksum(outputPath, tor); err != nil {
+		return err
 	}
-
-	//wait for unchoke
-	buf = make([]byte, 5)
-	_, err = conn.Read(buf)
-	if err != nil {
-		fmt.Println(err)
-		return
+	fmt.Println("Torrent is empty, created", outputPath)
+	if onComplete != "" {
+		return runCompletionHook(onComplete, outputPath)
 	}
+	return nil
+}
 
-	fmt.Println("unchoke message recieved:", index)
-
-	//request for each block
-	pieceSize := torrent.Info.PieceLength
-	pieceCnt := int(math.Ceil(float64(torrent.Info.Length) / float64(pieceSize)))
-	if index == pieceCnt-1 {
-		pieceSize = torrent.Info.Length % torrent.Info.PieceLength
+// runCompletionHook runs the --on-complete command with outputPath appended
+// as its last argument. The command is split on whitespace and run directly,
+// not through a shell, but it still runs with the user's privileges: it must
+// only ever come from the user, never from torrent or tracker data.
+func runCompletionHook(command string, outputPath string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd := exec.Command(fields[0], append(fields[1:], outputPath)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("completion hook exited with status %d", exitErr.ExitCode())
 	}
-	blockSize := 16 * 1024
-	blockCnt := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-	for i := 0; i < blockCnt; i++ {
-		blockLength := blockSize
-		if i == blockCnt-1 {
-			blockLength = pieceSize - ((blockCnt - 1) * int(blockSize))
-		}
+	if err != nil {
+		return fmt.Errorf("completion hook failed: %v", err)
+	}
+	fmt.Println("Completion hook finished")
+	return nil
+}
 
-		peerMessage := RequestMessage{
-			lengthPrefix: 13,
-			id:           6,
-			index:        uint32(index),
-			begin:        uint32(i * int(blockSize)),
-			length:       uint32(blockLength),
-		}
-		var buf bytes.Buffer
-		binary.Write(&buf, binary.BigEndian, peerMessage)
-		_, err = conn.Write(buf.Bytes())
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+// scrapeTrackers scrapes every tracker of tor at once and prints each one's
+// counts, then the largest of each count across them. It reports whether any
+// tracker answered.
+func scrapeTrackers(client *torrent.Client, tor torrent.Torrent) bool {
+	urls := torrent.TrackerURLs(tor)
+	results := make([]torrent.ScrapeStats, len(urls))
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i], errs[i] = client.Scrape(tor, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	// Trackers count overlapping swarms, so take the largest of each
+	// rather than summing
+	var aggregate torrent.ScrapeStats
+	answered := 0
+	for i, u := range urls {
+		if errs[i] != nil {
+			fmt.Printf("%s: %v\n", u, errs[i])
+			continue
 		}
+		r := results[i]
+		fmt.Printf("%s: seeders %d, leechers %d, downloaded %d\n", u, r.Complete, r.Incomplete, r.Downloaded)
+		aggregate.Complete = max(aggregate.Complete, r.Complete)
+		aggregate.Incomplete = max(aggregate.Incomplete, r.Incomplete)
+		aggregate.Downloaded = max(aggregate.Downloaded, r.Downloaded)
+		answered++
+	}
+	if answered == 0 {
+		return false
+	}
+	fmt.Printf("Aggregate (%d of %d trackers): seeders %d, leechers %d, downloaded %d\n", answered, len(urls), aggregate.Complete, aggregate.Incomplete, aggregate.Downloaded)
+	return true
+}
 
-		//accept data
-		resBuf := make([]byte, 4)
-		_, err = conn.Read(resBuf)
-		if err != nil {
-			fmt.Println(err)
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments, returning the positional arguments in order.
+func parseArgs(flags *flag.FlagSet, args []string) (positional []string, err error) {
+	for {
+		if err = flags.Parse(args); err != nil {
 			return nil, err
 		}
-		peerMessage = RequestMessage{}
-		peerMessage.lengthPrefix = binary.BigEndian.Uint32(resBuf)
-		payloadBuf := make([]byte, peerMessage.lengthPrefix)
-		_, err = io.ReadFull(conn, payloadBuf)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
 		}
-		peerMessage.id = payloadBuf[0]
-		pieceData = append(pieceData, payloadBuf[9:]...)
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-
-	return pieceData, err
 }
 
-func downloadTorrentComplete(outputPath string, conn net.Conn, torrent Torrent) (err error) {
-
-	//wait for bitfield message
-	buf := make([]byte, 4)
-	_, err = conn.Read(buf)
+func main() {
+	client, err := torrent.NewClient()
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
-	fmt.Println("bitfield message recieved")
-
-	//payload
-	bitpayload := make([]byte, binary.BigEndian.Uint32(buf))
-	_, err = conn.Read(bitpayload)
-	if err != nil {
-		fmt.Println(err)
-		return
+	client.Log = os.Stdout
+	decoder := torrent.Decoder{OnDuplicate: func(key string) {
+		fmt.Fprintf(os.Stderr, "warning: duplicate dictionary key %q, keeping the last value\n", key)
+	}}
+
+	globalFlags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	globalFlags.BoolVar(&decoder.Strict, "strict", false, "reject bencode dictionaries with duplicate keys")
+	globalFlags.DurationVar(&client.KeepAliveInterval, "keep-alive", client.KeepAliveInterval, "send a keep-alive to peers after this long without other traffic (0 disables)")
+	globalFlags.StringVar(&client.UserAgent, "user-agent", client.UserAgent, "User-Agent header sent to trackers")
+	peerIDPrefix := globalFlags.String("peer-id-prefix", torrent.DefaultPeerIDPrefix, "client prefix of the peer ID, followed by random bytes")
+	proxy := globalFlags.String("proxy", "", "route peer and tracker connections through a socks5://[user:pass@]host:port proxy")
+	if err := globalFlags.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	if *proxy != "" {
+		if err := client.UseProxy(*proxy); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
 	}
-
-	//constructed interested
-	message := make([]byte, 5)
-	message[4] = byte(2)
-	binary.BigEndian.PutUint32(message[0:4], uint32(1))
-
-	//send interested
-	_, err = conn.Write(message)
-	if err != nil {
+	if client.PeerID, err = torrent.GeneratePeerID(*peerIDPrefix); err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(2)
 	}
-
-	//wait for unchoke
-	buf = make([]byte, 5)
-	_, err = conn.Read(buf)
-	if err != nil {
-		fmt.Println(err)
-		return
+	os.Args = append(os.Args[:1], globalFlags.Args()...)
+	if len(os.Args) < 2 {
+		fmt.Println("usage: mybittorrent [global flags] <command> [args]")
+		os.Exit(2)
 	}
 
-	fmt.Println("unchoke message recieved")
-
-	pieceSize := torrent.Info.PieceLength
-	pieceCnt := int(math.Ceil(float64(torrent.Info.Length) / float64(pieceSize)))
+	command := os.Args[1]
 
-	var fileData bytes.Buffer
-	for index := 0; index < pieceCnt; index++ {
-		fmt.Println("Piece Started:", index)
+	if command == "decode" {
 
-		//request for each block
-		var pieceData []byte
+		bencodedValue := os.Args[2]
 
-		if index == pieceCnt-1 {
-			pieceSize = torrent.Info.Length % torrent.Info.PieceLength
+		decoded, _, err := decoder.Decode(bencodedValue, 0)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
-		blockSize := 16 * 1024
-		blockCnt := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-		for i := 0; i < blockCnt; i++ {
-			blockLength := blockSize
-			if i == blockCnt-1 {
-				blockLength = pieceSize - ((blockCnt - 1) * int(blockSize))
-			}
 
-			peerMessage := RequestMessage{
-				lengthPrefix: 13,
-				id:           6,
-				index:        uint32(index),
-				begin:        uint32(i * int(blockSize)),
-				length:       uint32(blockLength),
-			}
-			var buf bytes.Buffer
-			binary.Write(&buf, binary.BigEndian, peerMessage)
-			_, err = conn.Write(buf.Bytes())
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
+		jsonOutput, _ := json.Marshal(decoded)
+		fmt.Println(string(jsonOutput))
 
-			//accept data
-			resBuf := make([]byte, 4)
-			_, err = conn.Read(resBuf)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			peerMessage = RequestMessage{}
-			peerMessage.lengthPrefix = binary.BigEndian.Uint32(resBuf)
-			payloadBuf := make([]byte, peerMessage.lengthPrefix)
-			_, err = io.ReadFull(conn, payloadBuf)
+	} else if command == "info" {
+		flags := flag.NewFlagSet("info", flag.ContinueOnError)
+		asJSON := flags.Bool("json", false, "print the metadata as a JSON object")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 1 {
+			fmt.Println("usage: info [-json] <torrent>")
+			os.Exit(2)
+		}
+		tor, err := decoder.Load(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *asJSON {
+			jsonOutput, err := json.MarshalIndent(newTorrentInfo(tor), "", "  ")
 			if err != nil {
 				fmt.Println(err)
-				return err
+				os.Exit(1)
 			}
-			peerMessage.id = payloadBuf[0]
-			pieceData = append(pieceData, payloadBuf[9:]...)
+			fmt.Println(string(jsonOutput))
+			return
 		}
+		fmt.Println("Tracker URL:", tor.Announce)
+		fmt.Println("Length:", tor.Info.Length)
+		fmt.Printf("Info Hash: %x\n", tor.Info.InfoHash)
+		fmt.Println("Piece Length:", tor.Info.PieceLength)
+		fmt.Printf("Piece Hashes: %x\n", tor.Info.Pieces)
 
+	} else if command == "infodict" {
+		flags := flag.NewFlagSet("infodict", flag.ContinueOnError)
+		output := flags.String("o", "", "write the info dictionary to this file instead of stdout")
+		args, err := parseArgs(flags, os.Args[2:])
 		if err != nil {
-			fmt.Println("Error on", index, ":", err)
-			return err
+			os.Exit(2)
 		}
-		fmt.Println("Piece Finished:", index)
-		fileData.Write(pieceData)
-	}
-	os.WriteFile(outputPath, fileData.Bytes(), os.ModePerm)
-	return err
-}
-
-func downloadPieceFromPeer(torrent Torrent, peerAddress string, index int) (pieceData []byte, err error) {
-	conn, err := net.Dial("tcp", peerAddress)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to peer %s: %v", peerAddress, err)
-	}
-	defer conn.Close()
-
-	_, err = executeHandshake(torrent, peerAddress, conn)
-	if err != nil {
-		return nil, fmt.Errorf("handshake failed with peer %s: %v", peerAddress, err)
-	}
-
-	// Wait for bitfield and send interested message
-	buf := make([]byte, 4)
-	if _, err = conn.Read(buf); err != nil {
-		return nil, err
-	}
-	bitpayload := make([]byte, binary.BigEndian.Uint32(buf))
-	if _, err = conn.Read(bitpayload); err != nil {
-		return nil, err
-	}
-
-	// Send interested message
-	message := make([]byte, 5)
-	message[4] = byte(2)
-	binary.BigEndian.PutUint32(message[0:4], uint32(1))
-	if _, err = conn.Write(message); err != nil {
-		return nil, err
-	}
-
-	// Wait for unchoke
-	buf = make([]byte, 5)
-	if _, err = conn.Read(buf); err != nil {
-		return nil, err
-	}
-
-	pieceSize := torrent.Info.PieceLength
-	if index == int(math.Ceil(float64(torrent.Info.Length)/float64(pieceSize)))-1 {
-		pieceSize = torrent.Info.Length % torrent.Info.PieceLength
-	}
-	blockSize := 16 * 1024
-	blockCnt := int(math.Ceil(float64(pieceSize) / float64(blockSize)))
-
-	var pieceDataBuffer []byte
-	for i := 0; i < blockCnt; i++ {
-		blockLength := blockSize
-		if i == blockCnt-1 {
-			blockLength = pieceSize - ((blockCnt - 1) * int(blockSize))
+		if len(args) != 1 {
+			fmt.Println("usage: infodict [-o file] <torrent>")
+			os.Exit(2)
 		}
 
-		peerMessage := RequestMessage{
-			lengthPrefix: 13,
-			id:           6,
-			index:        uint32(index),
-			begin:        uint32(i * int(blockSize)),
-			length:       uint32(blockLength),
+		data, err := torrent.ReadTorrentFile(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		var buf bytes.Buffer
-		binary.Write(&buf, binary.BigEndian, peerMessage)
-		_, err = conn.Write(buf.Bytes())
+		info, err := torrent.RawInfoDict(string(data))
 		if err != nil {
-			return nil, err
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// Raw bytes, so `infodict x.torrent | sha1sum` gives the info hash
+		if *output != "" {
+			err = os.WriteFile(*output, []byte(info), 0644)
+		} else {
+			_, err = os.Stdout.WriteString(info)
 		}
-
-		resBuf := make([]byte, 4)
-		_, err = conn.Read(resBuf)
 		if err != nil {
-			return nil, err
+			fmt.Println(err)
+			os.Exit(1)
 		}
 
-		peerMessage = RequestMessage{}
-		peerMessage.lengthPrefix = binary.BigEndian.Uint32(resBuf)
-		payloadBuf := make([]byte, peerMessage.lengthPrefix)
-		_, err = io.ReadFull(conn, payloadBuf)
+	} else if command == "pieces" {
+		flags := flag.NewFlagSet("pieces", flag.ContinueOnError)
+		workers := flags.Int("verify-concurrency", 1, "number of pieces hashed in parallel")
+		args, err := parseArgs(flags, os.Args[2:])
 		if err != nil {
-			return nil, err
+			os.Exit(2)
 		}
-
-		pieceDataBuffer = append(pieceDataBuffer, payloadBuf[9:]...)
-	}
-
-	// Verify piece hash
-	expectedHash := getPieceHash(torrent, index)
-	if !verifyPiece(pieceDataBuffer, expectedHash) {
-		return nil, fmt.Errorf("piece %d hash verification failed", index)
-	}
-
-	return pieceDataBuffer, nil
-}
-
-func downloadTorrentParallel(outputPath string, torrent Torrent, peers []string) error {
-	pieceSize := torrent.Info.PieceLength
-	pieceCnt := int(math.Ceil(float64(torrent.Info.Length) / float64(pieceSize)))
-
-	pieceChan := make(chan struct {
-		index int
-		data  []byte
-		err   error
-	}, pieceCnt)
-
-	var wg sync.WaitGroup
-	wg.Add(pieceCnt)
-
-	// Semaphore to limit concurrent connections
-	maxConcurrent := 5
-	semaphore := make(chan struct{}, maxConcurrent)
-
-	downloadPiece := func(index int) {
-		defer wg.Done()
-		defer func() { <-semaphore }() // Release semaphore slot
-
-		var lastErr error
-		attempts := 0
-		maxAttempts := len(peers)
-
-		// Try different peers until success or max attempts reached
-		for attempts < maxAttempts {
-			peer := peers[attempts%len(peers)]
-			pieceData, err := downloadPieceFromPeer(torrent, peer, index)
-			if err == nil {
-				fmt.Printf("Piece %d downloaded and verified successfully\n", index)
-				pieceChan <- struct {
-					index int
-					data  []byte
-					err   error
-				}{index: index, data: pieceData, err: nil}
-				return
-			}
-			lastErr = err
-			attempts++
-			fmt.Printf("Piece %d attempt %d failed from peer %s: %v\n", index, attempts, peer, err)
+		if len(args) != 2 {
+			fmt.Println("usage: pieces [-verify-concurrency n] <torrent> <file>")
+			os.Exit(2)
 		}
-
-		pieceChan <- struct {
-			index int
-			data  []byte
-			err   error
-		}{index: index, data: nil, err: lastErr}
-	}
-
-	for i := 0; i < pieceCnt; i++ {
-		semaphore <- struct{}{}
-		go downloadPiece(i)
-	}
-
-	go func() {
-		wg.Wait()
-		close(pieceChan)
-	}()
-
-	// Collect and order pieces
-	pieces := make([][]byte, pieceCnt)
-	var errors []error
-
-	for result := range pieceChan {
-		if result.err != nil {
-			errors = append(errors, fmt.Errorf("piece %d download failed: %v", result.index, result.err))
-			continue
+		tor, err := decoder.Load(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		pieces[result.index] = result.data
-	}
-
-	if len(errors) > 0 {
-		return fmt.Errorf("download failed with errors: %v", errors)
-	}
-
-	// Combine pieces and write to file
-	var fileData bytes.Buffer
-	for _, piece := range pieces {
-		fileData.Write(piece)
-	}
-
-	return os.WriteFile(outputPath, fileData.Bytes(), os.ModePerm)
-}
-
-func fileReader(torrentFilePath string) (torrent Torrent) {
-
-	torrentFile, _ := os.ReadFile(torrentFilePath)
-	decoded, _, err := decodeDict(string(torrentFile), 0)
-
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	info, ok := decoded["info"].(map[string]interface{})
-
-	if !ok {
-		fmt.Println("info is not a map")
-		return
-	}
 
-	var buf bytes.Buffer
-
-	err = bencode.Marshal(&buf, info)
-
-	if err != nil {
-		fmt.Println("Bad info")
-		return
-	}
-
-	hash := sha1.New()
-	hash.Write(buf.Bytes())
-	sha1Hash := hash.Sum(nil)
-
-	torrent.Announce = decoded["announce"].(string)
-	torrent.Info.Length = info["length"].(int)
-	torrent.Info.Name = info["name"].(string)
-	torrent.Info.sha1Hash = sha1Hash
-	torrent.Info.PieceLength = info["piece length"].(int)
-	torrent.Info.Pieces = info["pieces"].(string)
-
-	return torrent
-}
-func main() {
-
-	command := os.Args[1]
-
-	if command == "decode" {
-
-		bencodedValue := os.Args[2]
-
-		decoded, _, err := decode(bencodedValue, 0)
+		present, err := torrent.CheckPieces(tor, args[1], *workers)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		printPieceMap(present)
 
-		jsonOutput, _ := json.Marshal(decoded)
-		fmt.Println(string(jsonOutput))
+	} else if command == "verify" {
+		flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+		workers := flags.Int("verify-concurrency", runtime.GOMAXPROCS(0), "number of pieces hashed in parallel")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 2 {
+			fmt.Println("usage: verify [-verify-concurrency n] <torrent> <file or directory>")
+			os.Exit(2)
+		}
+		tor, err := decoder.Load(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-	} else if command == "info" {
-		torrent := fileReader(os.Args[2])
+		matched, err := verifyLocal(tor, args[1], *workers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !matched {
+			os.Exit(1)
+		}
 
-		fmt.Println("Tracker URL:", torrent.Announce)
-		fmt.Println("Length:", torrent.Info.Length)
-		fmt.Printf("Info Hash: %x\n", torrent.Info.sha1Hash)
-		fmt.Println("Piece Length:", torrent.Info.PieceLength)
-		fmt.Printf("Piece Hashes: %x\n", torrent.Info.Pieces)
+	} else if command == "finalize" {
+		if len(os.Args) != 4 {
+			fmt.Println("usage: finalize <torrent> <part-file>")
+			os.Exit(2)
+		}
+		tor, err := decoder.Load(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		finalPath, err := torrent.FinalizePart(tor, os.Args[3])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Finalized", finalPath)
 
 	} else if command == "peers" {
-		torrentFile := os.Args[2]
-		torrent := fileReader(torrentFile)
+		flags := flag.NewFlagSet("peers", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		timeout := flags.Duration("timeout", torrent.AllTrackersTimeout, "overall deadline for peer discovery")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 1 {
+			fmt.Println("usage: peers [-timeout d] <torrent>")
+			os.Exit(2)
+		}
+
+		torrentFile := args[0]
+		tor, err := decoder.Load(torrentFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		peers, err := peersList(torrent)
+		// Bounded by the deadline; trackers that answered in time still count
+		peers, err := client.PeersFromAllTrackers(tor, *timeout)
 
 		if err != nil {
 			fmt.Println("Error forming peer list:", err)
@@ -705,21 +538,41 @@ func main() {
 			fmt.Println(peer)
 		}
 
+	} else if command == "scrape" {
+		if len(os.Args) != 3 {
+			fmt.Println("usage: scrape <torrent>")
+			os.Exit(2)
+		}
+		tor, err := decoder.Load(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if !scrapeTrackers(client, tor) {
+			fmt.Println("No tracker answered the scrape")
+			os.Exit(1)
+		}
+
 	} else if command == "handshake" {
 		torrentFile := os.Args[2]
 
 		peerAddress := os.Args[3]
 
-		torrent := fileReader(torrentFile)
+		tor, err := decoder.Load(torrentFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		conn, err := net.Dial("tcp", peerAddress)
+		conn, err := client.DialPeer("tcp", peerAddress)
 		if err != nil {
 			fmt.Println("bad peer")
 			return
 		}
 		defer conn.Close()
 
-		recievedHandshake, err := executeHandshake(torrent, peerAddress, conn)
+		recievedHandshake, err := client.Handshake(tor, peerAddress, conn)
 
 		if err != nil {
 			fmt.Println("Handshake error:", err)
@@ -729,38 +582,58 @@ func main() {
 		fmt.Printf("Peer ID: %x\n", recievedHandshake[48:])
 
 	} else if command == "download_piece" {
+		flags := flag.NewFlagSet("download_piece", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		addRateFlags(flags, client)
+		output := addOutputFlags(flags)
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 2 || *output.path == "" {
+			fmt.Println("usage: download_piece -o <output> <torrent> <piece index>")
+			os.Exit(2)
+		}
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 {
+			fmt.Println("invalid piece index:", args[1])
+			os.Exit(2)
+		}
 
-		var torrentFile, outputPath string
-
-		if os.Args[2] == "-o" {
-			torrentFile = os.Args[4]
-			outputPath = os.Args[3]
+		torrentFile := args[0]
+		outputPath, err := output.resolve()
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
 
-		torrent := fileReader(torrentFile)
+		tor, err := decoder.Load(torrentFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		peers, err := peersList(torrent)
+		peers, err := client.Peers(tor)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
-		index, _ := strconv.Atoi(os.Args[5])
 
-		conn, err := net.Dial("tcp", peers[0])
+		conn, err := client.DialPeer("tcp", peers[0])
 		if err != nil {
 			fmt.Println("bad peer")
 			return
 		}
 		defer conn.Close()
 
-		_, err = executeHandshake(torrent, peers[0], conn)
+		_, err = client.Handshake(tor, peers[0], conn)
 
 		if err != nil {
 			fmt.Println("Handshake error:", err)
 			return
 		}
 
-		pieceData, err := downloadTorrent(conn, torrent, index)
+		pieceData, err := client.DownloadPiece(conn, tor, index)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -781,76 +654,352 @@ func main() {
 		fmt.Printf("Piece %d downloaded to %s.\n", index, outputPath)
 
 	} else if command == "download" {
+		flags := flag.NewFlagSet("download", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		addRateFlags(flags, client)
+		output := addOutputFlags(flags)
+		onComplete := flags.String("on-complete", "", "command to run with the output path after a successful download (runs with your privileges; only use trusted commands)")
+		resume := flags.Bool("resume", false, "download into a .part file and continue an interrupted download")
+		flags.IntVar(&client.ListenPort, "port", client.ListenPort, "port to advertise to the tracker")
+		flags.BoolVar(&client.Verbose, "verbose", false, "log every piece instead of drawing a progress bar")
+		verify := flags.Bool("verify", false, "after downloading, re-read the output from disk and re-hash every piece")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 1 || *output.path == "" {
+			fmt.Println("usage: download [-resume] [-port n] [-verbose] [-verify] -o <output> <torrent>")
+			os.Exit(2)
+		}
 
-		var torrentFile, outputPath string
-
-		if os.Args[2] == "-o" {
-			torrentFile = os.Args[4]
-			outputPath = os.Args[3]
+		torrentFile := args[0]
+		outputPath, err := output.resolve()
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
 
-		torrent := fileReader(torrentFile)
+		tor, err := decoder.Load(torrentFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
 		fmt.Println("File Read and torrent Created")
 
-		peers, err := peersList(torrent)
+		if tor.Info.Length == 0 {
+			if err := finishEmptyTorrent(outputPath, tor, *onComplete); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		peers, err := client.Peers(tor)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		stopOnInterrupt(client, tor)
 
-		conn, err := net.Dial("tcp", peers[0])
-		if err != nil {
-			fmt.Println("bad peer")
+		if err := client.DownloadFromPeer(outputPath, tor, peers[0], *resume); err != nil {
+			fmt.Println(err)
+			client.AnnounceLifecycle(tor, "stopped")
 			return
 		}
-		defer conn.Close()
+		if *verify {
+			if err := torrent.VerifyDownload(outputPath, tor, runtime.GOMAXPROCS(0)); err != nil {
+				fmt.Println(err)
+				client.AnnounceLifecycle(tor, "stopped")
+				os.Exit(1)
+			}
+			fmt.Println("Verified every piece on disk")
+		}
+		client.AnnounceLifecycle(tor, "completed")
+		client.AnnounceLifecycle(tor, "stopped")
 
-		fmt.Println("Peer list extracted and connection dialed")
+		if *onComplete != "" {
+			if err := runCompletionHook(*onComplete, outputPath); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		return
 
-		_, err = executeHandshake(torrent, peers[0], conn)
+	} else if command == "mirror" {
+		flags := flag.NewFlagSet("mirror", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		addRateFlags(flags, client)
+		flags.IntVar(&client.ListenPort, "port", client.ListenPort, "port to accept peers on")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 2 {
+			fmt.Println("usage: mirror [-port n] <torrent> <dir>")
+			os.Exit(2)
+		}
+		tor, err := decoder.Load(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(tor.Info.Files) > 0 {
+			fmt.Println("mirror doesn't support multi-file torrents yet")
+			os.Exit(1)
+		}
+		if !torrent.ValidPathComponent(tor.Info.Name) {
+			fmt.Printf("torrent name %q is not a usable file name\n", tor.Info.Name)
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(args[1], 0755); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		outputPath := filepath.Join(args[1], tor.Info.Name)
 
+		// Bind before announcing so trackers learn the port we really got
+		ln, err := client.Listen()
 		if err != nil {
-			fmt.Println("Handshake error:", err)
-			return
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		stopOnInterrupt(client, tor)
+
+		ctx := context.Background()
+		if err := client.MirrorDownload(ctx, tor, outputPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Seeding", outputPath, "on port", client.ListenPort)
+		go client.MirrorAnnounce(ctx, tor)
+		if err := client.Seed(ln, tor, outputPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	} else if command == "magnet" {
+		flags := flag.NewFlagSet("magnet", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		addRateFlags(flags, client)
+		output := addOutputFlags(flags)
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 1 || *output.path == "" {
+			fmt.Println("usage: magnet -o <output> <magnet-uri>")
+			os.Exit(2)
 		}
-		fmt.Println("Firm Handshake")
 
-		err = downloadTorrentComplete(outputPath, conn, torrent)
+		link, err := torrent.ParseMagnet(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		outputPath, err := output.resolve()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
+		// Only the info hash is known until a peer sends the metadata
+		tor := torrent.Torrent{Info: torrent.Info{Name: link.DisplayName, InfoHash: link.InfoHash}}
+		if len(link.Trackers) > 0 {
+			tor.Announce = link.Trackers[0]
+			tor.AnnounceList = [][]string{link.Trackers}
+		}
+		peers, err := client.PeersFromAllTrackers(tor, torrent.AllTrackersTimeout)
+		if err != nil && client.Proxied() {
+			fmt.Println("No tracker returned peers, and the DHT is disabled behind a proxy")
+		} else if err != nil {
+			fmt.Println("No tracker returned peers, looking the torrent up in the DHT")
+			peers, err = client.DHTPeers(tor.Info.InfoHash)
+		}
 		if err != nil {
-			fmt.Println("download err:", err)
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		tor.Info, err = client.MetadataFromPeers(tor, peers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Metadata received for", tor.Info.Name)
 
+		if tor.Info.Length == 0 {
+			if err := finishEmptyTorrent(outputPath, tor, ""); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+		// Any of the peers may have the pieces, not just the one that sent
+		// the metadata
+		if err := client.Download(context.Background(), outputPath, tor, peers, torrent.DownloadOptions{Network: "tcp"}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
 		return
 
 	} else if command == "download_parallel" {
-		var torrentFile, outputPath string
-
-		if os.Args[2] == "-o" {
-			torrentFile = os.Args[4]
-			outputPath = os.Args[3]
+		flags := flag.NewFlagSet("download_parallel", flag.ContinueOnError)
+		addTrackerFlags(flags, client)
+		addRateFlags(flags, client)
+		output := addOutputFlags(flags)
+		adaptive := flags.Bool("adaptive", false, "adjust the number of concurrent transfers to observed throughput")
+		network := flags.String("net", "tcp", "peer network: tcp4, tcp6 or tcp for dual-stack")
+		flags.IntVar(&client.TrackerRetries, "tracker-retries", client.TrackerRetries, "retries for transient tracker network errors")
+		allTrackers := flags.Bool("all-trackers", false, "announce to every tracker in parallel and merge their peers")
+		peerCacheTTL := flags.Duration("peer-cache-ttl", 0, "remember the peers that served pieces in <output>.peers and try them first next time, for this long (0, the default, disables the cache)")
+		onComplete := flags.String("on-complete", "", "command to run with the output path after a successful download (runs with your privileges; only use trusted commands)")
+		resume := flags.Bool("resume", false, "download into a .part file and continue an interrupted download")
+		resumeFlushPieces := flags.Int("resume-flush-pieces", torrent.DefaultResumeFlushPieces, "with --resume, save progress after this many completed pieces")
+		resumeFlushInterval := flags.Duration("resume-flush-interval", torrent.DefaultResumeFlushInterval, "with --resume, save progress at least this often")
+		stats := flags.Bool("stats", false, "print which peer supplied each piece and which served bad data")
+		tempDir := flags.String("temp-dir", "", "assemble the download in this directory and move it into place once complete")
+		prewarm := flags.Int("prewarm", 0, fmt.Sprintf("connect, handshake and get unchoked by this many peers before requesting pieces (max %d)", torrent.MaxPrewarm))
+		swarmWait := flags.Duration("swarm-wait", 0, "keep re-announcing this long for pieces no known peer has before failing")
+		eta := flags.Bool("eta", false, "report progress, download rate and estimated time remaining")
+		hashWorkers := flags.Int("hash-workers", runtime.GOMAXPROCS(0), "number of pieces SHA-1 verified in parallel")
+		strategy := flags.String("strategy", torrent.StrategySequential, "piece selection order: sequential or rarest-first")
+		pieceTimeout := flags.Duration("timeout", torrent.DefaultPieceTimeout, "give up on a peer that hasn't delivered a piece within this long (0 disables)")
+		flags.IntVar(&client.ListenPort, "port", client.ListenPort, "port to advertise to the tracker")
+		flags.BoolVar(&client.Verbose, "verbose", false, "log every piece instead of drawing a progress bar")
+		verify := flags.Bool("verify", false, "after downloading, re-read the output from disk and re-hash every piece")
+		args, err := parseArgs(flags, os.Args[2:])
+		if err != nil {
+			os.Exit(2)
+		}
+		if len(args) != 1 || *output.path == "" {
+			fmt.Println("usage: download_parallel [flags] -o <output> <torrent>")
+			os.Exit(2)
 		}
 
-		torrent := fileReader(torrentFile)
+		torrentFile := args[0]
+		outputPath, err := output.resolve()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
-		fmt.Println("File Read and torrent Created")
+		if *tempDir != "" && *resume {
+			fmt.Println("--temp-dir cannot be combined with --resume")
+			os.Exit(2)
+		}
+		if *strategy != torrent.StrategySequential && *strategy != torrent.StrategyRarestFirst {
+			fmt.Println("--strategy must be sequential or rarest-first")
+			os.Exit(2)
+		}
 
-		peers, err := peersList(torrent)
+		tor, err := decoder.Load(torrentFile)
 		if err != nil {
 			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("File Read and torrent Created")
+
+		if tor.Info.Length == 0 {
+			if err := finishEmptyTorrent(outputPath, tor, *onComplete); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
 			return
 		}
 
-		fmt.Println("Downloading file using parallel download from", len(peers), "peers")
+		opts := torrent.DownloadOptions{
+			Adaptive:     *adaptive,
+			Network:      *network,
+			Resume:       *resume,
+			HashWorkers:  *hashWorkers,
+			Strategy:     *strategy,
+			PieceTimeout: *pieceTimeout,
+			ETA:          *eta,
+			SwarmWait:    *swarmWait,
+			TempDir:      *tempDir,
+			Stats:        *stats,
+			Prewarm:      *prewarm,
+			Pause:        torrent.NewPauseGate(),
+
+			ResumeFlushPieces:   *resumeFlushPieces,
+			ResumeFlushInterval: *resumeFlushInterval,
+			AnnounceInterval:    torrent.DefaultAnnounceInterval,
+		}
+		announce := func() ([]string, time.Duration, error) {
+			if *allTrackers {
+				peers, err := client.PeersFromAllTrackers(tor, torrent.AllTrackersTimeout)
+				return peers, 0, err
+			}
+			return client.PeersWithInterval(tor)
+		}
+
+		var cachedPeers []string
+		if *peerCacheTTL > 0 {
+			opts.PeerCachePath = torrent.PeerCachePath(outputPath)
+			opts.PeerCacheTTL = *peerCacheTTL
+			// A bad -net is reported below, when the tracker peers are
+			// filtered
+			cachedPeers, _ = torrent.FilterPeersByNetwork(torrent.LoadPeerCache(opts.PeerCachePath, opts.PeerCacheTTL), *network)
+		}
+
+		var peers []string
+		if len(cachedPeers) > 0 {
+			// Start on the cached peers at once; the trackers' peers join
+			// as they answer, so a slow or down tracker doesn't hold up
+			// the first piece
+			peers = cachedPeers
+			opts.InitialAnnounce = announce
+			fmt.Println("Starting with", len(peers), "cached peers while asking the trackers for more")
+		} else {
+			trackerPeers, interval, err := announce()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			if interval > 0 {
+				opts.AnnounceInterval = interval
+			}
+			peers, err = torrent.FilterPeersByNetwork(trackerPeers, *network)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			if len(peers) == 0 {
+				fmt.Println("No", *network, "peers available")
+				return
+			}
+			fmt.Println("Downloading file using parallel download from", len(peers), "peers")
+		}
+		handlePauseSignals(client, tor, opts.Pause)
+		stopOnInterrupt(client, tor)
 
-		err = downloadTorrentParallel(outputPath, torrent, peers)
+		err = client.Download(context.Background(), outputPath, tor, peers, opts)
 		if err != nil {
 			fmt.Println("Parallel download error:", err)
+			client.AnnounceLifecycle(tor, "stopped")
 			return
 		}
+		if *verify {
+			if err := torrent.VerifyDownload(outputPath, tor, *hashWorkers); err != nil {
+				fmt.Println(err)
+				client.AnnounceLifecycle(tor, "stopped")
+				os.Exit(1)
+			}
+			fmt.Println("Verified every piece on disk")
+		}
+		client.AnnounceLifecycle(tor, "completed")
+		client.AnnounceLifecycle(tor, "stopped")
 
 		fmt.Println("File downloaded successfully to", outputPath)
+
+		if *onComplete != "" {
+			if err := runCompletionHook(*onComplete, outputPath); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
 	} else {
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+func TestParseArgsOrderings(t *testing.T) {
+	orderings := [][]string{
+		{"-o", "out", "file.torrent", "3"},
+		{"file.torrent", "-o", "out", "3"},
+		{"file.torrent", "3", "-o", "out"},
+		{"-o=out", "file.torrent", "3"},
+		{"--o", "out", "file.torrent", "3"},
+	}
+	for _, args := range orderings {
+		flags := flag.NewFlagSet("download_piece", flag.ContinueOnError)
+		output := flags.String("o", "", "")
+		positional, err := parseArgs(flags, args)
+		if err != nil {
+			t.Errorf("%q: %v", args, err)
+			continue
+		}
+		if *output != "out" || !reflect.DeepEqual(positional, []string{"file.torrent", "3"}) {
+			t.Errorf("%q: got -o %q and %q", args, *output, positional)
+		}
+	}
+}
+
+func TestParseArgsUnknownFlag(t *testing.T) {
+	flags := flag.NewFlagSet("download_piece", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.String("o", "", "")
+	if _, err := parseArgs(flags, []string{"file.torrent", "-x", "3"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+// captureStdout returns what f prints to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestPrintPieceMap(t *testing.T) {
+	present := make([]bool, 34)
+	present[0], present[2], present[33] = true, true, true
+	got := captureStdout(t, func() { printPieceMap(present) })
+	want := "     0 ✓✗✓✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗✗\n" +
+		"    32 ✗✓\n" +
+		"Bitfield: a000000040\n" +
+		"3/34 pieces present\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOutputPathCreatesParents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "b", "out.bin")
+	output := outputFlags{path: &path, force: new(bool), rename: new(bool)}
+	resolved, err := output.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != path {
+		t.Errorf("resolved to %s, want %s", resolved, path)
+	}
+	if err := os.WriteFile(resolved, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A parent that is a file can't be created
+	blocked := filepath.Join(path, "out.bin")
+	output.path = &blocked
+	if _, err := output.resolve(); err == nil {
+		t.Error("resolved a path below a file")
+	}
+}
+
+func TestCompletionHookGetsOutputPath(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the hook script")
+	}
+	dir := t.TempDir()
+	record := filepath.Join(dir, "hook.out")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("printf %s \"$2\" > \"$1\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "some file.bin")
+
+	captureStdout(t, func() {
+		if err := runCompletionHook("sh "+script+" "+record, outputPath); err != nil {
+			t.Error(err)
+		}
+	})
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != outputPath {
+		t.Errorf("hook got %q, want %q", got, outputPath)
+	}
+
+	failing := filepath.Join(dir, "fail.sh")
+	if err := os.WriteFile(failing, []byte("exit 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = runCompletionHook("sh "+failing, outputPath)
+	if err == nil || err.Error() != "completion hook exited with status 3" {
+		t.Errorf("failing hook: got %v", err)
+	}
+}
+
+func TestResolveOutputCollision(t *testing.T) {
+	dir := t.TempDir()
+	free := filepath.Join(dir, "free.bin")
+	taken := filepath.Join(dir, "taken.bin")
+	for _, path := range []string{taken, taken + ".1"} {
+		if err := os.WriteFile(path, []byte("user data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, err := resolveOutputCollision(free, false, false); err != nil || got != free {
+		t.Errorf("free path: got %q, %v", got, err)
+	}
+	if _, err := resolveOutputCollision(taken, false, false); err == nil {
+		t.Error("existing file accepted without --force or --rename")
+	}
+	if got, err := resolveOutputCollision(taken, true, false); err != nil || got != taken {
+		t.Errorf("--force: got %q, %v", got, err)
+	}
+	if got, err := resolveOutputCollision(taken, false, true); err != nil || got != taken+".2" {
+		t.Errorf("--rename: got %q, %v, want %s", got, err, taken+".2")
+	}
+}
+
+// scrapeTracker serves a scrape reporting the given counts for infoHash and
+// returns its announce URL.
+func scrapeTracker(t *testing.T, infoHash []byte, complete, incomplete, downloaded int) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei%de10:downloadedi%de10:incompletei%deeee", infoHash, complete, downloaded, incomplete)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+func TestScrapeTrackersTakesLargestCounts(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{7}, 20)
+	first := scrapeTracker(t, infoHash, 5, 1, 20)
+	second := scrapeTracker(t, infoHash, 3, 4, 9)
+	// Scrape isn't supported without "announce" at the end of the path
+	unsupported := strings.TrimSuffix(scrapeTracker(t, infoHash, 100, 100, 100), "/announce") + "/tracker"
+	tor := torrent.Torrent{
+		Announce:     first,
+		AnnounceList: [][]string{{first, second}, {unsupported}},
+		Info:         torrent.Info{InfoHash: infoHash},
+	}
+	client, err := torrent.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answered bool
+	out := captureStdout(t, func() { answered = scrapeTrackers(client, tor) })
+	if !answered {
+		t.Fatalf("no tracker answered:\n%s", out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	want := []string{
+		first + ": seeders 5, leechers 1, downloaded 20",
+		second + ": seeders 3, leechers 4, downloaded 9",
+		"",
+		"Aggregate (2 of 3 trackers): seeders 5, leechers 4, downloaded 20",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got\n%s", out)
+	}
+	for i, line := range lines {
+		if i == 2 {
+			if !strings.HasPrefix(line, unsupported+": ") {
+				t.Errorf("unsupported tracker: got %q", line)
+			}
+			continue
+		}
+		if line != want[i] {
+			t.Errorf("got %q, want %q", line, want[i])
+		}
+	}
+
+	tor = torrent.Torrent{Announce: unsupported, Info: torrent.Info{InfoHash: infoHash}}
+	captureStdout(t, func() { answered = scrapeTrackers(client, tor) })
+	if answered {
+		t.Error("answered with no tracker supporting scrape")
+	}
+}
+
+func TestFinishEmptyTorrent(t *testing.T) {
+	dir := t.TempDir()
+	// Nothing answers at this tracker, so any contact would fail
+	single := torrent.Torrent{Announce: "http://127.0.0.1:1/announce", Info: torrent.Info{Name: "empty.bin", PieceLength: 16}}
+	outputPath := filepath.Join(dir, "empty.bin")
+	captureStdout(t, func() {
+		if err := finishEmptyTorrent(outputPath, single, ""); err != nil {
+			t.Error(err)
+		}
+	})
+	if info, err := os.Stat(outputPath); err != nil || info.Size() != 0 {
+		t.Errorf("single file: got %v, %v", info, err)
+	}
+
+	multi := single
+	multi.Info.Files = []torrent.FileEntry{{Path: []string{"a"}}, {Path: []string{"sub", "b"}}}
+	outputDir := filepath.Join(dir, "multi")
+	captureStdout(t, func() {
+		if err := finishEmptyTorrent(outputDir, multi, ""); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, path := range []string{"a", filepath.Join("sub", "b")} {
+		if info, err := os.Stat(filepath.Join(outputDir, path)); err != nil || info.Size() != 0 {
+			t.Errorf("%s: got %v, %v", path, info, err)
+		}
+	}
+}
+
+func TestVerifyLocal(t *testing.T) {
+	// Three pieces of 32 bytes and a short last one of 4
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var pieces []byte
+	for off := 0; off < len(data); off += 32 {
+		hash := sha1.Sum(data[off:min(off+32, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	dir := t.TempDir()
+	torrentPath := filepath.Join(dir, "test.torrent")
+	raw := fmt.Sprintf("d8:announce27:http://127.0.0.1:1/announce4:infod6:lengthi100e4:name8:test.bin12:piece lengthi32e6:pieces%d:%see", len(pieces), pieces)
+	if err := os.WriteFile(torrentPath, []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tor, err := torrent.Load(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "test.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var matched bool
+	out := captureStdout(t, func() { matched, err = verifyLocal(tor, path, 2) })
+	if err != nil || !matched || out != "Matched: 4/4 pieces\nAll pieces match\n" {
+		t.Errorf("intact file: got %v, %v and\n%s", matched, err, out)
+	}
+
+	// A flipped byte in the short last piece
+	data[98] ^= 0x01
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out = captureStdout(t, func() { matched, err = verifyLocal(tor, path, 2) })
+	if err != nil || matched || out != "Matched: 3/4 pieces\nMismatched pieces: [3]\n" {
+		t.Errorf("flipped byte: got %v, %v and\n%s", matched, err, out)
+	}
+}
+
+func TestTorrentInfoJSONKeys(t *testing.T) {
+	single := torrent.Torrent{Announce: "http://tracker/announce", Info: torrent.Info{
+		Name: "a.bin", Length: 40, PieceLength: 16, Pieces: strings.Repeat("h", 60), InfoHash: make([]byte, 20),
+	}}
+	multi := single
+	multi.AnnounceList = [][]string{{"http://tracker/announce"}, {"udp://backup:80"}}
+	multi.Info.Name = "dir"
+	multi.Info.Files = []torrent.FileEntry{{Path: []string{"a"}, Length: 30}, {Path: []string{"sub", "b"}, Length: 10}}
+
+	common := []string{"announce", "info_hash", "length", "name", "piece_count", "piece_length"}
+	for _, tc := range []struct {
+		name string
+		tor  torrent.Torrent
+		want []string
+	}{
+		{"single-file", single, common},
+		{"multi-file", multi, []string{"announce", "announce_list", "files", "info_hash", "length", "name", "piece_count", "piece_length"}},
+	} {
+		data, err := json.Marshal(newTorrentInfo(tc.tor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for key := range decoded {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, tc.want) {
+			t.Errorf("%s: got keys %q, want %q", tc.name, keys, tc.want)
+		}
+		if decoded["piece_count"] != 3.0 || decoded["info_hash"] != strings.Repeat("00", 20) {
+			t.Errorf("%s: got %s", tc.name, data)
+		}
+	}
+
+	data, _ := json.Marshal(newTorrentInfo(multi))
+	if want := `"files":[{"path":["a"],"length":30},{"path":["sub","b"],"length":10}]`; !strings.Contains(string(data), want) {
+		t.Errorf("got %s, want it to contain %s", data, want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// pauseSignals is empty where SIGUSR1 doesn't exist, so downloads can't be
+// paused by signal there.
+var pauseSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// pauseSignals pause and resume a running download_parallel.
+var pauseSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,245 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Decoder decodes bencode. Dictionaries with duplicate keys are malformed:
+// a Strict decoder rejects them, while otherwise the last value is kept and
+// OnDuplicate, if set, is told the key.
+type Decoder struct {
+	Strict      bool
+	OnDuplicate func(key string)
+}
+
+// Decode decodes the bencoded value starting at st in b with the default
+// Decoder.
+func Decode(b string, st int) (x interface{}, i int, err error) {
+	return Decoder{}.Decode(b, st)
+}
+
+// Decode decodes the bencoded value starting at st in b and returns it with
+// the offset just past it.
+func (d Decoder) Decode(b string, st int) (x interface{}, i int, err error) {
+	// fmt.Println(st)
+	if st == len(b) {
+		return nil, st, io.ErrUnexpectedEOF
+	}
+	i = st
+	switch {
+	case b[i] == 'l':
+		return d.decodeList(b, i)
+	case b[i] == 'i':
+		return decodeInt(b, i)
+	case b[i] >= '0' && b[i] <= '9':
+		return decodeString(b, i)
+	case b[i] == 'd':
+		return d.decodeDict(b, i)
+	default:
+		return nil, st, fmt.Errorf("unexpected value: %q", b[i])
+	}
+}
+
+func decodeString(b string, st int) (x string, i int, err error) {
+	var l int
+	i = st
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		l = l*10 + (int(b[i]) - '0')
+		i++
+	}
+	if i == len(b) || b[i] != ':' {
+		return "", st, fmt.Errorf("bad string")
+	}
+	i++
+	if i+l > len(b) {
+		return "", st, fmt.Errorf("bad string: out of bounds")
+	}
+	x = b[i : i+l]
+	i += l
+	return x, i, nil
+}
+
+func decodeInt(b string, st int) (x int, i int, err error) {
+	i = st
+	i++ // 'i'
+	if i == len(b) {
+		return 0, st, fmt.Errorf("bad int")
+	}
+	neg := false
+	if b[i] == '-' {
+		neg = true
+		i++
+	}
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		x = x*10 + (int(b[i]) - '0')
+		i++
+	}
+	if i == len(b) || b[i] != 'e' {
+		return 0, st, fmt.Errorf("bad int")
+	}
+	i++
+	if neg {
+		x = -x
+	}
+	return x, i, nil
+}
+
+func (d Decoder) decodeList(b string, st int) (l []interface{}, i int, err error) {
+	i = st
+	i++ // 'l'
+	l = make([]interface{}, 0)
+	for {
+		if i >= len(b) {
+			return nil, st, fmt.Errorf("bad list")
+		}
+		if b[i] == 'e' {
+			break
+		}
+		var x interface{}
+		x, i, err = d.Decode(b, i)
+		if err != nil {
+			return nil, i, err
+		}
+		l = append(l, x)
+	}
+	i++
+	return l, i, nil
+}
+
+// decodeDict decodes a dictionary with the default Decoder.
+func decodeDict(b string, st int) (m map[string]interface{}, i int, err error) {
+	return Decoder{}.decodeDict(b, st)
+}
+
+func (d Decoder) decodeDict(b string, st int) (m map[string]interface{}, i int, err error) {
+	i = st
+	i++
+	m = make(map[string]interface{})
+	for {
+		if i >= len(b) {
+			return nil, st, fmt.Errorf("bad dictionary")
+		}
+		if b[i] == 'e' {
+			break
+		}
+		var key string
+		key, i, err = decodeString(b, i)
+		if err != nil {
+			return nil, i, err
+		}
+		if _, dup := m[key]; dup {
+			if d.Strict {
+				return nil, i, fmt.Errorf("duplicate dictionary key %q", key)
+			}
+			if d.OnDuplicate != nil {
+				d.OnDuplicate(key)
+			}
+		}
+		var value interface{}
+		value, i, err = d.Decode(b, i)
+		if err != nil {
+			return nil, i, err
+		}
+		m[key] = value
+	}
+	i++
+	return m, i, nil
+}
+
+// RawInfoDict returns the info dictionary exactly as it appears in the
+// bencoded torrent b, located by the offsets the decoder reports rather than
+// by re-encoding it.
+func RawInfoDict(b string) (string, error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return "", fmt.Errorf("torrent is not a dictionary")
+	}
+	i := 1
+	for i < len(b) && b[i] != 'e' {
+		key, next, err := decodeString(b, i)
+		if err != nil {
+			return "", err
+		}
+		start := next
+		_, i, err = Decode(b, start)
+		if err != nil {
+			return "", err
+		}
+		if key == "info" {
+			if b[start] != 'd' {
+				return "", fmt.Errorf("info is not a dictionary")
+			}
+			return b[start:i], nil
+		}
+	}
+	return "", fmt.Errorf("torrent has no info dictionary")
+}
+
+// rawInfoHash returns the SHA-1 of the info dictionary's bytes exactly as they
+// appear in the torrent raw. Re-encoding the decoded dictionary could reorder
+// keys or change values a sloppy encoder wrote, giving the wrong info hash.
+func rawInfoHash(raw []byte) ([]byte, error) {
+	info, err := RawInfoDict(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum([]byte(info))
+	return hash[:], nil
+}
+
+// encodeBencode encodes v as bencode. Dictionary keys are sorted as raw byte
+// strings, as the spec requires, so equal values always encode to the same
+// bytes.
+func encodeBencode(v interface{}) ([]byte, error) {
+	return appendBencode(nil, v)
+}
+
+// appendBencode appends the bencoding of v to b.
+func appendBencode(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		b = strconv.AppendInt(b, int64(len(v)), 10)
+		b = append(b, ':')
+		return append(b, v...), nil
+	case []byte:
+		// Binary values such as the pieces blob are emitted verbatim
+		b = strconv.AppendInt(b, int64(len(v)), 10)
+		b = append(b, ':')
+		return append(b, v...), nil
+	case int:
+		b = append(b, 'i')
+		b = strconv.AppendInt(b, int64(v), 10)
+		return append(b, 'e'), nil
+	case []interface{}:
+		b = append(b, 'l')
+		for _, item := range v {
+			var err error
+			if b, err = appendBencode(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// Go compares strings bytewise, which is the order bencode wants
+		sort.Strings(keys)
+
+		b = append(b, 'd')
+		for _, key := range keys {
+			var err error
+			b, _ = appendBencode(b, key)
+			if b, err = appendBencode(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	default:
+		return nil, fmt.Errorf("unsupported type: %T", v)
+	}
+}
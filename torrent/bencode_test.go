@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeBencodeBinary(t *testing.T) {
+	got, err := encodeBencode(map[string]interface{}{"blob": []byte{0x00, 'a', 0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d4:blob3:\x00a\xffe"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEncodeBencodePiecesRoundTrip(t *testing.T) {
+	tor, err := Load("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawInfo, err := RawInfoDict(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _, err := decodeDict(rawInfo, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info["pieces"] = []byte(info["pieces"].(string))
+
+	encoded, err := encodeBencode(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, []byte(rawInfo)) {
+		t.Fatal("re-encoded info dictionary differs from the original")
+	}
+	if hash := sha1.Sum(encoded); !bytes.Equal(hash[:], tor.Info.InfoHash) {
+		t.Errorf("re-encoded info hashes to %x, want %x", hash, tor.Info.InfoHash)
+	}
+}
+
+func TestEncodeBencodeRoundTrip(t *testing.T) {
+	raw, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := decodeDict(string(raw), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encodeBencode(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Error("re-encoded torrent differs from the original")
+	}
+}
+
+func TestEncodeBencodeSortsKeysAsBytes(t *testing.T) {
+	// Upper case sorts before lower case and 0xff after both
+	got, err := encodeBencode(map[string]interface{}{"b": 1, "a": []interface{}{"x", []byte{0, 0xff}}, "\xff": 2, "B": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d1:Bi3e1:al1:x2:\x00\xffe1:bi1e1:\xffi2ee"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeDuplicateKeys(t *testing.T) {
+	const dup = "d1:ai1e1:bi2e1:ai3ee"
+
+	var reported []string
+	d := Decoder{OnDuplicate: func(key string) { reported = append(reported, key) }}
+	value, _, err := d.Decode(dup, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := value.(map[string]interface{})["a"]; got != 3 {
+		t.Errorf("got a = %v, want the last value 3", got)
+	}
+	if len(reported) != 1 || reported[0] != "a" {
+		t.Errorf("reported duplicates %q, want [a]", reported)
+	}
+
+	if _, _, err := (Decoder{Strict: true}).Decode(dup, 0); err == nil {
+		t.Error("strict decoder accepted a duplicate key")
+	}
+	// Keys may repeat in different dictionaries
+	if _, _, err := (Decoder{Strict: true}).Decode("d1:ad1:ai1ee1:bd1:ai2eee", 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRawInfoDictHashesToInfoHash(t *testing.T) {
+	raw, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := RawInfoDict(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha1.Sum([]byte(info)); hex.EncodeToString(hash[:]) != "d69f91e6b2ae4c542468d1073a71d4ea13879a7f" {
+		t.Errorf("sample info dictionary hashes to %x", hash)
+	}
+
+	// Keys out of order would be sorted by re-encoding, changing the hash;
+	// the raw bytes must come back exactly as written
+	const unsorted = "d4:name1:x6:lengthi1ee"
+	info, err = RawInfoDict("d8:announce3:url4:info" + unsorted + "7:comment2:hie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != unsorted {
+		t.Errorf("got %q, want %q", info, unsorted)
+	}
+
+	if _, err := RawInfoDict("d8:announce3:urle"); err == nil {
+		t.Error("found an info dictionary in a torrent without one")
+	}
+}
+
+func TestDecodeDictNestedValues(t *testing.T) {
+	value, next, err := decodeDict("d4:infod6:lengthi5eee", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != len("d4:infod6:lengthi5eee") {
+		t.Errorf("stopped at %d", next)
+	}
+	want := map[string]interface{}{"info": map[string]interface{}{"length": 5}}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("got %v, want %v", value, want)
+	}
+
+	// A list value followed by another key
+	value, _, err = decodeDict("d1:al1:xi2ee1:bd1:c1:dee", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{"a": []interface{}{"x", 2}, "b": map[string]interface{}{"c": "d"}}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("got %v, want %v", value, want)
+	}
+}
@@ -0,0 +1,43 @@
+package torrent
+
+// Bitfield records which pieces are available, as in a bitfield message:
+// the high bit of the first byte is piece 0.
+type Bitfield []byte
+
+func NewBitfield(pieceCnt int) Bitfield {
+	return make(Bitfield, (pieceCnt+7)/8)
+}
+
+// HasPiece reports whether index is set. Indices outside the bitfield are
+// never set.
+func (b Bitfield) HasPiece(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (b Bitfield) SetPiece(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] |= 0x80 >> (index % 8)
+}
+
+func (b Bitfield) ClearPiece(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] &^= 0x80 >> (index % 8)
+}
+
+// Useful returns the pieces set both in b, the pieces we still need, and in
+// have, the pieces a peer has. Bytes missing from a shorter have count as
+// unset, and spare bits past the end of b stay clear since b never sets them.
+func (b Bitfield) Useful(have Bitfield) Bitfield {
+	useful := make(Bitfield, len(b))
+	for i := 0; i < len(b) && i < len(have); i++ {
+		useful[i] = b[i] & have[i]
+	}
+	return useful
+}
@@ -0,0 +1,83 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBitfieldBitOrder(t *testing.T) {
+	b := Bitfield{0x80, 0x01}
+	for index := 0; index < 16; index++ {
+		if got, want := b.HasPiece(index), index == 0 || index == 15; got != want {
+			t.Errorf("piece %d: got %v, want %v", index, got, want)
+		}
+	}
+
+	b = NewBitfield(10)
+	b.SetPiece(1)
+	b.SetPiece(8)
+	if !bytes.Equal(b, Bitfield{0x40, 0x80}) {
+		t.Errorf("setting pieces 1 and 8 gave %08b", b)
+	}
+	b.ClearPiece(1)
+	if !bytes.Equal(b, Bitfield{0x00, 0x80}) {
+		t.Errorf("clearing piece 1 gave %08b", b)
+	}
+}
+
+func TestBitfieldOutOfRange(t *testing.T) {
+	b := Bitfield{0xff}
+	for _, index := range []int{-1, 8, 100} {
+		if b.HasPiece(index) {
+			t.Errorf("piece %d is set", index)
+		}
+		b.SetPiece(index)
+		b.ClearPiece(index)
+	}
+	if !bytes.Equal(b, Bitfield{0xff}) {
+		t.Errorf("out of range indices changed the bitfield to %08b", b)
+	}
+	if Bitfield(nil).HasPiece(0) {
+		t.Error("piece 0 is set in an empty bitfield")
+	}
+}
+
+func TestPeerLackingPieceFailsFast(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{2: true}}).start(t)
+	_, have, err := newTestClient(t).downloadPieceFromPeer(context.Background(), tor, "tcp", peer, 2)
+	if !errors.Is(err, errPeerLacksPiece) {
+		t.Fatalf("got %v, want %v", err, errPeerLacksPiece)
+	}
+	if !have.HasPiece(1) || have.HasPiece(2) {
+		t.Errorf("got bitfield %08b", have)
+	}
+}
+
+func TestBitfieldUseful(t *testing.T) {
+	// 10 pieces, needing all but piece 1
+	needed := NewBitfield(10)
+	for i := 0; i < 10; i++ {
+		if i != 1 {
+			needed.SetPiece(i)
+		}
+	}
+	tests := []struct {
+		name string
+		have Bitfield
+		want Bitfield
+	}{
+		{"has everything", Bitfield{0xff, 0xc0}, Bitfield{0xbf, 0xc0}},
+		{"sets spare bits", Bitfield{0xff, 0xff}, Bitfield{0xbf, 0xc0}},
+		{"shorter", Bitfield{0x60}, Bitfield{0x20, 0x00}},
+		{"longer", Bitfield{0x00, 0x40, 0xff}, Bitfield{0x00, 0x40}},
+		{"empty", nil, Bitfield{0x00, 0x00}},
+	}
+	for _, test := range tests {
+		if got := needed.Useful(test.have); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %08b, want %08b", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultPeerIDPrefix is the Azureus-style client prefix of our peer ID.
+const DefaultPeerIDPrefix = "-GZ0001-"
+
+// minPeerIDRandomBytes is how many random bytes a peer ID must keep after
+// the client prefix so IDs stay unique.
+const minPeerIDRandomBytes = 8
+
+// Defaults NewClient fills in.
+const (
+	DefaultListenPort     = 6881
+	DefaultUserAgent      = "bittorrent-go/0.1"
+	DefaultTrackerRetries = 3
+	// DefaultKeepAliveInterval leaves a margin for slow links, since peers
+	// drop connections idle for about two minutes.
+	DefaultKeepAliveInterval = 90 * time.Second
+)
+
+// Client holds what the downloads, announces and seeding of one program
+// share: who we are to peers and trackers, how connections are made and
+// throttled, and where progress is reported. Create one with NewClient and
+// set its fields before first use.
+type Client struct {
+	// PeerID is the 20-byte peer ID sent in handshakes and announces.
+	PeerID string
+	// ListenPort is the port we tell trackers peers can reach us on. Listen
+	// updates it to the port actually bound.
+	ListenPort int
+	// UserAgent is sent with every tracker request and in our extension
+	// handshake; some private trackers only accept whitelisted clients.
+	UserAgent string
+	// TrackerRetries is how many times a tracker request is retried after a
+	// transient failure: a network error such as a DNS timeout or refused
+	// connection, or a status like 503 that says to try again later.
+	TrackerRetries int
+	// TrackerTLSConfig is the TLS configuration for https:// trackers. It is
+	// read when the first tracker request is made.
+	TrackerTLSConfig *tls.Config
+	// Dialer opens every outbound peer and tracker connection, so a proxy or
+	// a test transport can be swapped in at one place. nil means a plain
+	// net.Dialer.
+	Dialer Dialer
+	// KeepAliveInterval is how long a peer connection may go without us
+	// writing anything while a piece downloads over it before we send a
+	// keep-alive. 0 disables keep-alives.
+	KeepAliveInterval time.Duration
+	// MaxDownloadRate caps the bytes per second of piece data read from all
+	// peers together. 0 means no limit.
+	MaxDownloadRate int
+	// MaxPeerDownloadRate caps the bytes per second of piece data read from
+	// each peer. 0 means no limit.
+	MaxPeerDownloadRate int
+	// Verbose turns on the per-piece download logs; without it downloads
+	// show a progress bar instead when Log is a terminal.
+	Verbose bool
+	// Log receives progress messages; nil discards them.
+	Log io.Writer
+
+	trackerOnce   sync.Once
+	trackerClient *http.Client
+	// startedTrackers records, per torrent, the trackers we have sent
+	// "started" to, so later announces omit the event and "completed" and
+	// "stopped" reach every tracker that knows about us.
+	startedTrackers sync.Map
+	// limiters holds the rate limiters for MaxDownloadRate and
+	// MaxPeerDownloadRate.
+	limiters limiterSet
+}
+
+// NewClient returns a Client with a fresh peer ID and the default settings.
+func NewClient() (*Client, error) {
+	peerID, err := GeneratePeerID(DefaultPeerIDPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		PeerID:            peerID,
+		ListenPort:        DefaultListenPort,
+		UserAgent:         DefaultUserAgent,
+		TrackerRetries:    DefaultTrackerRetries,
+		TrackerTLSConfig:  &tls.Config{},
+		KeepAliveInterval: DefaultKeepAliveInterval,
+	}, nil
+}
+
+// GeneratePeerID returns a 20-byte peer ID made of prefix followed by random
+// bytes.
+func GeneratePeerID(prefix string) (string, error) {
+	if len(prefix) > 20-minPeerIDRandomBytes {
+		return "", fmt.Errorf("peer ID prefix %q is too long (max %d bytes)", prefix, 20-minPeerIDRandomBytes)
+	}
+	random := make([]byte, 20-len(prefix))
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return prefix + string(random), nil
+}
+
+// logf writes a progress message to c.Log, if there is one. A nil client
+// logs nothing.
+func (c *Client) logf(format string, args ...any) {
+	if c != nil && c.Log != nil {
+		fmt.Fprintf(c.Log, format, args...)
+	}
+}
+
+// verbosef logs like logf, but only with Verbose set.
+func (c *Client) verbosef(format string, args ...any) {
+	if c != nil && c.Verbose {
+		c.logf(format, args...)
+	}
+}
+
+// dialer returns the Dialer for outbound connections.
+func (c *Client) dialer() Dialer {
+	if c.Dialer == nil {
+		return &net.Dialer{}
+	}
+	return c.Dialer
+}
+
+// httpClient returns the HTTP client for tracker requests, built on first
+// use from TrackerTLSConfig. It dials through c.Dialer, whatever that is at
+// the time.
+func (c *Client) httpClient() *http.Client {
+	c.trackerOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.TrackerTLSConfig
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.dialer().DialContext(ctx, network, address)
+		}
+		c.trackerClient = &http.Client{Transport: transport, Timeout: trackerTimeout}
+	})
+	return c.trackerClient
+}
@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeneratePeerIDPrefix(t *testing.T) {
+	const prefix = "-XY1234-"
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := GeneratePeerID(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 20 || !strings.HasPrefix(id, prefix) {
+			t.Fatalf("got %q, want 20 bytes starting %q", id, prefix)
+		}
+		if seen[id] {
+			t.Fatalf("peer ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+
+	if _, err := GeneratePeerID("-TOOLONGPREFIX-"); err == nil {
+		t.Error("accepted a prefix leaving fewer than 8 random bytes")
+	}
+	if _, err := GeneratePeerID("-ABCDEFGHIJK"); err != nil {
+		t.Errorf("rejected a 12-byte prefix: %v", err)
+	}
+}
+
+func TestNewClientPeerID(t *testing.T) {
+	a, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(a.PeerID, DefaultPeerIDPrefix) || len(a.PeerID) != 20 {
+		t.Errorf("got peer ID %q, want 20 bytes starting %q", a.PeerID, DefaultPeerIDPrefix)
+	}
+	if a.PeerID == b.PeerID {
+		t.Error("two clients share a peer ID")
+	}
+
+	// The same ID goes to the tracker on every announce
+	peerIDs := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerIDs <- r.URL.Query().Get("peer_id")
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL + "/announce"
+	for i := 0; i < 2; i++ {
+		if _, err := a.Peers(tor); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-peerIDs; got != a.PeerID {
+			t.Errorf("announce %d sent peer ID %q, want %q", i, got, a.PeerID)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// bufferedConn is a peer connection whose reads go through a bufio.Reader, so
+// the many small length-prefix reads don't each cost a syscall. Exact reads
+// must still use io.ReadFull since a buffered Read may return short.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// writeFull writes all of buf, looping over short writes so a message is
+// never left half-sent on the wire.
+func writeFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// clock tells the time and makes timers, so tests can control time.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is the part of a time.Timer the keep-alive loop uses.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// keepAliveConn serializes writes to a peer connection and records when it
+// was last written to, so keepAlive can send a keep-alive message whenever
+// nothing else has been written for the keep-alive interval.
+type keepAliveConn struct {
+	net.Conn
+	interval  time.Duration
+	clock     clock
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+func newKeepAliveConn(conn net.Conn, interval time.Duration) *keepAliveConn {
+	return &keepAliveConn{Conn: conn, interval: interval, clock: realClock{}, lastWrite: time.Now()}
+}
+
+func (c *keepAliveConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastWrite = c.clock.Now()
+	// Write the whole message under the lock so a keep-alive can't land in
+	// the middle of it
+	if err := writeFull(c.Conn, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// keepAlive sends a keep-alive each time the connection has gone the
+// interval without a write, until ctx is done or a write fails. It does
+// nothing if keep-alives are disabled.
+func (c *keepAliveConn) keepAlive(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+	c.mu.Lock()
+	wait := c.interval - c.clock.Now().Sub(c.lastWrite)
+	c.mu.Unlock()
+	for {
+		timer := c.clock.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		c.mu.Lock()
+		idle := c.clock.Now().Sub(c.lastWrite)
+		if idle >= c.interval {
+			if err := writeFull(c.Conn, []byte{0, 0, 0, 0}); err != nil {
+				c.mu.Unlock()
+				return
+			}
+			c.lastWrite = c.clock.Now()
+			idle = 0
+		}
+		c.mu.Unlock()
+		wait = c.interval - idle
+	}
+}
+
+// startKeepAlive keeps conn alive until ctx is done or the returned function
+// is called, if conn was opened by DialPeer.
+func startKeepAlive(ctx context.Context, conn net.Conn) (stop func()) {
+	kc, ok := conn.(*keepAliveConn)
+	if !ok {
+		return func() {}
+	}
+	ctx, stop = context.WithCancel(ctx)
+	go kc.keepAlive(ctx)
+	return stop
+}
+
+// Dialer opens outbound connections; see Client.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialPeer connects to a peer and buffers its reads. Its writes are tracked
+// so that piece downloads over it can send keep-alives while it is idle.
+func (c *Client) DialPeer(network string, peerAddress string) (net.Conn, error) {
+	return c.dialPeerContext(context.Background(), network, peerAddress)
+}
+
+// dialPeerContext is DialPeer giving up once ctx is done.
+func (c *Client) dialPeerContext(ctx context.Context, network string, peerAddress string) (net.Conn, error) {
+	conn, err := c.dialer().DialContext(ctx, network, peerAddress)
+	if err != nil {
+		return nil, err
+	}
+	buffered := &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, 32*1024)}
+	return newKeepAliveConn(buffered, c.KeepAliveInterval), nil
+}
+
+// bindContext makes I/O on conn honour ctx: reads and writes fail once ctx's
+// deadline passes or as soon as ctx is cancelled. The returned function
+// detaches conn from ctx again.
+func bindContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopAfter := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return func() {
+		stopAfter()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// maxMessageLength bounds the peer messages readMessage will buffer, which
+// leaves room for the bitfield of a torrent with millions of pieces.
+const maxMessageLength = 2 * 1024 * 1024
+
+// readMessage reads one whole peer message, skipping keep-alives, and returns
+// its id and payload. The length prefix and body are read in full however the
+// bytes trickle in.
+func readMessage(conn net.Conn) (id uint8, payload []byte, err error) {
+	prefix := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(conn, prefix); err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(prefix)
+		if length == 0 {
+			continue // keep-alive
+		}
+		if length > maxMessageLength {
+			return 0, nil, fmt.Errorf("peer message too long (%d bytes)", length)
+		}
+		body := make([]byte, length)
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return 0, nil, err
+		}
+		return body[0], body[1:], nil
+	}
+}
@@ -0,0 +1,421 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when advanced. Each timer it makes is
+// also sent on created, so tests can wait for the code under test to start
+// waiting.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	created chan *fakeTimer
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	deadline time.Time
+	stopped  atomic.Bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	return !t.stopped.Swap(true)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), created: make(chan *fakeTimer, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: make(chan time.Time, 1), deadline: c.now.Add(d)}
+	c.timers = append(c.timers, t)
+	c.created <- t
+	return t
+}
+
+// advance moves the clock forward by d and fires the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.stopped.Load() {
+			continue
+		}
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func TestKeepAliveAfterInterval(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	clock := newFakeClock()
+	conn := &keepAliveConn{Conn: ours, interval: 90 * time.Second, clock: clock, lastWrite: clock.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		conn.keepAlive(ctx)
+		close(done)
+	}()
+
+	<-clock.created
+	clock.advance(89 * time.Second)
+	theirs.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := theirs.Read(make([]byte, 4)); err == nil {
+		t.Fatal("keep-alive sent before the interval elapsed")
+	}
+
+	clock.advance(time.Second)
+	theirs.SetReadDeadline(time.Now().Add(time.Second))
+	message := make([]byte, 4)
+	if _, err := io.ReadFull(theirs, message); err != nil {
+		t.Fatalf("no keep-alive after the interval: %v", err)
+	}
+	if string(message) != "\x00\x00\x00\x00" {
+		t.Fatalf("got %x, want a keep-alive", message)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keep-alive loop still running after its context was cancelled")
+	}
+}
+
+func TestKeepAliveDeferredByWrites(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	clock := newFakeClock()
+	conn := &keepAliveConn{Conn: ours, interval: 90 * time.Second, clock: clock, lastWrite: clock.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go conn.keepAlive(ctx)
+
+	<-clock.created
+	clock.advance(60 * time.Second)
+	go conn.Write([]byte{0, 0, 0, 1, 2}) // interested
+	if _, err := io.ReadFull(theirs, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// The timer for the original deadline fires, but the write 30s ago
+	// means it is not due yet
+	clock.advance(30 * time.Second)
+	<-clock.created
+	theirs.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := theirs.Read(make([]byte, 4)); err == nil {
+		t.Fatal("keep-alive sent 30s after a write")
+	}
+}
+
+// throttledConn accepts at most max bytes per Write, yielding after each,
+// and collects what was written.
+type throttledConn struct {
+	net.Conn
+	max int
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	n := min(len(p), c.max)
+	c.buf.Write(p[:n])
+	c.mu.Unlock()
+	runtime.Gosched()
+	return n, nil
+}
+
+func TestKeepAlivesDontInterleaveWrites(t *testing.T) {
+	raw := &throttledConn{max: 3}
+	conn := newKeepAliveConn(raw, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		conn.keepAlive(ctx)
+		close(stopped)
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				conn.Write(haveStream(1))
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	stream := bytes.NewReader(raw.buf.Bytes())
+	haves, keepAlives := 0, 0
+	for stream.Len() > 0 {
+		prefix := make([]byte, 4)
+		io.ReadFull(stream, prefix)
+		switch length := binary.BigEndian.Uint32(prefix); length {
+		case 0:
+			keepAlives++
+		case 5:
+			body := make([]byte, 5)
+			io.ReadFull(stream, body)
+			if body[0] != 4 {
+				t.Fatalf("message %d: got id %d", haves+keepAlives, body[0])
+			}
+			haves++
+		default:
+			t.Fatalf("message %d: length %d, the stream is interleaved", haves+keepAlives, length)
+		}
+	}
+	if haves != 150 || keepAlives == 0 {
+		t.Errorf("got %d have messages and %d keep-alives, want 150 and some", haves, keepAlives)
+	}
+}
+
+func TestWriteFullLoopsOverShortWrites(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	handshake := newTestClient(t).buildHandshake(tor, downloadReserved())
+	raw := &throttledConn{max: 2}
+	if err := writeFull(raw, handshake); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw.buf.Bytes(), handshake) {
+		t.Errorf("wrote %x, want %x", raw.buf.Bytes(), handshake)
+	}
+
+	if err := writeFull(&throttledConn{max: 0}, handshake); err != io.ErrShortWrite {
+		t.Errorf("writer that takes nothing: got %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// countingConn serves reads from r, counting the Read calls that reach it
+// the way each would cost a syscall on a socket.
+type countingConn struct {
+	net.Conn
+	r     io.Reader
+	reads int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// haveStream returns n have messages back to back.
+func haveStream(n int) []byte {
+	var stream []byte
+	for i := 0; i < n; i++ {
+		stream = append(stream, 0, 0, 0, 5, 4)
+		stream = binary.BigEndian.AppendUint32(stream, uint32(i))
+	}
+	return stream
+}
+
+// oneByteReader returns at most one byte per Read, so every message
+// boundary falls between reads.
+type oneByteReader struct{ r io.Reader }
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.r.Read(p)
+}
+
+func TestBufferedConnKeepsMessageBoundaries(t *testing.T) {
+	raw := &countingConn{r: oneByteReader{bytes.NewReader(haveStream(100))}}
+	conn := &bufferedConn{Conn: raw, reader: bufio.NewReaderSize(raw, 16)}
+	for i := 0; i < 100; i++ {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 4 || binary.BigEndian.Uint32(payload) != uint32(i) {
+			t.Fatalf("message %d: got id %d payload %x", i, id, payload)
+		}
+	}
+	if _, _, err := readMessage(conn); err != io.EOF {
+		t.Errorf("got %v after the last message, want EOF", err)
+	}
+}
+
+func TestReadMessageTrickled(t *testing.T) {
+	block := make([]byte, 16*1024)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	piece := append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, block...)
+	var stream []byte
+	stream = binary.BigEndian.AppendUint32(stream, uint32(1+len(piece)))
+	stream = append(stream, 7)
+	stream = append(stream, piece...)
+	stream = append(stream, 0, 0, 0, 0) // keep-alive
+	stream = append(stream, haveStream(1)...)
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go func() {
+		defer theirs.Close()
+		for i := range stream {
+			if _, err := theirs.Write(stream[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+
+	id, payload, err := readMessage(ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 || !bytes.Equal(payload, piece) {
+		t.Fatalf("got id %d with %d bytes, want the whole piece message", id, len(payload))
+	}
+	id, payload, err = readMessage(ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 || binary.BigEndian.Uint32(payload) != 0 {
+		t.Fatalf("got id %d payload %x after the keep-alive, want have 0", id, payload)
+	}
+	if _, _, err := readMessage(ours); err != io.EOF {
+		t.Errorf("got %v after the last message, want EOF", err)
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	const messages = 10000
+	stream := haveStream(messages)
+	for _, buffered := range []bool{false, true} {
+		name := "raw"
+		if buffered {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(stream)))
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				raw := &countingConn{r: bytes.NewReader(stream)}
+				var conn net.Conn = raw
+				if buffered {
+					conn = &bufferedConn{Conn: raw, reader: bufio.NewReaderSize(raw, 32*1024)}
+				}
+				for j := 0; j < messages; j++ {
+					if _, _, err := readMessage(conn); err != nil {
+						b.Fatal(err)
+					}
+				}
+				reads += raw.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// queuedConn queues its writes for a goroutine to send, so like a TCP socket
+// with room in its buffers a write to a net.Pipe doesn't wait for the other
+// end to read.
+type queuedConn struct {
+	net.Conn
+	writes chan []byte
+}
+
+func newQueuedConn(conn net.Conn) *queuedConn {
+	q := &queuedConn{Conn: conn, writes: make(chan []byte, 1024)}
+	go func() {
+		for p := range q.writes {
+			writeFull(conn, p)
+		}
+		conn.Close()
+	}()
+	return q
+}
+
+func (q *queuedConn) Write(p []byte) (int, error) {
+	q.writes <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func (q *queuedConn) Close() error {
+	close(q.writes)
+	return nil
+}
+
+// pipeDialer connects every dial to seeder over net.Pipe, recording the
+// addresses dialed.
+type pipeDialer struct {
+	seeder *testSeeder
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	client, server := net.Pipe()
+	go d.seeder.serve(newQueuedConn(server))
+	return client, nil
+}
+
+func TestDownloadOverInjectedDialer(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	dialer := &pipeDialer{seeder: &testSeeder{torrent: tor, data: data}}
+	c := newTestClient(t)
+	c.Dialer = dialer
+
+	// The address doesn't resolve; only the dialer can reach it
+	const peer = "mock.invalid:6881"
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := c.Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the torrent's")
+	}
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	for _, address := range dialer.dialed {
+		if address != peer {
+			t.Errorf("dialed %s, want only %s", address, peer)
+		}
+	}
+	if len(dialer.dialed) == 0 {
+		t.Error("the dialer was never used")
+	}
+}
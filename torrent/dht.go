@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// dhtBootstrapNodes are the DHT nodes a lookup starts from.
+var dhtBootstrapNodes = []string{"router.bittorrent.com:6881"}
+
+// dhtQueryTimeout is how long each lookup round waits for answers;
+// dhtLookupTimeout bounds the whole lookup.
+var (
+	dhtQueryTimeout  = 3 * time.Second
+	dhtLookupTimeout = 30 * time.Second
+)
+
+const (
+	// dhtAlpha is how many nodes each lookup round queries.
+	dhtAlpha = 8
+	// dhtWantPeers is how many peers end a lookup early.
+	dhtWantPeers = 50
+)
+
+// errDHTProxied is returned instead of looking a torrent up in the DHT
+// behind a proxy.
+var errDHTProxied = fmt.Errorf("DHT is disabled behind a proxy, which can't carry its UDP traffic")
+
+// dhtContact is a DHT node; id is nil for bootstrap nodes, whose IDs we
+// don't know.
+type dhtContact struct {
+	id   []byte
+	addr string
+}
+
+// dhtQuery encodes a KRPC query (BEP 5) for method with transaction ID tid.
+func dhtQuery(tid string, method string, args map[string]interface{}) ([]byte, error) {
+	return encodeBencode(map[string]interface{}{"t": tid, "y": "q", "q": method, "a": args})
+}
+
+// getPeersQuery encodes a get_peers query for infoHash from the node id.
+func getPeersQuery(tid string, id []byte, infoHash []byte) ([]byte, error) {
+	return dhtQuery(tid, "get_peers", map[string]interface{}{"id": id, "info_hash": infoHash})
+}
+
+// parseDHTResponse decodes a KRPC message into its transaction ID and, for a
+// response, its "r" dictionary. A KRPC error message is returned as an error.
+func parseDHTResponse(data []byte) (tid string, r map[string]interface{}, err error) {
+	msg, _, err := decodeDict(string(data), 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad KRPC message: %v", err)
+	}
+	tid, _ = msg["t"].(string)
+	switch msg["y"] {
+	case "r":
+		r, ok := msg["r"].(map[string]interface{})
+		if !ok {
+			return tid, nil, fmt.Errorf("KRPC response without r")
+		}
+		return tid, r, nil
+	case "e":
+		return tid, nil, fmt.Errorf("KRPC error: %v", msg["e"])
+	default:
+		return tid, nil, fmt.Errorf("unexpected KRPC message type %v", msg["y"])
+	}
+}
+
+// parseGetPeersResponse returns the peers ("values", compact 6-byte entries)
+// and the closer nodes ("nodes", compact 26-byte node info) of a get_peers
+// response.
+func parseGetPeersResponse(r map[string]interface{}) (peers []string, nodes []dhtContact, err error) {
+	if values, ok := r["values"].([]interface{}); ok {
+		for _, value := range values {
+			entry, ok := value.(string)
+			if !ok || len(entry) != 6 {
+				return nil, nil, fmt.Errorf("invalid peer in get_peers values")
+			}
+			compact, _ := parseCompactPeers([]byte(entry), 6)
+			peers = append(peers, compact...)
+		}
+	}
+	if compact, ok := r["nodes"].(string); ok {
+		if len(compact)%26 != 0 {
+			return nil, nil, fmt.Errorf("invalid compact nodes length %d", len(compact))
+		}
+		for i := 0; i < len(compact); i += 26 {
+			ip := net.IP([]byte(compact[i+20 : i+24]))
+			port := binary.BigEndian.Uint16([]byte(compact[i+24 : i+26]))
+			nodes = append(nodes, dhtContact{
+				id:   []byte(compact[i : i+20]),
+				addr: net.JoinHostPort(ip.String(), strconv.Itoa(int(port))),
+			})
+		}
+	}
+	return peers, nodes, nil
+}
+
+// dhtDistance is the XOR distance from id to target; an unknown id counts as
+// the farthest possible.
+func dhtDistance(id []byte, target []byte) []byte {
+	distance := make([]byte, len(target))
+	for i := range distance {
+		if id == nil {
+			distance[i] = 0xff
+		} else {
+			distance[i] = id[i] ^ target[i]
+		}
+	}
+	return distance
+}
+
+// DHTPeers looks infoHash up in the DHT. Starting from the bootstrap nodes,
+// each round sends get_peers to the dhtAlpha closest nodes not yet asked and
+// collects the peers and closer nodes they answer with. The lookup ends once
+// dhtWantPeers peers turned up, no unasked node is closer than the closest
+// that answered, or dhtLookupTimeout runs out. It refuses to run behind a
+// proxy.
+func (c *Client) DHTPeers(infoHash []byte) (peers []string, err error) {
+	if c.Proxied() {
+		return nil, errDHTProxied
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	var candidates []dhtContact
+	for _, addr := range dhtBootstrapNodes {
+		candidates = append(candidates, dhtContact{addr: addr})
+	}
+	queried := make(map[string]bool)
+	var closest []byte
+	deadline := time.Now().Add(dhtLookupTimeout)
+	buf := make([]byte, 65536)
+	var tid uint16
+
+	for len(peers) < dhtWantPeers && time.Now().Before(deadline) {
+		slices.SortFunc(candidates, func(a, b dhtContact) int {
+			return bytes.Compare(dhtDistance(a.id, infoHash), dhtDistance(b.id, infoHash))
+		})
+
+		pending := make(map[string]dhtContact)
+		for _, node := range candidates {
+			if len(pending) == dhtAlpha {
+				break
+			}
+			if queried[node.addr] {
+				continue
+			}
+			if len(pending) == 0 && closest != nil && bytes.Compare(dhtDistance(node.id, infoHash), closest) >= 0 {
+				break
+			}
+			queried[node.addr] = true
+			addr, err := net.ResolveUDPAddr("udp4", node.addr)
+			if err != nil {
+				c.logf("DHT node %v failed: %v\n", node.addr, err)
+				continue
+			}
+			tid++
+			t := string(binary.BigEndian.AppendUint16(nil, tid))
+			query, err := getPeersQuery(t, id, infoHash)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.WriteTo(query, addr); err != nil {
+				continue
+			}
+			pending[t] = node
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		roundEnd := time.Now().Add(dhtQueryTimeout)
+		if roundEnd.After(deadline) {
+			roundEnd = deadline
+		}
+		conn.SetReadDeadline(roundEnd)
+		for len(pending) > 0 {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // round timed out
+			}
+			t, r, err := parseDHTResponse(buf[:n])
+			node, ok := pending[t]
+			if !ok {
+				continue
+			}
+			delete(pending, t)
+			if err != nil {
+				continue
+			}
+			found, nodes, err := parseGetPeersResponse(r)
+			if err != nil {
+				continue
+			}
+			if node.id != nil {
+				if distance := dhtDistance(node.id, infoHash); closest == nil || bytes.Compare(distance, closest) < 0 {
+					closest = distance
+				}
+			}
+			peers = MergePeers(peers, found)
+			candidates = append(candidates, nodes...)
+		}
+	}
+
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("DHT lookup found no peers")
+	}
+	return peers, nil
+}
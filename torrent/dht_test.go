@@ -0,0 +1,213 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDHTNode starts a DHT node on the loopback that answers every
+// get_peers query with reply(transactionID) and returns its address.
+func fakeDHTNode(t *testing.T, reply func(tid string) string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m, _, err := decodeDict(string(buf[:n]), 0)
+			if err != nil || m["q"] != "get_peers" {
+				continue
+			}
+			conn.WriteTo([]byte(reply(m["t"].(string))), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// withBootstrapNodes points the DHT at nodes for the rest of the test.
+func withBootstrapNodes(t *testing.T, nodes ...string) {
+	old := dhtBootstrapNodes
+	dhtBootstrapNodes = nodes
+	t.Cleanup(func() { dhtBootstrapNodes = old })
+}
+
+func TestGetPeersEncoding(t *testing.T) {
+	id := bytes.Repeat([]byte{'a'}, 20)
+	infoHash := bytes.Repeat([]byte{'b'}, 20)
+	query, err := getPeersQuery("aa", id, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d1:ad2:id20:" + string(id) + "9:info_hash20:" + string(infoHash) + "e1:q9:get_peers1:t2:aa1:y1:qe"; string(query) != want {
+		t.Errorf("got query %q, want %q", query, want)
+	}
+
+	resp := "d1:rd2:id20:" + string(id) + "5:token2:xx6:valuesl6:\x7f\x00\x00\x01\x1a\xe1ee1:t2:aa1:y1:re"
+	tid, r, err := parseDHTResponse([]byte(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tid != "aa" {
+		t.Errorf("got transaction ID %q, want aa", tid)
+	}
+	peers, _, err := parseGetPeersResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got peers %q, want %q", peers, want)
+	}
+
+	if _, _, err := parseDHTResponse([]byte("d1:eli201e7:Generice1:t2:aa1:y1:ee")); err == nil {
+		t.Error("accepted an error response")
+	}
+}
+
+func TestDHTLookupFollowsNodes(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{'b'}, 20)
+	// The bootstrap node only knows a closer node, which has the peers
+	closer := fakeDHTNode(t, func(tid string) string {
+		return "d1:rd2:id20:bbbbbbbbbbbbbbbbbbbc5:token2:xx6:valuesl6:\x7f\x00\x00\x01\x1a\xe16:\x7f\x00\x00\x02\x1a\xe1ee1:t2:" + tid + "1:y1:re"
+	})
+	addr, err := net.ResolveUDPAddr("udp4", closer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := append([]byte("bbbbbbbbbbbbbbbbbbbc"), addr.IP.To4()...)
+	node = binary.BigEndian.AppendUint16(node, uint16(addr.Port))
+	bootstrap := fakeDHTNode(t, func(tid string) string {
+		return "d1:rd2:id20:zzzzzzzzzzzzzzzzzzzz5:nodes26:" + string(node) + "5:token2:xxe1:t2:" + tid + "1:y1:re"
+	})
+	withBootstrapNodes(t, bootstrap)
+
+	peers, err := newTestClient(t).DHTPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	if want := []string{"127.0.0.1:6881", "127.0.0.2:6881"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got peers %q, want %q", peers, want)
+	}
+
+	// With no tracker answering, Peers falls back to the DHT
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Info.InfoHash = infoHash
+	withFastTrackerRetries(t)
+	peers, err = newTestClient(t).Peers(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("got peers %q from the DHT fallback", peers)
+	}
+}
+
+func TestDHTPeersSkippedBehindProxy(t *testing.T) {
+	queried := make(chan struct{}, 1)
+	node := fakeDHTNode(t, func(tid string) string {
+		queried <- struct{}{}
+		return "d1:rd2:id20:zzzzzzzzzzzzzzzzzzzz5:token2:xx6:valuesl6:\x7f\x00\x00\x01\x1a\xe1ee1:t2:" + tid + "1:y1:re"
+	})
+	withBootstrapNodes(t, node)
+
+	c := newTestClient(t)
+	if err := c.UseProxy("socks5://127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DHTPeers(make([]byte, 20)); err != errDHTProxied {
+		t.Fatalf("DHTPeers behind a proxy: got %v, want %v", err, errDHTProxied)
+	}
+	select {
+	case <-queried:
+		t.Fatal("DHT node was queried behind a proxy")
+	default:
+	}
+}
+
+func TestPrivateTorrentSkipsDHT(t *testing.T) {
+	queried := make(chan struct{}, 1)
+	node := fakeDHTNode(t, func(tid string) string {
+		queried <- struct{}{}
+		return "d1:rd2:id20:zzzzzzzzzzzzzzzzzzzz5:token2:xx6:valuesl6:\x7f\x00\x00\x01\x1a\xe1ee1:t2:" + tid + "1:y1:re"
+	})
+	withBootstrapNodes(t, node)
+
+	// No tracker answers, which would otherwise fall back to the DHT
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Info.Private = true
+	withFastTrackerRetries(t)
+	if peers, err := newTestClient(t).Peers(tor); err == nil {
+		t.Fatalf("got peers %q for a private torrent with no tracker", peers)
+	}
+	select {
+	case <-queried:
+		t.Fatal("DHT node was queried for a private torrent")
+	default:
+	}
+}
+
+func TestReannounceSkipsDHT(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true}}).start(t)
+	addr, err := net.ResolveTCPAddr("tcp4", peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := binary.BigEndian.AppendUint16(addr.IP.To4(), uint16(addr.Port))
+	var lookups atomic.Int32
+	node := fakeDHTNode(t, func(tid string) string {
+		lookups.Add(1)
+		return "d1:rd2:id20:zzzzzzzzzzzzzzzzzzzz5:token2:xx6:valuesl6:" + string(compact) + "ee1:t2:" + tid + "1:y1:re"
+	})
+	withBootstrapNodes(t, node)
+	var announces atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces.Add(1)
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	defer server.Close()
+	tor.Announce = server.URL + "/announce"
+
+	// The initial lookup falls back to the DHT, which finds the seeder
+	c := newTestClient(t)
+	peers, err := c.Peers(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lookups.Load() != 1 {
+		t.Fatalf("initial discovery made %d DHT lookups, want 1", lookups.Load())
+	}
+
+	// Nobody has piece 0, so besides the periodic re-announces the piece
+	// keeps re-announcing until SwarmWait runs out
+	delay := swarmRetryDelay
+	swarmRetryDelay = 10 * time.Millisecond
+	defer func() { swarmRetryDelay = delay }()
+	opts := DownloadOptions{Network: "tcp", AnnounceInterval: 20 * time.Millisecond, SwarmWait: 300 * time.Millisecond}
+	if err := c.Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, peers, opts); err == nil {
+		t.Fatal("downloaded a piece nobody has")
+	}
+	if n := announces.Load(); n < 5 {
+		t.Errorf("re-announced only %d times", n)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("made %d DHT lookups across re-announces, want only the initial one", n)
+	}
+}
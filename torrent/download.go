@@ -0,0 +1,770 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PauseGate lets a running download be paused and resumed: workers call wait
+// before each request and block while paused.
+type PauseGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func NewPauseGate() *PauseGate {
+	g := &PauseGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Toggle flips between paused and running and reports whether it is now
+// paused.
+func (g *PauseGate) Toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = !g.paused
+	g.cond.Broadcast()
+	return g.paused
+}
+
+// wait blocks while the gate is paused. A nil gate never pauses.
+func (g *PauseGate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+}
+
+// swarmRetryDelay is how long to wait between re-announces while no known
+// peer has a needed piece.
+var swarmRetryDelay = 5 * time.Second
+
+// maxPeerPool bounds how many peers the re-announces and PEX may grow a
+// download's peer pool to.
+const maxPeerPool = 500
+
+// growPeerPool returns pool followed by the peers of found not already in it,
+// as long as the pool stays within maxPeerPool.
+func growPeerPool(pool, found []string) []string {
+	if len(pool) >= maxPeerPool {
+		return pool
+	}
+	grown := MergePeers(pool, found)
+	return grown[:min(len(grown), maxPeerPool)]
+}
+
+// forgetPeers returns pool without the peers of dropped that are in
+// forgettable, which it also removes them from. pool itself is left as is,
+// since workers may still be reading it.
+func forgetPeers(pool, dropped []string, forgettable map[string]bool) []string {
+	forget := make(map[string]bool)
+	for _, peer := range dropped {
+		if forgettable[peer] {
+			forget[peer] = true
+			delete(forgettable, peer)
+		}
+	}
+	if len(forget) == 0 {
+		return pool
+	}
+	var kept []string
+	for _, peer := range pool {
+		if !forget[peer] {
+			kept = append(kept, peer)
+		}
+	}
+	return kept
+}
+
+// DownloadOptions holds the knobs for Download.
+type DownloadOptions struct {
+	Adaptive bool
+	// Network is the dial network: "tcp", "tcp4" or "tcp6".
+	Network string
+	// HashWorkers is how many pieces may be SHA-1 verified at once.
+	HashWorkers int
+	// ResumeFlushPieces and ResumeFlushInterval bound how much progress a
+	// crash can lose: the resume state is flushed after that many pieces or
+	// that long, whichever comes first.
+	ResumeFlushPieces   int
+	ResumeFlushInterval time.Duration
+	// Stats prints which peer supplied each piece and which served bad data.
+	Stats bool
+	// TempDir, if set, is where a download without Resume is assembled
+	// before being moved to the output path on success, instead of next to
+	// the output path.
+	TempDir string
+	// Pause, if set, is checked before every piece request.
+	Pause *PauseGate
+	// Prewarm is how many peer connections to set up before the first piece
+	// is requested.
+	Prewarm int
+	// SwarmWait is how long to keep re-announcing for a piece no known peer
+	// has before giving up on it.
+	SwarmWait time.Duration
+	// PieceTimeout bounds each attempt to fetch a piece from a peer, so a
+	// stalled peer can't hold a transfer slot forever. 0 means no limit.
+	PieceTimeout time.Duration
+	// Strategy is the piece selection order: StrategySequential or
+	// StrategyRarestFirst.
+	Strategy string
+	// ETA prints progress with the rate and estimated time remaining.
+	ETA bool
+	// Resume downloads into a .part file whose finished pieces are recorded
+	// in a resume state, so an interrupted download continues where it
+	// stopped.
+	Resume bool
+	// PeerCachePath, when set, records the peers that served pieces so the
+	// next run can try them before asking the tracker.
+	PeerCachePath string
+	PeerCacheTTL  time.Duration
+	// AnnounceInterval is how often to re-announce for fresh peers while
+	// the download runs, until a tracker names its own interval. 0 disables
+	// re-announcing.
+	AnnounceInterval time.Duration
+	// InitialAnnounce, if set, is run in the background as the download
+	// starts, so the peers passed to Download, such as cached ones, are
+	// contacted without waiting on the trackers. The peers it finds join the
+	// pool when it returns, and pieces that run out of peers meanwhile wait
+	// for them. A positive interval it returns replaces AnnounceInterval.
+	InitialAnnounce func() (peers []string, interval time.Duration, err error)
+}
+
+// DefaultPieceTimeout is download_parallel's default per-attempt piece
+// deadline.
+const DefaultPieceTimeout = 2 * time.Minute
+
+// Download fetches torrent from peers into outputPath, several pieces at a
+// time. Transfers in flight are abandoned once ctx is done.
+func (c *Client) Download(ctx context.Context, outputPath string, torrent Torrent, peers []string, opts DownloadOptions) error {
+	pieceCnt := torrent.PieceCount()
+
+	if len(torrent.Info.Files) > 0 && opts.Resume {
+		return fmt.Errorf("--resume doesn't support multi-file torrents yet")
+	}
+
+	pieceChan := make(chan struct {
+		index int
+		data  []byte
+		err   error
+	}, pieceCnt)
+
+	var state *ResumeState
+	if opts.Resume {
+		var err error
+		state, err = loadResumeState(resumeStatePath(outputPath), torrent)
+		if err != nil {
+			return err
+		}
+		if err = c.reverifyResumeState(torrent, partPath(outputPath), state, opts.HashWorkers); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	// The peer pool, which the periodic re-announce and PEX grow
+	var peersMu sync.Mutex
+	currentPeers := func() []string {
+		peersMu.Lock()
+		defer peersMu.Unlock()
+		return peers
+	}
+
+	// Limit concurrent connections
+	controller := newConcurrencyController(defaultConcurrency, defaultConcurrency, false)
+	if opts.Adaptive {
+		controller = newConcurrencyController(2, maxAdaptiveConcurrency, true)
+	}
+
+	hasher := newPieceHasher(opts.HashWorkers)
+	defer hasher.close()
+
+	warm := newWarmPool(c)
+	if opts.Prewarm > 0 {
+		warm = c.prewarmConnections(torrent, opts.Network, peers, opts.Prewarm)
+		c.logf("Pre-warmed %d peer connections\n", warm.size())
+	}
+	defer warm.close()
+	// Peers we only know of through PEX, which we forget again once the
+	// peer that told us drops them
+	pexOnly := make(map[string]bool)
+	warm.discovered = func(found, dropped []string) {
+		found, err := FilterPeersByNetwork(found, opts.Network)
+		if err != nil {
+			return
+		}
+		peersMu.Lock()
+		known := len(peers)
+		peers = growPeerPool(peers, found)
+		added := len(peers) - known
+		for _, peer := range peers[known:] {
+			pexOnly[peer] = true
+		}
+		peers = forgetPeers(peers, dropped, pexOnly)
+		peersMu.Unlock()
+		if added > 0 {
+			c.verbosef("PEX found %d new peers\n", added)
+		}
+	}
+
+	// Peers that served at least one verified piece, which peer supplied
+	// each piece and how many bad pieces each peer served
+	var goodPeers []string
+	pieceSources := make(map[int]string)
+	badPieces := make(map[string]int)
+	var goodPeersMu sync.Mutex
+
+	// Pieces still needed and the pieces each peer has told us about
+	needed := NewBitfield(pieceCnt)
+	for i := 0; i < pieceCnt; i++ {
+		needed.SetPiece(i)
+	}
+	peerHave := make(map[string]Bitfield)
+	var haveMu sync.Mutex
+
+	// peerMayHave reports whether peer is worth asking for index: either it
+	// hasn't told us what it has yet or it has the piece.
+	peerMayHave := func(peer string, index int) bool {
+		haveMu.Lock()
+		defer haveMu.Unlock()
+		have, known := peerHave[peer]
+		return !known || needed.Useful(have).HasPiece(index)
+	}
+
+	// Cancelled when the download is abandoned, aborting transfers in flight
+	downloadCtx, cancelDownload := context.WithCancel(ctx)
+	defer cancelDownload()
+
+	// addTrackerPeers adds peers a tracker returned to the pool and reports
+	// how many were new. Peers a tracker names are no longer PEX-only.
+	addTrackerPeers := func(fresh []string) int {
+		peersMu.Lock()
+		defer peersMu.Unlock()
+		known := len(peers)
+		peers = growPeerPool(peers, fresh)
+		for _, peer := range fresh {
+			delete(pexOnly, peer)
+		}
+		return len(peers) - known
+	}
+
+	// Closed once opts.InitialAnnounce has returned and its peers are in
+	// the pool, or at once without one
+	announced := make(chan struct{})
+	var initialInterval time.Duration
+	if opts.InitialAnnounce != nil {
+		go func() {
+			defer close(announced)
+			fresh, interval, err := opts.InitialAnnounce()
+			initialInterval = interval
+			if err == nil {
+				fresh, err = FilterPeersByNetwork(fresh, opts.Network)
+			}
+			if err != nil {
+				c.logf("Announce failed: %v\n", err)
+				return
+			}
+			c.logf("Announce found %d new peers\n", addTrackerPeers(fresh))
+		}()
+	} else {
+		close(announced)
+	}
+
+	// Re-announce every tracker interval so the peer pool doesn't go stale
+	// on long downloads; this stops when the download returns
+	if opts.AnnounceInterval > 0 {
+		go func() {
+			select {
+			case <-downloadCtx.Done():
+				return
+			case <-announced:
+			}
+			interval := opts.AnnounceInterval
+			if initialInterval > 0 {
+				interval = initialInterval
+			}
+			for {
+				select {
+				case <-downloadCtx.Done():
+					return
+				case <-time.After(interval):
+				}
+				fresh, trackerInterval, err := c.trackerPeers(torrent)
+				if trackerInterval > 0 {
+					interval = trackerInterval
+				}
+				if err == nil {
+					fresh, err = FilterPeersByNetwork(fresh, opts.Network)
+				}
+				if err != nil {
+					c.logf("Re-announce failed: %v\n", err)
+					continue
+				}
+				c.logf("Re-announce found %d new peers\n", addTrackerPeers(fresh))
+			}
+		}()
+	}
+
+	// Closed once the torrent is declared corrupt, stopping all workers
+	corrupt := make(chan struct{})
+	var corruptOnce sync.Once
+	var corruptErr error
+	isCorrupt := func() bool {
+		select {
+		case <-corrupt:
+			return true
+		default:
+			return false
+		}
+	}
+	// corruptThreshold is how many distinct peers must serve a piece that
+	// fails verification to declare the torrent corrupt. It follows the
+	// pool as re-announces and PEX grow it, and never drops below
+	// minCorruptPeers, as one peer's bad copy says little about the torrent
+	corruptThreshold := func() int {
+		return max(minCorruptPeers, min(corruptPieceThreshold, len(currentPeers())))
+	}
+
+	// Pieces not already in the resume state, handed out in the order
+	// opts.strategy picks
+	pending := NewBitfield(pieceCnt)
+	for i := 0; i < pieceCnt; i++ {
+		if state == nil || !state.Pieces.HasPiece(i) {
+			pending.SetPiece(i)
+		}
+	}
+	scheduler := newPieceScheduler(pending, pieceCnt, opts.Strategy)
+	for peer, conns := range warm.conns {
+		for _, wc := range conns {
+			if wc.have != nil {
+				scheduler.UpdatePeer(peer, wc.have)
+			}
+		}
+	}
+
+	// swarmLacks reports whether every one of candidates has told us it
+	// doesn't have index.
+	swarmLacks := func(candidates []string, index int) bool {
+		haveMu.Lock()
+		defer haveMu.Unlock()
+		for _, peer := range candidates {
+			if have, known := peerHave[peer]; !known || have.HasPiece(index) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// In endgame several attempts race for the same piece. racing counts the
+	// attempts still running for each piece and started all those ever
+	// started; pieceCtxs is cancelled once the piece is settled, aborting
+	// the attempts that lost
+	racing := make(map[int]int)
+	started := make(map[int]int)
+	pieceCtxs := make(map[int]context.Context)
+	pieceCancels := make(map[int]context.CancelFunc)
+
+	// settle records that an attempt at index finished with data or err and
+	// reports whether it was the one to deliver the piece's result: the
+	// first success, or the failure of the last attempt when none succeeded.
+	settle := func(index int, data []byte, err error) bool {
+		haveMu.Lock()
+		racing[index]--
+		deliver := needed.HasPiece(index) && (err == nil || racing[index] == 0)
+		if deliver && err == nil {
+			needed.ClearPiece(index)
+		}
+		cancel := pieceCancels[index]
+		haveMu.Unlock()
+		if !deliver {
+			return false
+		}
+		cancel()
+		pieceChan <- struct {
+			index int
+			data  []byte
+			err   error
+		}{index: index, data: data, err: err}
+		return true
+	}
+
+	downloadPiece := func(index int, racer int) {
+		defer wg.Done()
+
+		haveMu.Lock()
+		pieceCtx := pieceCtxs[index]
+		haveMu.Unlock()
+
+		var lastErr error
+		pieceBytes := 0
+		lost := false
+		defer func() { controller.release(pieceBytes, pieceBytes == 0 && !lost) }() // Release transfer slot
+
+		// A bug in the download path fails this piece rather than the process
+		defer func() {
+			if r := recover(); r != nil {
+				c.logf("Piece %d panicked: %v\n%s", index, r, debug.Stack())
+				pieceBytes = 0
+				settle(index, nil, fmt.Errorf("internal error: %v", r))
+			}
+		}()
+
+		// Peers already tried for this piece, including those known to lack it
+		tried := make(map[string]bool)
+		attempts := 0
+		hashFailures := 0
+
+		expected, err := getPieceHash(torrent, index)
+		if err != nil {
+			settle(index, nil, err)
+			return
+		}
+
+		// Try each untried peer until success; the piece is unobtainable
+		// once every peer has been tried. Endgame racers start further
+		// along the list so they ask different peers
+		pool := currentPeers()
+		candidates := pool
+		if racer > 0 && len(pool) > 0 {
+			offset := racer % len(pool)
+			candidates = append(slices.Clone(pool[offset:]), pool[:offset]...)
+		}
+		waitUntil := time.Now().Add(opts.SwarmWait)
+		unavailable := false
+		for {
+			for len(tried) < len(candidates) {
+				opts.Pause.wait()
+				peer := ""
+				for _, candidate := range candidates {
+					if tried[candidate] {
+						continue
+					}
+					if !peerMayHave(candidate, index) {
+						tried[candidate] = true
+						continue
+					}
+					peer = candidate
+					break
+				}
+				if peer == "" || isCorrupt() || pieceCtx.Err() != nil {
+					break
+				}
+				tried[peer] = true
+
+				ctx, cancelAttempt := pieceCtx, context.CancelFunc(func() {})
+				if opts.PieceTimeout > 0 {
+					ctx, cancelAttempt = context.WithTimeout(pieceCtx, opts.PieceTimeout)
+				}
+				var pieceData []byte
+				var have Bitfield
+				var err error
+				pieceData, have, err = warm.fetch(ctx, torrent, opts.Network, peer, index)
+				cancelAttempt()
+				if err == nil && !hasher.verify(pieceData, expected) {
+					err = fmt.Errorf("piece %d hash verification failed", index)
+					goodPeersMu.Lock()
+					badPieces[peer]++
+					goodPeersMu.Unlock()
+					hashFailures++
+					if hashFailures >= corruptThreshold() {
+						corruptOnce.Do(func() {
+							corruptErr = fmt.Errorf("%w: piece %d failed verification from %d different peers", errTorrentCorrupt, index, hashFailures)
+							close(corrupt)
+							cancelDownload()
+						})
+					}
+				}
+				if have != nil {
+					haveMu.Lock()
+					peerHave[peer] = have
+					haveMu.Unlock()
+					scheduler.UpdatePeer(peer, have)
+				}
+				if err == nil {
+					if !settle(index, pieceData, nil) {
+						lost = true
+						c.verbosef("Piece %d from peer %s arrived after another peer delivered it\n", index, peer)
+						return
+					}
+					pieceBytes = len(pieceData)
+					goodPeersMu.Lock()
+					goodPeers = append(goodPeers, peer)
+					pieceSources[index] = peer
+					goodPeersMu.Unlock()
+					c.verbosef("Piece %d downloaded and verified successfully\n", index)
+					return
+				}
+				if pieceCtx.Err() != nil && !isCorrupt() {
+					// Another attempt delivered the piece
+					lost = true
+					break
+				}
+				if errors.Is(err, errPeerLacksPiece) {
+					c.verbosef("Peer %s doesn't have piece %d, trying another peer\n", peer, index)
+					continue
+				}
+				lastErr = err
+				attempts++
+				c.verbosef("Piece %d attempt %d failed from peer %s: %v\n", index, attempts, peer, err)
+			}
+
+			if isCorrupt() || pieceCtx.Err() != nil {
+				break
+			}
+			// Peers from the initial announce may still be on their way, and
+			// re-announces and PEX may have grown the pool since the piece
+			// started; try any peers it gained
+			select {
+			case <-announced:
+			case <-pieceCtx.Done():
+				continue
+			}
+			if grown := MergePeers(candidates, currentPeers()); len(grown) > len(candidates) {
+				candidates = grown
+				continue
+			}
+
+			// Every peer has told us it lacks the piece; re-announce in
+			// case the swarm has grown, until SwarmWait runs out
+			if !swarmLacks(candidates, index) {
+				break
+			}
+			if !time.Now().Before(waitUntil) {
+				unavailable = true
+				break
+			}
+			time.Sleep(swarmRetryDelay)
+			fresh, _, err := c.trackerPeers(torrent)
+			if err == nil {
+				fresh, err = FilterPeersByNetwork(fresh, opts.Network)
+			}
+			if err != nil {
+				c.logf("Re-announce for piece %d failed: %v\n", index, err)
+				continue
+			}
+			candidates = MergePeers(candidates, fresh)
+		}
+
+		if unavailable {
+			lastErr = fmt.Errorf("piece %d unavailable from current swarm", index)
+		} else if lastErr == nil {
+			lastErr = fmt.Errorf("none of the %d peers has piece %d", len(candidates), index)
+		} else {
+			lastErr = fmt.Errorf("all %d peers tried, last error: %v", len(candidates), lastErr)
+		}
+
+		if !settle(index, nil, lastErr) {
+			lost = true
+		}
+	}
+
+	// startAttempt starts an attempt at index, the first or an endgame racer.
+	startAttempt := func(index int) {
+		haveMu.Lock()
+		if _, ok := pieceCtxs[index]; !ok {
+			pieceCtxs[index], pieceCancels[index] = context.WithCancel(downloadCtx)
+		}
+		racer := started[index]
+		started[index]++
+		racing[index]++
+		haveMu.Unlock()
+		go downloadPiece(index, racer)
+	}
+
+	// nextRacer picks the piece for the next endgame attempt: one still being
+	// downloaded, with the fewest attempts racing for it, while fewer than
+	// maxRacers are.
+	nextRacer := func(maxRacers int) (index int, ok bool) {
+		haveMu.Lock()
+		defer haveMu.Unlock()
+		best := -1
+		for i, n := range racing {
+			if n == 0 || !needed.HasPiece(i) || started[i] >= maxRacers {
+				continue
+			}
+			if best == -1 || n < racing[best] || n == racing[best] && i < best {
+				best = i
+			}
+		}
+		return best, best != -1
+	}
+
+	// Each piece is written in place as it arrives, so at most the pieces in
+	// flight are held in memory. Without resume the download is staged in a
+	// temporary file, in TempDir if set, which is removed unless it is moved
+	// into place, so outputPath never holds a partial download
+	writePath := partPath(outputPath)
+	var stagingPath string
+	if !opts.Resume {
+		var err error
+		stagingPath, err = newStagingPath(opts.TempDir, outputPath, torrent)
+		if err != nil {
+			return err
+		}
+		writePath = stagingPath
+		defer func() {
+			if stagingPath != "" {
+				os.RemoveAll(stagingPath)
+			}
+		}()
+	}
+	files, err := CreateFiles(writePath, torrent)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	// Hand pieces out in the background, so the loop below writes each one
+	// as it arrives rather than once every piece has been handed out
+	go func() {
+		// Pick each piece only once a transfer slot frees up, so the choice
+		// reflects the latest bitfields
+		for {
+			wg.Add(1)
+			controller.acquire()
+			index, ok := scheduler.Next()
+			if !ok || isCorrupt() {
+				wg.Done()
+				controller.release(0, false)
+				break
+			}
+			startAttempt(index)
+		}
+
+		// Endgame: every piece has been handed out, so the few still in
+		// flight can hold up the whole download. Each slot that frees up
+		// races another peer for one of them; the first to deliver cancels
+		// the rest
+		maxRacers := min(endgameRacers, len(currentPeers()))
+		for !isCorrupt() {
+			wg.Add(1)
+			controller.acquire()
+			index, ok := nextRacer(maxRacers)
+			if !ok || isCorrupt() {
+				wg.Done()
+				controller.release(0, false)
+				break
+			}
+			c.verbosef("Endgame: racing another peer for piece %d\n", index)
+			startAttempt(index)
+		}
+
+		wg.Wait()
+		close(pieceChan)
+	}()
+
+	var estimator *etaEstimator
+	var progress *ProgressTracker
+	if opts.ETA {
+		_, remaining := remainingWork(torrent, state)
+		estimator = newETAEstimator(remaining, time.Now())
+		stopETA := make(chan struct{})
+		defer close(stopETA)
+		go c.reportETA(estimator, 2*time.Second, stopETA)
+	} else if c.showProgress() {
+		pieces, bytes := remainingWork(torrent, state)
+		progress = newProgressTracker(pieces, bytes, time.Now())
+		stopProgress := c.startProgress(progress)
+		defer stopProgress()
+	}
+
+	// Collect pieces and write them as they arrive
+	var failures []error
+	unflushed := 0
+	lastFlush := time.Now()
+
+	for result := range pieceChan {
+		if result.err != nil {
+			failures = append(failures, fmt.Errorf("piece %d download failed: %v", result.index, result.err))
+			continue
+		}
+		if estimator != nil {
+			estimator.add(len(result.data), time.Now())
+		}
+		if progress != nil {
+			progress.Add(len(result.data), time.Now())
+		}
+		_, err := files.WriteAt(result.data, int64(result.index)*int64(torrent.Info.PieceLength))
+		if err != nil {
+			failures = append(failures, fmt.Errorf("piece %d write failed: %v", result.index, err))
+		} else if state != nil {
+			state.Pieces.SetPiece(result.index)
+			unflushed++
+			if unflushed >= opts.ResumeFlushPieces || time.Since(lastFlush) >= opts.ResumeFlushInterval {
+				// Data must reach disk before the state claims it
+				if err := files.Sync(); err != nil {
+					c.logf("Failed to sync before saving resume state: %v\n", err)
+				} else if err := saveResumeState(resumeStatePath(outputPath), state); err != nil {
+					c.logf("Failed to save resume state: %v\n", err)
+				} else {
+					unflushed = 0
+					lastFlush = time.Now()
+				}
+			}
+		}
+	}
+
+	if opts.Adaptive {
+		c.logf("Adaptive concurrency settled at %v\n", controller.currentLimit())
+	}
+
+	if opts.Stats {
+		c.printPeerStats(pieceSources, badPieces)
+	}
+
+	if opts.PeerCachePath != "" && len(goodPeers) > 0 {
+		if err := savePeerCache(opts.PeerCachePath, goodPeers, opts.PeerCacheTTL); err != nil {
+			c.logf("Failed to save peer cache: %v\n", err)
+		}
+	}
+
+	if err := files.Sync(); err != nil {
+		return err
+	}
+	// Record progress even when some pieces failed, so a rerun skips them
+	if state != nil {
+		if err := saveResumeState(resumeStatePath(outputPath), state); err != nil {
+			return err
+		}
+	}
+
+	if isCorrupt() {
+		return corruptErr
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("download failed with errors: %v", failures)
+	}
+
+	if err := files.Close(); err != nil {
+		return err
+	}
+	if state != nil {
+		if err := finishResume(outputPath); err != nil {
+			return err
+		}
+	}
+	if stagingPath != "" {
+		if err := VerifyFileChecksum(stagingPath, torrent); err != nil {
+			return err
+		}
+		if err := commitStaged(stagingPath, outputPath, torrent); err != nil {
+			return err
+		}
+		stagingPath = ""
+		return nil
+	}
+	return VerifyFileChecksum(outputPath, torrent)
+}
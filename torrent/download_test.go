@@ -0,0 +1,501 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadKeepsMemoryBounded(t *testing.T) {
+	// Far more than the pieces in flight, so buffering the whole torrent
+	// would show
+	const memoryCap = 8 << 20
+	tor, data := testTorrent(t, 4*memoryCap, 256*1024)
+	peer := startSeeder(t, tor, data)
+
+	// Collect garbage eagerly, so the heap in use is close to what is live
+	defer debug.SetGCPercent(debug.SetGCPercent(1))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+		}
+	}()
+
+	outputPath := filepath.Join(t.TempDir(), "out")
+	err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"})
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs")
+	}
+	if growth := int64(peak.Load()) - int64(baseline); growth > memoryCap {
+		t.Errorf("heap grew by %d bytes downloading %d, want at most %d", growth, len(data), memoryCap)
+	}
+}
+
+func TestDownloadStagesOutput(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := startSeeder(t, tor, data)
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out")
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("want only the output left, got %v", entries)
+	}
+}
+
+func TestFailedDownloadLeavesNoOutput(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	seeder := &testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true}}
+	peer := seeder.start(t)
+	c := newTestClient(t)
+
+	for _, tempDir := range []string{"", t.TempDir()} {
+		dir := t.TempDir()
+		outputPath := filepath.Join(dir, "out")
+		if err := c.Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp", TempDir: tempDir}); err == nil {
+			t.Fatal("download of a piece no peer has succeeded")
+		}
+		for _, d := range []string{dir, tempDir} {
+			if d == "" {
+				continue
+			}
+			if entries, _ := os.ReadDir(d); len(entries) != 0 {
+				t.Errorf("temp dir %q: %v left behind", tempDir, entries)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	if err := c.DownloadFromPeer(filepath.Join(dir, "out"), tor, peer, false); err == nil {
+		t.Fatal("single-peer download of a piece the peer lacks succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("single-peer download left %v behind", entries)
+	}
+}
+
+func TestDownloadTempDirMultiFile(t *testing.T) {
+	tor, data := twoFileTorrent(t)
+	peer := startSeeder(t, tor, data)
+	tempDir := t.TempDir()
+	outputPath := filepath.Join(t.TempDir(), "out")
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp", TempDir: tempDir}); err != nil {
+		t.Fatal(err)
+	}
+	checkTwoFiles(t, outputPath, data)
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("%v left in the temp dir", entries)
+	}
+}
+
+func TestDownloadTriesEveryPeerForAPiece(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+	peers := []string{
+		dead,
+		(&testSeeder{torrent: tor, data: data, missing: map[int]bool{2: true}}).start(t),
+		(&testSeeder{torrent: tor, data: data, stall: true}).start(t),
+		startSeeder(t, tor, data),
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", PieceTimeout: 200 * time.Millisecond}
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, peers, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+
+	// Once every peer has been tried the piece is unobtainable
+	err = newTestClient(t).Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, peers[:3], opts)
+	if err == nil {
+		t.Fatal("downloaded a piece no peer serves")
+	}
+}
+
+func TestDownloadFailsFastOnCorruptTorrent(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	damaged := bytes.Clone(data)
+	damaged[10] ^= 0xff
+	var peers []string
+	for i := 0; i < corruptPieceThreshold; i++ {
+		peers = append(peers, startSeeder(t, tor, damaged))
+	}
+
+	start := time.Now()
+	err := newTestClient(t).Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, peers, DownloadOptions{Network: "tcp"})
+	if !errors.Is(err, errTorrentCorrupt) {
+		t.Fatalf("got %v, want %v", err, errTorrentCorrupt)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v to give up", elapsed)
+	}
+}
+
+func TestSinglePeerBadPieceDoesNotAbort(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	damaged := bytes.Clone(data)
+	damaged[32*1024+10] ^= 0xff
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", Resume: true}
+
+	// Piece 1 fails from the only peer, but the rest still download
+	err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{startSeeder(t, tor, damaged)}, opts)
+	if err == nil || errors.Is(err, errTorrentCorrupt) {
+		t.Fatalf("got %v, want piece 1 failed without declaring the torrent corrupt", err)
+	}
+	state, err := loadResumeState(resumeStatePath(outputPath), tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.Pieces, Bitfield{0xb0}) {
+		t.Fatalf("resume state holds %08b, want pieces 0, 2 and 3", state.Pieces)
+	}
+
+	// A good peer found later supplies it
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{startSeeder(t, tor, data)}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+}
+
+func TestDownloadPieceMissingFromSwarm(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	partial := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true}}).start(t)
+
+	start := time.Now()
+	err := newTestClient(t).Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{partial}, DownloadOptions{Network: "tcp"})
+	if err == nil || !strings.Contains(err.Error(), "piece 0") {
+		t.Fatalf("got %v, want piece 0 reported unobtainable", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v to give up", elapsed)
+	}
+
+	// With SwarmWait, re-announcing finds a peer that has it
+	delay := swarmRetryDelay
+	swarmRetryDelay = 10 * time.Millisecond
+	defer func() { swarmRetryDelay = delay }()
+	tor.Announce = startTracker(t, startSeeder(t, tor, data))
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", SwarmWait: 5 * time.Second}
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{partial}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+}
+
+func TestDownloadAssemblesInTempDir(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	release := make(chan struct{})
+	seeder := &testSeeder{torrent: tor, data: data, held: map[int]chan struct{}{3: release}}
+	peer := seeder.start(t)
+	tempDir := t.TempDir()
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp", TempDir: tempDir})
+	}()
+
+	// Wait for the first pieces to land in the temp dir
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(tempDir)
+		if len(entries) == 1 {
+			staged, _ := os.ReadFile(filepath.Join(tempDir, entries[0].Name()))
+			if len(staged) >= 32*1024 && bytes.Equal(staged[:32*1024], data[:32*1024]) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("piece 0 never appeared in the temp dir")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("output path exists before the download finished")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("%v left in the temp dir", entries)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a Client's
+// log.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDownloadStatsRecordPieceSources(t *testing.T) {
+	tor, data := testTorrent(t, 4*32*1024, 32*1024)
+	damaged := bytes.Clone(data)
+	for index := 0; index < 4; index++ {
+		damaged[index*32*1024] ^= 0xff
+	}
+	bad := startSeeder(t, tor, damaged)
+	even := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{1: true, 3: true}}).start(t)
+	odd := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true, 2: true}}).start(t)
+
+	c := newTestClient(t)
+	var log syncBuffer
+	c.Log = &log
+	opts := DownloadOptions{Network: "tcp", Stats: true}
+	if err := c.Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{bad, even, odd}, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Endgame racers may skip the bad peer for a piece, so only some of its
+	// failures are certain
+	if !strings.Contains(log.String(), bad+": 0 pieces [], ") || strings.Contains(log.String(), bad+": 0 pieces [], 0 failed") {
+		t.Errorf("stats don't show %s failing verification:\n%s", bad, log.String())
+	}
+	for _, want := range []string{
+		even + ": 2 pieces [0 2], 0 failed verification",
+		odd + ": 2 pieces [1 3], 0 failed verification",
+	} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("stats lack %q:\n%s", want, log.String())
+		}
+	}
+}
+
+// panicDialer panics on every dial, standing in for a bug in the download
+// path.
+type panicDialer struct{}
+
+func (panicDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	panic("injected")
+}
+
+func TestDownloadRecoversPiecePanic(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := startSeeder(t, tor, data)
+	c := newTestClient(t)
+	c.Dialer = panicDialer{}
+	var log syncBuffer
+	c.Log = &log
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{peer}, DownloadOptions{Network: "tcp"})
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "internal error: injected") {
+			t.Fatalf("got %v, want the panic as an error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download hung after a piece panicked")
+	}
+	if !strings.Contains(log.String(), "panicked: injected") {
+		t.Errorf("panic not logged:\n%s", log.String())
+	}
+}
+
+func TestDownloadLengthMultipleOfPieceLength(t *testing.T) {
+	tor, data := testTorrent(t, 3*32*1024, 32*1024)
+	peer := startSeeder(t, tor, data)
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want the whole %d with the full last piece", len(got), len(data))
+	}
+}
+
+func TestPausedDownloadWaitsForResume(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := startSeeder(t, tor, data)
+	gate := NewPauseGate()
+	gate.Toggle()
+
+	done := make(chan error, 1)
+	go func() {
+		opts := DownloadOptions{Network: "tcp", Pause: gate}
+		done <- newTestClient(t).Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{peer}, opts)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("paused download finished: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if gate.Toggle() {
+		t.Fatal("gate still paused after the second toggle")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download didn't finish after resuming")
+	}
+}
+
+func TestCancelledDownloadReturnsPromptly(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	stalled := (&testSeeder{torrent: tor, data: data, stall: true}).start(t)
+	c := newTestClient(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.downloadPieceFromPeer(ctx, tor, "tcp", stalled, 0)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("piece download didn't return after cancelling")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	downloadDone := make(chan error, 1)
+	go func() {
+		downloadDone <- c.Download(ctx, filepath.Join(t.TempDir(), "out.bin"), tor, []string{stalled}, DownloadOptions{Network: "tcp"})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-downloadDone:
+		if err == nil {
+			t.Error("cancelled download succeeded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("download didn't return after cancelling")
+	}
+
+	// A piece timeout bounds each attempt without any cancelling
+	start := time.Now()
+	opts := DownloadOptions{Network: "tcp", PieceTimeout: 200 * time.Millisecond}
+	if err := c.Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{stalled}, opts); err == nil {
+		t.Error("download from a stalled peer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v with a 200ms piece timeout", elapsed)
+	}
+}
+
+func TestEndgameCancelsLoser(t *testing.T) {
+	tor, data := testTorrent(t, 60000, 64*1024)
+	release := make(chan struct{})
+	defer close(release)
+	slow := &testSeeder{torrent: tor, data: data, held: map[int]chan struct{}{0: release}}
+	peers := []string{slow.start(t), startSeeder(t, tor, data)}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	start := time.Now()
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, peers, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v with a fast peer racing the held one", elapsed)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for slow.cancels.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the losing peer was sent no cancel")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPeerSessionCancelMessage(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		id, payload, err := readMessage(theirs)
+		if err == nil && id == 8 {
+			received <- payload
+		}
+		close(received)
+	}()
+	if err := NewPeerSession(ours, nil).Cancel(3, 16*1024, 16*1024); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, blockPayload(3, 16*1024, 16*1024)) {
+		t.Errorf("got cancel payload %x", got)
+	}
+}
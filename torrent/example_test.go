@@ -0,0 +1,71 @@
+package torrent_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/torrent"
+)
+
+// This example seeds a small torrent from one Client and downloads it with
+// another, both in the same process.
+func ExampleClient_Download() {
+	dir, err := os.MkdirTemp("", "example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	const pieceLength = 32 * 1024
+	var pieces []byte
+	for off := 0; off < len(data); off += pieceLength {
+		hash := sha1.Sum(data[off:min(off+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	infoHash := sha1.Sum([]byte("example"))
+	tor := torrent.Torrent{Info: torrent.Info{
+		Name:        "example.bin",
+		Length:      len(data),
+		PieceLength: pieceLength,
+		Pieces:      string(pieces),
+		InfoHash:    infoHash[:],
+	}}
+
+	seedPath := filepath.Join(dir, "seed.bin")
+	if err := os.WriteFile(seedPath, data, 0644); err != nil {
+		panic(err)
+	}
+	seeder, err := torrent.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+	go seeder.Seed(ln, tor, seedPath)
+
+	leecher, err := torrent.NewClient()
+	if err != nil {
+		panic(err)
+	}
+	outputPath := filepath.Join(dir, "example.bin")
+	err = leecher.Download(context.Background(), outputPath, tor, []string{ln.Addr().String()}, torrent.DownloadOptions{Network: "tcp"})
+	if err != nil {
+		panic(err)
+	}
+
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("pieces:", tor.PieceCount(), "identical:", bytes.Equal(got, data))
+	// Output: pieces: 3 identical: true
+}
@@ -0,0 +1,185 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// extensionProtocolBit in reserved byte 5 advertises the extension protocol
+// (BEP 10).
+const extensionProtocolBit = 0x10
+
+// extensionReserved returns reserved handshake bytes advertising the
+// extension protocol.
+func extensionReserved() []byte {
+	reserved := make([]byte, 8)
+	reserved[5] |= extensionProtocolBit
+	return reserved
+}
+
+// supportsExtensions reports whether a received handshake advertises the
+// extension protocol.
+func supportsExtensions(handshake []byte) bool {
+	return len(handshake) >= 28 && handshake[25]&extensionProtocolBit != 0
+}
+
+// utPexID is the extended message id we ask peers to use when sending us
+// ut_pex messages.
+const utPexID = 2
+
+// downloadExtensions maps the extensions we advertise on download
+// connections to the extended message ids we want them sent with.
+var downloadExtensions = map[string]int{"ut_pex": utPexID}
+
+// extensionsFor returns the extensions to advertise for torrent. Private
+// torrents get none, as their peers may only come from the trackers.
+func extensionsFor(torrent Torrent) map[string]int {
+	if torrent.Info.Private {
+		return map[string]int{}
+	}
+	return downloadExtensions
+}
+
+// pexMessage is a ut_pex message (BEP 11): the peers the sender connected to
+// and dropped since its last one.
+type pexMessage struct {
+	added []string
+	// addedFlags holds added.f, a flags byte per added IPv4 peer, which
+	// come first in added; it is nil if the sender didn't include them.
+	addedFlags []byte
+	dropped    []string
+}
+
+// parsePexMessage parses the bencoded payload of a ut_pex message. IPv4 and
+// IPv6 peers are both taken, from the compact added/added6 and
+// dropped/dropped6 strings.
+func parsePexMessage(payload []byte) (msg pexMessage, err error) {
+	decoded, _, err := decodeDict(string(payload), 0)
+	if err != nil {
+		return msg, fmt.Errorf("bad ut_pex message: %v", err)
+	}
+	compact := func(key string, size int) ([]string, error) {
+		value, ok := decoded[key].(string)
+		if !ok {
+			return nil, nil
+		}
+		peers, err := parseCompactPeers([]byte(value), size)
+		if err != nil {
+			return nil, fmt.Errorf("bad ut_pex %s: %v", key, err)
+		}
+		return peers, nil
+	}
+	for _, field := range []struct {
+		key   string
+		size  int
+		peers *[]string
+	}{
+		{"added", 6, &msg.added},
+		{"added6", 18, &msg.added},
+		{"dropped", 6, &msg.dropped},
+		{"dropped6", 18, &msg.dropped},
+	} {
+		peers, err := compact(field.key, field.size)
+		if err != nil {
+			return pexMessage{}, err
+		}
+		*field.peers = append(*field.peers, peers...)
+	}
+	added, _ := decoded["added"].(string)
+	if flags, ok := decoded["added.f"].(string); ok && len(flags) == len(added)/6 {
+		msg.addedFlags = []byte(flags)
+	}
+	return msg, nil
+}
+
+// pexSeedFlag marks an added peer as a seed in added.f.
+const pexSeedFlag = 0x02
+
+// seedsFirst returns the added peers with those flagged as seeds first, as
+// they can serve any piece we still need.
+func (msg pexMessage) seedsFirst() []string {
+	var seeds, others []string
+	for i, peer := range msg.added {
+		if i < len(msg.addedFlags) && msg.addedFlags[i]&pexSeedFlag != 0 {
+			seeds = append(seeds, peer)
+		} else {
+			others = append(others, peer)
+		}
+	}
+	return append(seeds, others...)
+}
+
+// peerExtensions is what a peer advertised in its extension handshake.
+type peerExtensions struct {
+	// ids maps each extension the peer supports to the extended message id
+	// it wants for it.
+	ids map[string]int
+	// metadataSize is the size of the info dictionary, for ut_metadata.
+	metadataSize int
+}
+
+// sendExtensionHandshake sends our extension handshake (extended id 0),
+// advertising the extended message id we want for each extension in ids.
+func (c *Client) sendExtensionHandshake(conn net.Conn, ids map[string]int) error {
+	m := make(map[string]interface{}, len(ids))
+	for name, id := range ids {
+		m[name] = id
+	}
+	payload, err := encodeBencode(map[string]interface{}{"m": m, "v": c.UserAgent})
+	if err != nil {
+		return err
+	}
+	return sendExtended(conn, 0, payload)
+}
+
+// parseExtensionHandshake parses the bencoded payload of a peer's extension
+// handshake. Extensions the peer disabled, with id 0, are left out, as are
+// ids that don't fit the extended message id byte.
+func parseExtensionHandshake(payload []byte) (ext peerExtensions, err error) {
+	decoded, _, err := decodeDict(string(payload), 0)
+	if err != nil {
+		return ext, fmt.Errorf("bad extension handshake: %v", err)
+	}
+	ext.ids = make(map[string]int)
+	m, _ := decoded["m"].(map[string]interface{})
+	for name, value := range m {
+		if id, ok := value.(int); ok && id > 0 && id <= 255 {
+			ext.ids[name] = id
+		}
+	}
+	ext.metadataSize, _ = decoded["metadata_size"].(int)
+	return ext, nil
+}
+
+// recordExtensionHandshake stores the peer's extension handshake in ext if
+// payload, the payload of an extended message, is one. A malformed handshake
+// is ignored, leaving the peer without extensions.
+func recordExtensionHandshake(ext *peerExtensions, payload []byte) {
+	if len(payload) == 0 || payload[0] != 0 {
+		return
+	}
+	if parsed, err := parseExtensionHandshake(payload[1:]); err == nil {
+		*ext = parsed
+	}
+}
+
+// downloadHandshake performs the handshake for a download connection and,
+// if the peer speaks the extension protocol, sends our extension handshake.
+func (c *Client) downloadHandshake(torrent Torrent, conn net.Conn) (recievedHandshake []byte, err error) {
+	recievedHandshake, err = c.handshakeWithReserved(torrent, conn, downloadReserved())
+	if err != nil || !supportsExtensions(recievedHandshake) {
+		return recievedHandshake, err
+	}
+	return recievedHandshake, c.sendExtensionHandshake(conn, extensionsFor(torrent))
+}
+
+// sendExtended sends an extended message (id 20) with the given extended
+// message id and bencoded payload.
+func sendExtended(conn net.Conn, extID byte, payload []byte) error {
+	message := make([]byte, 6, 6+len(payload))
+	binary.BigEndian.PutUint32(message[0:4], uint32(2+len(payload)))
+	message[4] = 20
+	message[5] = extID
+	return writeFull(conn, append(message, payload...))
+}
@@ -0,0 +1,133 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// pexPayload adds 10.0.0.1:6881 and the seed 10.0.0.2:6882, and drops
+// 10.0.0.3:80.
+const pexPayload = "d5:added12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2" +
+	"7:added.f2:\x10\x02" +
+	"7:dropped6:\x0a\x00\x00\x03\x00\x50e"
+
+func TestParsePexMessage(t *testing.T) {
+	msg, err := parsePexMessage([]byte(pexPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:6881", "10.0.0.2:6882"}; !reflect.DeepEqual(msg.added, want) {
+		t.Errorf("added: got %v, want %v", msg.added, want)
+	}
+	if want := []string{"10.0.0.3:80"}; !reflect.DeepEqual(msg.dropped, want) {
+		t.Errorf("dropped: got %v, want %v", msg.dropped, want)
+	}
+	if want := []string{"10.0.0.2:6882", "10.0.0.1:6881"}; !reflect.DeepEqual(msg.seedsFirst(), want) {
+		t.Errorf("seedsFirst: got %v, want %v", msg.seedsFirst(), want)
+	}
+}
+
+func TestPexPeersReachSession(t *testing.T) {
+	data := make([]byte, 100)
+	hash := sha1.Sum(data)
+	tor := Torrent{Info: Info{Length: 100, PieceLength: 100, Pieces: string(hash[:])}}
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go func() {
+		readMessage(theirs) // the request
+		sendMessage(theirs, 20, append([]byte{utPexID}, pexPayload...))
+		sendBlock(theirs, data, 0, 0, 100)
+	}()
+
+	var added, dropped []string
+	s := NewPeerSession(ours, nil)
+	s.discovered = func(a, d []string) {
+		added = append(added, a...)
+		dropped = append(dropped, d...)
+	}
+	if _, err := s.DownloadPiece(tor, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || len(dropped) != 1 {
+		t.Fatalf("got added %v and dropped %v, want two added and one dropped", added, dropped)
+	}
+}
+
+func TestPexDisabledForPrivateTorrents(t *testing.T) {
+	if ids := extensionsFor(Torrent{Info: Info{Private: true}}); len(ids) != 0 {
+		t.Errorf("private torrent advertises %v", ids)
+	}
+	if id := extensionsFor(Torrent{})["ut_pex"]; id != utPexID {
+		t.Errorf("ut_pex id: got %d, want %d", id, utPexID)
+	}
+}
+
+func TestPeerPoolGrowth(t *testing.T) {
+	var pool []string
+	for i := 0; i < maxPeerPool+10; i++ {
+		pool = growPeerPool(pool, []string{fmt.Sprintf("10.0.%d.%d:6881", i/256, i%256)})
+	}
+	if len(pool) != maxPeerPool {
+		t.Fatalf("pool grew to %d peers, want %d", len(pool), maxPeerPool)
+	}
+
+	pexOnly := map[string]bool{"10.0.0.1:6881": true}
+	pool = forgetPeers(pool, []string{"10.0.0.1:6881", "10.0.0.2:6881"}, pexOnly)
+	if len(pool) != maxPeerPool-1 || pool[0] != "10.0.0.0:6881" || pool[1] != "10.0.0.2:6881" {
+		t.Errorf("forgetPeers should drop only the PEX-only peer, got %v", pool[:3])
+	}
+}
+
+func TestExtensionHandshakeRoundTrip(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	peerSaw := make(chan peerExtensions, 1)
+	go func() {
+		defer theirs.Close()
+		handshake := make([]byte, 68)
+		if _, err := io.ReadFull(theirs, handshake); err != nil || !supportsExtensions(handshake) {
+			peerSaw <- peerExtensions{}
+			return
+		}
+		reply := peerHandshake(tor)
+		reply[25] |= extensionProtocolBit
+		writeFull(theirs, reply)
+		id, payload, err := readMessage(theirs)
+		if err != nil || id != 20 {
+			peerSaw <- peerExtensions{}
+			return
+		}
+		var ext peerExtensions
+		recordExtensionHandshake(&ext, payload)
+		peerSaw <- ext
+		sendExtended(theirs, 0, []byte("d1:md6:ut_pexi7e11:ut_metadatai0eee"))
+	}()
+
+	received, err := newTestClient(t).downloadHandshake(tor, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !supportsExtensions(received) {
+		t.Error("peer's extension bit not seen")
+	}
+	if ext := <-peerSaw; !reflect.DeepEqual(ext.ids, map[string]int{"ut_pex": utPexID}) {
+		t.Errorf("peer got extensions %v, want ut_pex as %d", ext.ids, utPexID)
+	}
+
+	// The peer's own handshake disables ut_metadata with id 0
+	id, payload, err := readMessage(ours)
+	if err != nil || id != 20 {
+		t.Fatalf("got message %d, %v, want an extended one", id, err)
+	}
+	var ext peerExtensions
+	recordExtensionHandshake(&ext, payload)
+	if !reflect.DeepEqual(ext.ids, map[string]int{"ut_pex": 7}) {
+		t.Errorf("got peer extensions %v, want ut_pex as 7", ext.ids)
+	}
+}
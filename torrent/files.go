@@ -0,0 +1,182 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files holds the files a torrent's data is written into, so a piece
+// can be written at its offset in the torrent as soon as it is verified
+// rather than assembling the whole torrent in memory.
+type Files struct {
+	files   []*os.File
+	lengths []int64
+}
+
+// CreateFiles creates the torrent's output: one file at outputPath for
+// a single-file torrent, or the torrent's files below the outputPath
+// directory for a multi-file one. Every file is truncated to its final
+// length, so regions not yet written stay holes on disk.
+func CreateFiles(outputPath string, torrent Torrent) (*Files, error) {
+	entries := torrent.Info.Files
+	if len(entries) == 0 {
+		entries = []FileEntry{{Length: torrent.Info.Length}}
+	}
+
+	t := &Files{}
+	for _, entry := range entries {
+		path := filepath.Join(append([]string{outputPath}, entry.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.ModePerm)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.files = append(t.files, f)
+		t.lengths = append(t.lengths, int64(entry.Length))
+		if err := f.Truncate(int64(entry.Length)); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// OpenFiles opens the torrent's output at outputPath, laid out as
+// CreateFiles makes it, for reading.
+func OpenFiles(outputPath string, torrent Torrent) (*Files, error) {
+	entries := torrent.Info.Files
+	if len(entries) == 0 {
+		entries = []FileEntry{{Length: torrent.Info.Length}}
+	}
+
+	t := &Files{}
+	for _, entry := range entries {
+		f, err := os.Open(filepath.Join(append([]string{outputPath}, entry.Path...)...))
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.files = append(t.files, f)
+		t.lengths = append(t.lengths, int64(entry.Length))
+	}
+	return t, nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the torrent's data, spanning
+// file boundaries. A file shorter than the torrent says ends the read with
+// io.EOF.
+func (t *Files) ReadAt(p []byte, off int64) (n int, err error) {
+	for i, f := range t.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= t.lengths[i] {
+			off -= t.lengths[i]
+			continue
+		}
+		chunk := p[:min(int64(len(p)), t.lengths[i]-off)]
+		read, err := f.ReadAt(chunk, off)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		p = p[read:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset off of the torrent's data, splitting it across
+// file boundaries.
+func (t *Files) WriteAt(p []byte, off int64) (n int, err error) {
+	for i, f := range t.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= t.lengths[i] {
+			off -= t.lengths[i]
+			continue
+		}
+		chunk := p[:min(int64(len(p)), t.lengths[i]-off)]
+		written, err := f.WriteAt(chunk, off)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, fmt.Errorf("write past the end of the torrent data")
+	}
+	return n, nil
+}
+
+func (t *Files) Sync() error {
+	for _, f := range t.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every file, returning the first error.
+func (t *Files) Close() error {
+	var firstErr error
+	for _, f := range t.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newStagingPath returns where a download of torrent to outputPath is
+// written until it completes: a new temporary file in dir, or a new
+// temporary directory for a multi-file torrent. An empty dir means next to
+// outputPath, so the finished download is renamed rather than copied into
+// place.
+func newStagingPath(dir, outputPath string, torrent Torrent) (string, error) {
+	if dir == "" {
+		dir = filepath.Dir(outputPath)
+	}
+	pattern := filepath.Base(outputPath) + ".*.part"
+	if len(torrent.Info.Files) > 0 {
+		return os.MkdirTemp(dir, pattern)
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// commitStaged moves a completed download from stagingPath, made by
+// newStagingPath, to outputPath. The files of a multi-file torrent are moved
+// one by one, so an existing output directory is merged into rather than
+// replaced.
+func commitStaged(stagingPath, outputPath string, torrent Torrent) error {
+	if len(torrent.Info.Files) == 0 {
+		return moveFile(stagingPath, outputPath)
+	}
+	for _, entry := range torrent.Info.Files {
+		dst := filepath.Join(append([]string{outputPath}, entry.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := moveFile(filepath.Join(append([]string{stagingPath}, entry.Path...)...), dst); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(stagingPath)
+}
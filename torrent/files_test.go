@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// twoFileTorrent returns a torrent of two files whose boundary falls in the
+// middle of its second piece, and its data.
+func twoFileTorrent(t *testing.T) (Torrent, []byte) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	tor.Info.Files = []FileEntry{
+		{Length: 40000, Path: []string{"a.bin"}},
+		{Length: 60000, Path: []string{"sub", "b.bin"}},
+	}
+	return tor, data
+}
+
+// checkTwoFiles checks the files of twoFileTorrent below dir hold data.
+func checkTwoFiles(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	a, _ := os.ReadFile(filepath.Join(dir, "a.bin"))
+	b, _ := os.ReadFile(filepath.Join(dir, "sub", "b.bin"))
+	if !bytes.Equal(a, data[:40000]) || !bytes.Equal(b, data[40000:]) {
+		t.Fatal("files don't hold their byte ranges of the torrent data")
+	}
+}
+
+func TestDownloadMultiFile(t *testing.T) {
+	tor, data := twoFileTorrent(t)
+	peer := startSeeder(t, tor, data)
+	c := newTestClient(t)
+
+	parallel := filepath.Join(t.TempDir(), "parallel")
+	if err := c.Download(context.Background(), parallel, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTwoFiles(t, parallel, data)
+
+	single := filepath.Join(t.TempDir(), "single")
+	if err := c.DownloadFromPeer(single, tor, peer, false); err != nil {
+		t.Fatal(err)
+	}
+	checkTwoFiles(t, single, data)
+}
+
+func TestFilesListParsed(t *testing.T) {
+	dict, _, err := decodeDict("d5:filesld6:lengthi3e6:md5sum32:0123456789ABCDEF0123456789ABCDEF4:pathl1:x1:yeed6:lengthi2e4:pathl1:zeee4:name1:n12:piece lengthi8e6:pieces20:aaaaaaaaaaaaaaaaaaaae", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := infoFromDict(dict, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Length != 5 || len(info.Files) != 2 || filepath.Join(info.Files[0].Path...) != filepath.Join("x", "y") {
+		t.Fatalf("got %+v", info)
+	}
+	if info.Files[0].MD5Sum != "0123456789abcdef0123456789abcdef" || info.Files[1].MD5Sum != "" {
+		t.Errorf("md5sums: got %q and %q", info.Files[0].MD5Sum, info.Files[1].MD5Sum)
+	}
+
+	dict, _, _ = decodeDict("d5:filesld6:lengthi3e4:pathl2:..1:yeee4:name1:n12:piece lengthi4e6:pieces20:aaaaaaaaaaaaaaaaaaaae", 0)
+	if _, err := infoFromDict(dict, nil, ""); err == nil {
+		t.Error("accepted a path that leaves the output directory")
+	}
+}
+
+func TestMultiFileChecksums(t *testing.T) {
+	tor, data := twoFileTorrent(t)
+	for i, part := range [][]byte{data[:40000], data[40000:]} {
+		sum := md5.Sum(part)
+		tor.Info.Files[i].MD5Sum = hex.EncodeToString(sum[:])
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.bin"), data[:40000], 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.bin"), data[40000:], 0644)
+	if err := VerifyFileChecksum(dir, tor); err != nil {
+		t.Fatal(err)
+	}
+	if !tor.Info.hasChecksums() {
+		t.Error("hasChecksums is false with an md5sum for every file")
+	}
+
+	damaged := bytes.Clone(data[40000:])
+	damaged[0] ^= 1
+	os.WriteFile(filepath.Join(dir, "sub", "b.bin"), damaged, 0644)
+	if err := VerifyFileChecksum(dir, tor); !errors.Is(err, errFileChecksum) {
+		t.Fatalf("damaged second file: got %v, want %v", err, errFileChecksum)
+	}
+}
+
+func TestDownloadMultiFileWithEmptyFile(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	tor.Info.Files = []FileEntry{
+		{Length: 40000, Path: []string{"a.bin"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 60000, Path: []string{"sub", "b.bin"}},
+	}
+	peer := startSeeder(t, tor, data)
+	outputPath := filepath.Join(t.TempDir(), "out")
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	checkTwoFiles(t, outputPath, data)
+	info, err := os.Stat(filepath.Join(outputPath, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("empty file holds %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCreateFilesLeavesHoles(t *testing.T) {
+	tor, data := testTorrent(t, 16<<20, 256*1024)
+	path := filepath.Join(t.TempDir(), "sparse.bin")
+	files, err := CreateFiles(path, tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	// Only the third piece is written
+	offset := int64(2 * tor.Info.PieceLength)
+	if _, err := files.WriteAt(data[offset:offset+int64(tor.Info.PieceLength)], offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("file is %d bytes, want %d", info.Size(), len(data))
+	}
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated >= info.Size() {
+		t.Skipf("%d of %d bytes allocated; the filesystem doesn't keep holes", allocated, info.Size())
+	}
+	if allocated < int64(tor.Info.PieceLength) {
+		t.Errorf("only %d bytes allocated, less than the piece written", allocated)
+	}
+}
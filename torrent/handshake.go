@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+)
+
+func (c *Client) Handshake(torrent Torrent, peerAddress string, conn net.Conn) (recievedHandshake []byte, err error) {
+	return c.handshakeWithReserved(torrent, conn, make([]byte, 8))
+}
+
+// fastExtensionBit is the reserved-byte flag (BEP 6) advertising the fast
+// extension, set in reserved[7].
+const fastExtensionBit = 0x04
+
+// downloadReserved returns the reserved bytes we download with, advertising
+// the fast extension and the extension protocol.
+func downloadReserved() []byte {
+	reserved := make([]byte, 8)
+	reserved[5] |= extensionProtocolBit
+	reserved[7] |= fastExtensionBit
+	return reserved
+}
+
+// supportsFast reports whether a received handshake advertises the fast
+// extension.
+func supportsFast(handshake []byte) bool {
+	return len(handshake) >= 28 && handshake[27]&fastExtensionBit != 0
+}
+
+// buildHandshake returns our handshake for torrent with the given reserved
+// bytes.
+func (c *Client) buildHandshake(torrent Torrent, reserved []byte) []byte {
+	pstrlen := byte(19)
+	pstr := []byte("BitTorrent protocol")
+	handshake := append([]byte{pstrlen}, pstr...)
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, torrent.Info.InfoHash...)
+	handshake = append(handshake, c.PeerID...)
+	return handshake
+}
+
+// handshakeWithReserved performs the handshake advertising the given reserved
+// bytes.
+func (c *Client) handshakeWithReserved(torrent Torrent, conn net.Conn, reserved []byte) (recievedHandshake []byte, err error) {
+
+	err = writeFull(conn, c.buildHandshake(torrent, reserved))
+	if err != nil {
+		c.logf("Failed to write handshake: %v\n", err)
+		return recievedHandshake, err
+	}
+
+	recievedHandshake = make([]byte, 68)
+
+	n, err := io.ReadFull(conn, recievedHandshake)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = fmt.Errorf("short handshake (%d bytes)", n)
+	}
+
+	if err != nil {
+		c.logf("Failed to read handshake: %v\n", err)
+		return recievedHandshake, err
+	}
+	if err = validateHandshake(recievedHandshake, torrent.Info.InfoHash); err != nil {
+		return recievedHandshake, err
+	}
+	return recievedHandshake, err
+}
+
+// validateHandshake checks that a 68-byte handshake speaks the BitTorrent
+// protocol and is for the torrent with infoHash, so a peer serving some other
+// torrent can't feed us its data.
+func validateHandshake(handshake []byte, infoHash []byte) error {
+	if handshake[0] != 19 {
+		return fmt.Errorf("bad handshake: protocol string length %d, expected 19", handshake[0])
+	}
+	if pstr := string(handshake[1:20]); pstr != "BitTorrent protocol" {
+		return fmt.Errorf("bad handshake: protocol %q, expected \"BitTorrent protocol\"", pstr)
+	}
+	if got := handshake[28:48]; !bytes.Equal(got, infoHash) {
+		return fmt.Errorf("handshake for another torrent: info hash %x, expected %x", got, infoHash)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// peerHandshake returns a handshake for torrent from a peer with a made-up
+// peer ID.
+func peerHandshake(torrent Torrent) []byte {
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, torrent.Info.InfoHash...)
+	return append(handshake, "-TS0001-123456789012"...)
+}
+
+// answerHandshake reads our handshake from conn, writes reply and closes
+// conn.
+func answerHandshake(conn net.Conn, reply []byte) {
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		return
+	}
+	writeFull(conn, reply)
+}
+
+func TestShortHandshake(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go answerHandshake(theirs, peerHandshake(tor)[:40])
+
+	_, err := newTestClient(t).Handshake(tor, "peer", ours)
+	if err == nil || err.Error() != "short handshake (40 bytes)" {
+		t.Errorf("got %v, want a short handshake of 40 bytes", err)
+	}
+}
+
+func TestHandshakeRejectsMismatch(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	tests := []struct {
+		name   string
+		modify func(reply []byte)
+		want   string
+	}{
+		{"protocol length", func(reply []byte) { reply[0] = 18 }, "bad handshake: protocol string length 18, expected 19"},
+		{"protocol string", func(reply []byte) { copy(reply[1:20], "BitTorrent protocoL") }, `bad handshake: protocol "BitTorrent protocoL", expected "BitTorrent protocol"`},
+		{"info hash", func(reply []byte) { reply[47] ^= 0xff }, "handshake for another torrent: info hash"},
+	}
+	for _, test := range tests {
+		reply := peerHandshake(tor)
+		test.modify(reply)
+		ours, theirs := net.Pipe()
+		go answerHandshake(theirs, reply)
+		_, err := newTestClient(t).Handshake(tor, "peer", ours)
+		ours.Close()
+		if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+	}
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go answerHandshake(theirs, peerHandshake(tor))
+	if _, err := newTestClient(t).Handshake(tor, "peer", ours); err != nil {
+		t.Errorf("matching handshake: %v", err)
+	}
+}
+
+func TestHandshakeSendsClientPeerID(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	c := newTestClient(t)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	sent := make(chan []byte, 1)
+	go func() {
+		defer theirs.Close()
+		handshake := make([]byte, 68)
+		if _, err := io.ReadFull(theirs, handshake); err != nil {
+			return
+		}
+		sent <- handshake
+		writeFull(theirs, peerHandshake(tor))
+	}()
+	if _, err := c.Handshake(tor, "peer", ours); err != nil {
+		t.Fatal(err)
+	}
+	handshake := <-sent
+	if got := string(handshake[48:68]); got != c.PeerID {
+		t.Errorf("sent peer ID %q, want the client's %q", got, c.PeerID)
+	}
+	if reserved := handshake[20:28]; !bytes.Equal(reserved, make([]byte, 8)) {
+		t.Errorf("sent reserved bytes %x without negotiating extensions", reserved)
+	}
+}
@@ -0,0 +1,201 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestClient returns a Client with the default settings that logs
+// nothing.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	c, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testTorrent returns a single-file torrent of length random bytes in pieces
+// of pieceLength, and its data.
+func testTorrent(t *testing.T, length, pieceLength int) (Torrent, []byte) {
+	t.Helper()
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var pieces []byte
+	for off := 0; off < length; off += pieceLength {
+		hash := sha1.Sum(data[off:min(off+pieceLength, length)])
+		pieces = append(pieces, hash[:]...)
+	}
+	return Torrent{
+		Announce: "http://127.0.0.1:1/announce",
+		Info: Info{
+			Name:        "test.bin",
+			Length:      length,
+			PieceLength: pieceLength,
+			Pieces:      string(pieces),
+			InfoHash:    bytes.Repeat([]byte{7}, 20),
+		},
+	}, data
+}
+
+// testSeeder is a minimal peer that serves a torrent's data to every
+// connection it accepts: it answers the handshake, sends its bitfield,
+// unchokes whoever is interested and answers requests.
+type testSeeder struct {
+	torrent Torrent
+	data    []byte
+	// missing holds the pieces it leaves out of its bitfield.
+	missing map[int]bool
+	// stall makes it ignore requests.
+	stall bool
+	// held, if set, delays answering requests for a piece until its channel
+	// is closed, meanwhile reading on.
+	held map[int]chan struct{}
+	// allowedFast, if set, makes it negotiate the fast extension and never
+	// unchoke, serving only these pieces from its allowed fast set.
+	allowedFast []int
+	// cancels counts the cancel messages received.
+	cancels atomic.Int32
+}
+
+// startSeeder serves data on the loopback and returns the address.
+func startSeeder(t *testing.T, torrent Torrent, data []byte) string {
+	return (&testSeeder{torrent: torrent, data: data}).start(t)
+}
+
+// start listens on the loopback until the test ends and returns the
+// address.
+func (s *testSeeder) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		return
+	}
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	reserved := make([]byte, 8)
+	if s.allowedFast != nil {
+		reserved[7] |= fastExtensionBit
+	}
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, s.torrent.Info.InfoHash...)
+	handshake = append(handshake, "-TS0001-123456789012"...)
+	if writeFull(conn, handshake) != nil {
+		return
+	}
+	have := NewBitfield(s.torrent.PieceCount())
+	for i := 0; i < s.torrent.PieceCount(); i++ {
+		if !s.missing[i] {
+			have.SetPiece(i)
+		}
+	}
+	sendMessage(conn, 5, have)
+	for _, index := range s.allowedFast {
+		sendMessage(conn, 17, binary.BigEndian.AppendUint32(nil, uint32(index)))
+	}
+	// Answers to held requests are written from other goroutines
+	var writeMu sync.Mutex
+	send := func(id byte, payload []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		sendMessage(conn, id, payload)
+	}
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch id {
+		case 2: // interested
+			if s.allowedFast == nil {
+				send(1, nil)
+			}
+		case 6: // request
+			if s.stall || len(payload) != 12 {
+				continue
+			}
+			index := int(binary.BigEndian.Uint32(payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(payload[4:8]))
+			length := int(binary.BigEndian.Uint32(payload[8:12]))
+			offset := index*s.torrent.Info.PieceLength + begin
+			block := append(payload[:8:8], s.data[offset:offset+length]...)
+			if release, ok := s.held[index]; ok {
+				go func() {
+					<-release
+					send(7, block)
+				}()
+				continue
+			}
+			send(7, block)
+		case 8: // cancel
+			s.cancels.Add(1)
+		}
+	}
+}
+
+// startTracker runs an HTTP tracker that answers every announce with peers,
+// which must be IPv4, and returns its announce URL.
+func startTracker(t *testing.T, peers ...string) string {
+	t.Helper()
+	var compact []byte
+	for _, peer := range peers {
+		addr, err := net.ResolveTCPAddr("tcp4", peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact = append(compact, addr.IP.To4()...)
+		compact = binary.BigEndian.AppendUint16(compact, uint16(addr.Port))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "d8:intervali60e5:peers%d:%se", len(compact), compact)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+// writeTorrent bencodes a .torrent with announce and info into a temporary
+// file and returns its path.
+func writeTorrent(t *testing.T, announce string, info map[string]interface{}) string {
+	t.Helper()
+	data, err := encodeBencode(map[string]interface{}{"announce": announce, "info": info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// MagnetLink is what a magnet URI tells us about a torrent.
+type MagnetLink struct {
+	InfoHash    []byte
+	DisplayName string
+	Trackers    []string
+}
+
+// ParseMagnet parses a magnet:? URI. The info hash (xt=urn:btih:...) may be
+// hex or base32; the display name (dn) and trackers (tr) are optional.
+func ParseMagnet(uri string) (link MagnetLink, err error) {
+	if !strings.HasPrefix(uri, "magnet:?") {
+		return link, fmt.Errorf("not a magnet URI")
+	}
+	params, err := url.ParseQuery(uri[len("magnet:?"):])
+	if err != nil {
+		return link, fmt.Errorf("bad magnet URI: %v", err)
+	}
+	for _, xt := range params["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(hash) {
+		case 40:
+			link.InfoHash, err = hex.DecodeString(hash)
+		case 32:
+			link.InfoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("want 40 hex or 32 base32 characters")
+		}
+		if err != nil {
+			return link, fmt.Errorf("bad info hash %q: %v", hash, err)
+		}
+		break
+	}
+	if link.InfoHash == nil {
+		return link, fmt.Errorf("magnet URI has no urn:btih info hash")
+	}
+	link.DisplayName = params.Get("dn")
+	link.Trackers = params["tr"]
+	return link, nil
+}
+
+// utMetadataID is the extended message id we ask peers to use when sending
+// us ut_metadata messages.
+const utMetadataID = 1
+
+// metadataBlockSize is the size of every ut_metadata piece but the last.
+const metadataBlockSize = 16 * 1024
+
+// maxMetadataSize bounds the metadata_size we accept from a peer.
+const maxMetadataSize = 8 * 1024 * 1024
+
+// fetchMetadataFromPeer downloads the info dictionary with the ut_metadata
+// extension (BEP 9) from a peer we've handshaked with using
+// extensionReserved, and checks it hashes to infoHash.
+func (c *Client) fetchMetadataFromPeer(conn net.Conn, infoHash []byte) (Info, error) {
+	if err := c.sendExtensionHandshake(conn, map[string]int{"ut_metadata": utMetadataID}); err != nil {
+		return Info{}, err
+	}
+
+	// Wait for the peer's extension handshake
+	var ext peerExtensions
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return Info{}, err
+		}
+		if id != 20 || len(payload) == 0 || payload[0] != 0 {
+			continue
+		}
+		if ext, err = parseExtensionHandshake(payload[1:]); err != nil {
+			return Info{}, err
+		}
+		break
+	}
+	peerMetadataID, size := ext.ids["ut_metadata"], ext.metadataSize
+	if peerMetadataID == 0 {
+		return Info{}, fmt.Errorf("peer does not support ut_metadata")
+	}
+	if size <= 0 || size > maxMetadataSize {
+		return Info{}, fmt.Errorf("peer reported bad metadata size %d", size)
+	}
+
+	metadata := make([]byte, size)
+	pieceCnt := (size + metadataBlockSize - 1) / metadataBlockSize
+	for piece := 0; piece < pieceCnt; piece++ {
+		request, err := encodeBencode(map[string]interface{}{"msg_type": 0, "piece": piece})
+		if err != nil {
+			return Info{}, err
+		}
+		if err := sendExtended(conn, byte(peerMetadataID), request); err != nil {
+			return Info{}, err
+		}
+		data, err := receiveMetadataPiece(conn, piece)
+		if err != nil {
+			return Info{}, err
+		}
+		if want := min(metadataBlockSize, size-piece*metadataBlockSize); len(data) != want {
+			return Info{}, fmt.Errorf("metadata piece %d is %d bytes, expected %d", piece, len(data), want)
+		}
+		copy(metadata[piece*metadataBlockSize:], data)
+	}
+
+	if hash := sha1.Sum(metadata); !bytes.Equal(hash[:], infoHash) {
+		return Info{}, fmt.Errorf("metadata does not match the info hash")
+	}
+	info, _, err := decodeDict(string(metadata), 0)
+	if err != nil {
+		return Info{}, fmt.Errorf("bad metadata: %v", err)
+	}
+	return infoFromDict(info, infoHash, "")
+}
+
+// receiveMetadataPiece reads messages until the ut_metadata data message for
+// piece arrives and returns its data.
+func receiveMetadataPiece(conn net.Conn, piece int) ([]byte, error) {
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if id != 20 || len(payload) == 0 || payload[0] != utMetadataID {
+			continue
+		}
+		// The bencoded header is followed directly by the piece's data
+		header, end, err := decodeDict(string(payload[1:]), 0)
+		if err != nil {
+			return nil, fmt.Errorf("bad ut_metadata message: %v", err)
+		}
+		if index, _ := header["piece"].(int); index != piece {
+			continue
+		}
+		switch header["msg_type"] {
+		case 1: // data
+			return payload[1+end:], nil
+		case 2: // reject
+			return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+		}
+	}
+}
+
+// MetadataFromPeers fetches the info dictionary from the first of peers
+// that can supply it.
+func (c *Client) MetadataFromPeers(torrent Torrent, peers []string) (Info, error) {
+	lastErr := fmt.Errorf("no peers")
+	for _, peer := range peers {
+		info, err := func() (Info, error) {
+			conn, err := c.DialPeer("tcp", peer)
+			if err != nil {
+				return Info{}, err
+			}
+			defer conn.Close()
+			received, err := c.handshakeWithReserved(torrent, conn, extensionReserved())
+			if err != nil {
+				return Info{}, err
+			}
+			if !supportsExtensions(received) {
+				return Info{}, fmt.Errorf("peer does not support the extension protocol")
+			}
+			return c.fetchMetadataFromPeer(conn, torrent.Info.InfoHash)
+		}()
+		if err == nil {
+			return info, nil
+		}
+		c.logf("Metadata from peer %s failed: %v\n", peer, err)
+		lastErr = err
+	}
+	return Info{}, fmt.Errorf("could not fetch metadata from any peer, last error: %v", lastErr)
+}
@@ -0,0 +1,101 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hexHash := "d69f91e6b2ae4c542468d1073a71d4ea13879a7f"
+	for _, uri := range []string{
+		"magnet:?xt=urn:btih:" + hexHash + "&dn=sample.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A80",
+		"magnet:?xt=urn:btih:22PZDZVSVZGFIJDI2EDTU4OU5IJYPGT7&dn=sample.txt&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Ftracker.example%3A80",
+	} {
+		link, err := ParseMagnet(uri)
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		if fmt.Sprintf("%x", link.InfoHash) != hexHash {
+			t.Errorf("%s: info hash %x, want %s", uri, link.InfoHash, hexHash)
+		}
+		if link.DisplayName != "sample.txt" || len(link.Trackers) != 2 || link.Trackers[1] != "udp://tracker.example:80" {
+			t.Errorf("%s: got %+v", uri, link)
+		}
+	}
+
+	for _, uri := range []string{
+		"http://example.com/",
+		"magnet:?dn=no-hash",
+		"magnet:?xt=urn:btih:abc",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s: parsed without error", uri)
+		}
+	}
+}
+
+// serveMetadata answers our extension handshake and ut_metadata requests on
+// conn with metadata.
+func serveMetadata(conn net.Conn, metadata []byte) {
+	const peerMetadataID = 3
+	if _, _, err := readMessage(conn); err != nil { // our extension handshake
+		return
+	}
+	handshake := fmt.Sprintf("d1:md11:ut_metadatai%dee13:metadata_sizei%dee", peerMetadataID, len(metadata))
+	sendMessage(conn, 20, append([]byte{0}, handshake...))
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if id != 20 || len(payload) == 0 || payload[0] != peerMetadataID {
+			continue
+		}
+		request, _, err := decodeDict(string(payload[1:]), 0)
+		if err != nil {
+			return
+		}
+		piece := request["piece"].(int)
+		chunk := metadata[piece*metadataBlockSize : min((piece+1)*metadataBlockSize, len(metadata))]
+		header := fmt.Sprintf("d8:msg_typei1e5:piecei%de10:total_sizei%dee", piece, len(metadata))
+		sendMessage(conn, 20, append(append([]byte{utMetadataID}, header...), chunk...))
+	}
+}
+
+func TestFetchMetadataInSeveralPieces(t *testing.T) {
+	// 1000 pieces make an info dictionary of more than one 16 KiB block
+	const pieceCount = 1000
+	metadata := fmt.Sprintf("d6:lengthi%de4:name8:big.file12:piece lengthi16384e6:pieces%d:%se",
+		pieceCount*16384, pieceCount*20, bytes.Repeat([]byte{0xaa}, pieceCount*20))
+	if len(metadata) <= metadataBlockSize {
+		t.Fatalf("metadata is only %d bytes", len(metadata))
+	}
+	infoHash := sha1.Sum([]byte(metadata))
+
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go serveMetadata(theirs, []byte(metadata))
+
+	info, err := newTestClient(t).fetchMetadataFromPeer(ours, infoHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "big.file" || info.Length != pieceCount*16384 || len(info.Pieces) != pieceCount*20 {
+		t.Errorf("got %s of %d bytes with %d bytes of hashes", info.Name, info.Length, len(info.Pieces))
+	}
+}
+
+func TestFetchMetadataChecksInfoHash(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go serveMetadata(theirs, []byte("d6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:aaaaaaaaaaaaaaaaaaaae"))
+
+	if _, err := newTestClient(t).fetchMetadataFromPeer(ours, make([]byte, 20)); err == nil {
+		t.Fatal("accepted metadata that doesn't match the info hash")
+	}
+}
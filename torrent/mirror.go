@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// mirrorRetryDelay is how long mirror waits after a failed download or
+// announce before trying again.
+var mirrorRetryDelay = 30 * time.Second
+
+// DefaultAnnounceInterval is used when a tracker doesn't say how often to
+// announce.
+const DefaultAnnounceInterval = 30 * time.Minute
+
+// MirrorDownload brings outputPath to a complete, verified copy of torrent,
+// resuming any earlier partial download and retrying until it succeeds or
+// ctx is done. An incomplete file already at outputPath is resumed into,
+// keeping the pieces that verify.
+func (c *Client) MirrorDownload(ctx context.Context, torrent Torrent, outputPath string) error {
+	for {
+		present, err := CheckPieces(torrent, outputPath, runtime.GOMAXPROCS(0))
+		if err == nil && !slices.Contains(present, false) {
+			c.logf("Verified %v\n", outputPath)
+			return nil
+		}
+		if err == nil {
+			if len(torrent.Info.Files) > 0 {
+				return fmt.Errorf("%v exists but is incomplete, and multi-file torrents can't be resumed yet", outputPath)
+			}
+			c.logf("%v is incomplete, resuming it\n", outputPath)
+			if err := adoptPartial(torrent, outputPath, present); err != nil {
+				return err
+			}
+		}
+		peers, err := c.Peers(torrent)
+		if err == nil {
+			err = c.Download(ctx, outputPath, torrent, peers, DownloadOptions{
+				Network:             "tcp",
+				Resume:              true,
+				ResumeFlushPieces:   DefaultResumeFlushPieces,
+				ResumeFlushInterval: DefaultResumeFlushInterval,
+			})
+		}
+		if err == nil {
+			continue // verify what was written
+		}
+		c.logf("Download failed: %v\n", err)
+		c.logf("Retrying in %v\n", mirrorRetryDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(mirrorRetryDelay):
+		}
+	}
+}
+
+// adoptPartial moves the incomplete file at outputPath to its .part path,
+// with a resume state recording the pieces present says verified, so a
+// resumable download continues from it.
+func adoptPartial(torrent Torrent, outputPath string, present []bool) error {
+	if _, err := os.Stat(partPath(outputPath)); err == nil {
+		return fmt.Errorf("%v is incomplete and %v also exists; remove one of them", outputPath, partPath(outputPath))
+	}
+	state := &ResumeState{InfoHash: hex.EncodeToString(torrent.Info.InfoHash), Pieces: NewBitfield(torrent.PieceCount())}
+	for index, ok := range present {
+		if ok {
+			state.Pieces.SetPiece(index)
+		}
+	}
+	if err := saveResumeState(resumeStatePath(outputPath), state); err != nil {
+		return err
+	}
+	return os.Rename(outputPath, partPath(outputPath))
+}
+
+// MirrorAnnounce announces us as a seeder every tracker interval until ctx
+// is done. Each tier of trackers gets the announce, going through the tier's
+// URLs until one answers; the shortest interval among them sets the pace.
+func (c *Client) MirrorAnnounce(ctx context.Context, torrent Torrent) {
+	// completed is sent once to each tracker, on its first announce
+	completed := make(map[string]bool)
+	for {
+		interval := time.Duration(0)
+		answered := false
+		for _, urls := range trackerTiers(torrent) {
+			for _, u := range urls {
+				extra := url.Values{"left": {"0"}}
+				if !completed[u] {
+					extra.Set("event", "completed")
+				}
+				_, trackerInterval, err := c.announceWithInterval(torrent, u, extra)
+				if err != nil {
+					c.logf("Announce to %v failed: %v\n", u, err)
+					continue
+				}
+				completed[u] = true
+				c.startedTrackers.Store(trackerKey(torrent, u), u)
+				if trackerInterval <= 0 {
+					trackerInterval = DefaultAnnounceInterval
+				}
+				if !answered || trackerInterval < interval {
+					interval = trackerInterval
+				}
+				answered = true
+				break
+			}
+		}
+		if !answered {
+			c.logf("No tracker accepted the announce\n")
+			interval = mirrorRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
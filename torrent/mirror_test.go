@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fetchBlock connects to the seeder at addr as an inbound peer would and
+// returns the first block of piece index.
+func fetchBlock(t *testing.T, addr string, torrent Torrent, index int) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := append([]byte{19}, "BitTorrent protocol"...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, torrent.Info.InfoHash...)
+	handshake = append(handshake, "-TS0001-inbound-peer"...)
+	if err := writeFull(conn, handshake); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(conn, 2, nil)
+	length := min(16*1024, torrent.PieceSize(index))
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch id {
+		case 1: // unchoke
+			sendMessage(conn, 6, blockPayload(index, 0, length))
+		case 7: // piece
+			if int(binary.BigEndian.Uint32(payload[0:4])) != index || len(payload) != 8+length {
+				t.Fatalf("got a %d-byte block of piece %d, want %d bytes of piece %d", len(payload)-8, binary.BigEndian.Uint32(payload), length, index)
+			}
+			return payload[8:]
+		}
+	}
+}
+
+func TestMirrorDownloadsThenSeeds(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	tor.Announce = startTracker(t, startSeeder(t, tor, data))
+	c := newTestClient(t)
+	outputPath := filepath.Join(t.TempDir(), "mirror.bin")
+	if err := c.MirrorDownload(context.Background(), tor, outputPath); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("mirrored data differs")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go c.Seed(ln, tor, outputPath)
+	offset := 2 * tor.Info.PieceLength
+	if got := fetchBlock(t, ln.Addr().String(), tor, 2); !bytes.Equal(got, data[offset:offset+len(got)]) {
+		t.Fatal("seeded block differs from the torrent data")
+	}
+}
+
+func TestMirrorResumesIncompleteFile(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	seeder := &testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true}}
+	tor.Announce = startTracker(t, seeder.start(t))
+	outputPath := filepath.Join(t.TempDir(), "mirror.bin")
+	// Only the first piece is there, and the seeder doesn't have it
+	partial := make([]byte, len(data))
+	copy(partial, data[:tor.Info.PieceLength])
+	if err := os.WriteFile(outputPath, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := newTestClient(t).MirrorDownload(ctx, tor, outputPath); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("resumed data differs")
+	}
+	if _, err := os.Stat(partPath(outputPath)); !os.IsNotExist(err) {
+		t.Errorf("%v left behind", partPath(outputPath))
+	}
+}
+
+func TestMirrorAnnounceToAnnounceListTiers(t *testing.T) {
+	// One tracker per tier is reached; the first tier's dead URL is skipped
+	announces := make(chan string, 8)
+	tracker := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			announces <- name + " left=" + r.URL.Query().Get("left") + " event=" + r.URL.Query().Get("event")
+			fmt.Fprint(w, "d8:intervali3600e5:peers0:e")
+		}))
+		t.Cleanup(server.Close)
+		return server.URL + "/announce"
+	}
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = ""
+	tor.AnnounceList = [][]string{{"http://127.0.0.1:1/announce", tracker("first")}, {tracker("second")}}
+	withFastTrackerRetries(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newTestClient(t).MirrorAnnounce(ctx, tor)
+		close(done)
+	}()
+	var got []string
+	for len(got) < 2 {
+		select {
+		case a := <-announces:
+			got = append(got, a)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got announces %q, want one to each tier", got)
+		}
+	}
+	cancel()
+	<-done
+	sort.Strings(got)
+	if want := []string{"first left=0 event=completed", "second left=0 event=completed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got announces %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,323 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+func (c *Client) DownloadPiece(conn net.Conn, torrent Torrent, index int) (pieceData []byte, err error) {
+
+	//wait for bitfield message
+	_, _, err = readMessage(conn)
+	if err != nil {
+		c.logf("%v\n", err)
+		return
+	}
+	c.logf("bitfield message recieved: %v\n", index)
+
+	//constructed interested
+	message := make([]byte, 5)
+	message[4] = byte(2)
+	binary.BigEndian.PutUint32(message[0:4], uint32(1))
+
+	//send interested
+	err = writeFull(conn, message)
+	if err != nil {
+		c.logf("%v\n", err)
+		return
+	}
+
+	//wait for unchoke, skipping anything else the peer sends first
+	for {
+		var id uint8
+		id, _, err = readMessage(conn)
+		if err != nil {
+			c.logf("%v\n", err)
+			return
+		}
+		if id == 1 {
+			break
+		}
+	}
+
+	c.logf("unchoke message recieved: %v\n", index)
+
+	pieceData, err = c.newPeerSession(conn, conn.RemoteAddr().String(), nil).DownloadPiece(torrent, index)
+	if err != nil {
+		c.logf("%v\n", err)
+		return nil, err
+	}
+
+	return pieceData, err
+}
+
+// DownloadFromPeer downloads the whole torrent from a single peer.
+func (c *Client) DownloadFromPeer(outputPath string, torrent Torrent, peer string, resume bool) error {
+	conn, err := c.DialPeer("tcp", peer)
+	if err != nil {
+		return fmt.Errorf("bad peer: %v", err)
+	}
+	defer conn.Close()
+
+	c.logf("Peer list extracted and connection dialed\n")
+
+	if _, err := c.Handshake(torrent, peer, conn); err != nil {
+		return fmt.Errorf("handshake error: %v", err)
+	}
+	c.logf("Firm Handshake\n")
+
+	if err := c.downloadTorrentComplete(outputPath, conn, peer, torrent, resume); err != nil {
+		return fmt.Errorf("download err: %v", err)
+	}
+	return nil
+}
+
+// downloadTorrentComplete downloads every piece in order over conn. With
+// resume it continues from the .part file at outputPath, skipping pieces that
+// still verify.
+func (c *Client) downloadTorrentComplete(outputPath string, conn net.Conn, peer string, torrent Torrent, resume bool) (err error) {
+
+	//wait for bitfield message
+	id, payload, err := readMessage(conn)
+	if err != nil {
+		c.logf("%v\n", err)
+		return
+	}
+	var have Bitfield
+	if id == 5 {
+		have = Bitfield(payload)
+	}
+	c.logf("bitfield message recieved\n")
+
+	//constructed interested
+	message := make([]byte, 5)
+	message[4] = byte(2)
+	binary.BigEndian.PutUint32(message[0:4], uint32(1))
+
+	//send interested
+	err = writeFull(conn, message)
+	if err != nil {
+		c.logf("%v\n", err)
+		return
+	}
+
+	//wait for unchoke, skipping anything else the peer sends first
+	for {
+		id, _, err = readMessage(conn)
+		if err != nil {
+			c.logf("%v\n", err)
+			return
+		}
+		if id == 1 {
+			break
+		}
+	}
+
+	c.logf("unchoke message recieved\n")
+
+	pieceCnt := torrent.PieceCount()
+
+	// Each verified piece is written straight to disk. A resumable download
+	// writes into the .part file and records the piece in the resume state
+	// before moving on; otherwise the download is staged in a temporary file
+	// that replaces outputPath only once complete
+	var state *ResumeState
+	var progress *ProgressTracker
+	var stagingPath string
+	writePath := outputPath
+	if resume {
+		if len(torrent.Info.Files) > 0 {
+			return fmt.Errorf("--resume doesn't support multi-file torrents yet")
+		}
+		state, err = loadResumeState(resumeStatePath(outputPath), torrent)
+		if err != nil {
+			return err
+		}
+		if err = c.reverifyResumeState(torrent, partPath(outputPath), state, runtime.GOMAXPROCS(0)); err != nil {
+			return err
+		}
+		writePath = partPath(outputPath)
+	} else {
+		stagingPath, err = newStagingPath("", outputPath, torrent)
+		if err != nil {
+			return err
+		}
+		writePath = stagingPath
+		defer func() {
+			if stagingPath != "" {
+				os.RemoveAll(stagingPath)
+			}
+		}()
+	}
+	files, err := CreateFiles(writePath, torrent)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	if c.showProgress() {
+		pieces, bytes := remainingWork(torrent, state)
+		progress = newProgressTracker(pieces, bytes, time.Now())
+		stopProgress := c.startProgress(progress)
+		defer stopProgress()
+	}
+
+	session := c.newPeerSession(conn, peer, have)
+	for index := 0; index < pieceCnt; index++ {
+		if state != nil && state.Pieces.HasPiece(index) {
+			c.verbosef("Piece Skipped: %d\n", index)
+			continue
+		}
+		if have != nil && !have.HasPiece(index) {
+			return fmt.Errorf("%w: piece %d", errPeerLacksPiece, index)
+		}
+		c.verbosef("Piece Started: %d\n", index)
+
+		pieceData, err := session.DownloadPiece(torrent, index)
+		if err != nil {
+			c.logf("Error on %v : %v\n", index, err)
+			return err
+		}
+		c.verbosef("Piece Finished: %d\n", index)
+
+		hash, err := getPieceHash(torrent, index)
+		if err != nil {
+			return err
+		}
+		if !verifyPiece(pieceData, hash) {
+			return fmt.Errorf("piece %d failed hash check", index)
+		}
+		if _, err = files.WriteAt(pieceData, int64(index)*int64(torrent.Info.PieceLength)); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress.Add(len(pieceData), time.Now())
+		}
+		if state == nil {
+			continue
+		}
+		// Data must reach disk before the state claims it
+		if err = files.Sync(); err != nil {
+			return err
+		}
+		state.Pieces.SetPiece(index)
+		if err = saveResumeState(resumeStatePath(outputPath), state); err != nil {
+			return err
+		}
+	}
+
+	if err = files.Close(); err != nil {
+		return err
+	}
+	// Piece hashes were checked as the data arrived; re-reading it from disk
+	// also catches pieces written to the wrong place
+	if state != nil {
+		if err = finishResume(outputPath); err != nil {
+			return err
+		}
+		return verifyAssembled(outputPath, torrent)
+	}
+	if err = verifyAssembled(stagingPath, torrent); err != nil {
+		return err
+	}
+	if err = commitStaged(stagingPath, outputPath, torrent); err != nil {
+		return err
+	}
+	stagingPath = ""
+	return nil
+}
+
+// waitForUnchoke sends interested and reads messages until the peer either
+// unchokes us or, when the fast extension was negotiated, puts index in its
+// allowed fast set so we may request it while still choked. It returns the
+// pieces the peer announced along the way, or nil if it announced none, and
+// whether we were unchoked rather than only allowed index. If ext is set, the
+// peer's extension handshake is recorded in it.
+func waitForUnchoke(conn net.Conn, index int, pieceCnt int, fast bool, ext *peerExtensions) (have Bitfield, unchoked bool, err error) {
+	// Send interested message
+	message := make([]byte, 5)
+	message[4] = byte(2)
+	binary.BigEndian.PutUint32(message[0:4], uint32(1))
+	if err = writeFull(conn, message); err != nil {
+		return nil, false, err
+	}
+
+	buf := make([]byte, 5)
+	for {
+		if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+			return have, false, err
+		}
+		length := binary.BigEndian.Uint32(buf[:4])
+		if length == 0 {
+			continue // keep-alive
+		}
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return have, false, err
+		}
+		id := buf[0]
+		rest := int64(length - 1)
+
+		// Stream the bitfield into a fixed-size bitfield rather than a
+		// buffer sized by the peer
+		if id == 5 {
+			have = NewBitfield(pieceCnt)
+			n := min(rest, int64(len(have)))
+			if _, err = io.ReadFull(conn, have[:n]); err != nil {
+				return have, false, err
+			}
+			if _, err = io.CopyN(io.Discard, conn, rest-n); err != nil {
+				return have, false, err
+			}
+			continue
+		}
+
+		// The peer's extension handshake, if we negotiated the protocol
+		if id == 20 && ext != nil && rest <= maxMessageLength {
+			payload := make([]byte, rest)
+			if _, err = io.ReadFull(conn, payload); err != nil {
+				return have, false, err
+			}
+			recordExtensionHandshake(ext, payload)
+			continue
+		}
+
+		// The other messages we care about carry at most a piece index
+		var payload []byte
+		if rest == 4 {
+			payload = buf[1:5]
+			if _, err = io.ReadFull(conn, payload); err != nil {
+				return have, false, err
+			}
+		} else if _, err = io.CopyN(io.Discard, conn, rest); err != nil {
+			return have, false, err
+		}
+
+		switch id {
+		case 1: // unchoke
+			return have, true, nil
+		case 4: // have
+			if payload != nil {
+				if have == nil {
+					have = NewBitfield(pieceCnt)
+				}
+				have.SetPiece(int(binary.BigEndian.Uint32(payload)))
+			}
+		case 14: // have all
+			have = NewBitfield(pieceCnt)
+			for i := 0; i < pieceCnt; i++ {
+				have.SetPiece(i)
+			}
+		case 15: // have none
+			have = NewBitfield(pieceCnt)
+		case 17: // allowed fast
+			if fast && payload != nil && binary.BigEndian.Uint32(payload) == uint32(index) {
+				return have, false, nil
+			}
+		}
+	}
+}
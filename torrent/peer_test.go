@@ -0,0 +1,61 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// scriptedConn is a peer connection that replays a fixed stream of bytes
+// and discards whatever is written to it.
+type scriptedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *scriptedConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkWaitForUnchokeLargeBitfield(b *testing.B) {
+	const pieceCnt = 500000
+	bitfield := bytes.Repeat([]byte{0xff}, (pieceCnt+7)/8)
+	var stream []byte
+	stream = binary.BigEndian.AppendUint32(stream, uint32(1+len(bitfield)))
+	stream = append(stream, 5)
+	stream = append(stream, bitfield...)
+	stream = append(stream, 0, 0, 0, 1, 1) // unchoke
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	for i := 0; i < b.N; i++ {
+		conn := &scriptedConn{r: bytes.NewReader(stream)}
+		have, unchoked, err := waitForUnchoke(conn, 0, pieceCnt, false, nil)
+		if err != nil || !unchoked || !have.HasPiece(pieceCnt-1) {
+			b.Fatalf("unchoked %v, err %v", unchoked, err)
+		}
+	}
+}
+
+func BenchmarkDownloadPiece(b *testing.B) {
+	tor := Torrent{Info: Info{Length: 1 << 20, PieceLength: 1 << 20}}
+	data := bytes.Repeat([]byte{0x3c}, tor.Info.Length)
+	const blockSize = 16 * 1024
+	var stream []byte
+	for begin := 0; begin < tor.Info.Length; begin += blockSize {
+		stream = binary.BigEndian.AppendUint32(stream, uint32(9+blockSize))
+		stream = append(stream, 7)
+		stream = append(stream, blockPayload(0, begin, blockSize)[:8]...)
+		stream = append(stream, data[begin:begin+blockSize]...)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(tor.Info.Length))
+	for i := 0; i < b.N; i++ {
+		s := NewPeerSession(&scriptedConn{r: bytes.NewReader(stream)}, nil)
+		if _, err := s.DownloadPiece(tor, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
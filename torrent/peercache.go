@@ -0,0 +1,71 @@
+package torrent
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+// cachedPeer is a peer that successfully served a piece, as stored in the
+// peer cache sidecar file.
+type cachedPeer struct {
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func PeerCachePath(outputPath string) string {
+	return outputPath + ".peers"
+}
+
+// LoadPeerCache returns the cached peers seen within ttl, most recent first.
+// A missing or unreadable cache yields no peers.
+func LoadPeerCache(path string, ttl time.Duration) (peers []string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var cached []cachedPeer
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].LastSeen.After(cached[j].LastSeen) })
+	for _, c := range cached {
+		if time.Since(c.LastSeen) <= ttl {
+			peers = append(peers, c.Addr)
+		}
+	}
+	return peers
+}
+
+// savePeerCache stamps good with the current time and merges it into the
+// cache at path, dropping entries older than ttl.
+func savePeerCache(path string, good []string, ttl time.Duration) error {
+	now := time.Now()
+	seen := make(map[string]bool)
+	var cached []cachedPeer
+	for _, addr := range good {
+		if !seen[addr] {
+			seen[addr] = true
+			cached = append(cached, cachedPeer{Addr: addr, LastSeen: now})
+		}
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		var previous []cachedPeer
+		if json.Unmarshal(data, &previous) == nil {
+			for _, c := range previous {
+				if !seen[c.Addr] && now.Sub(c.LastSeen) <= ttl {
+					seen[c.Addr] = true
+					cached = append(cached, c)
+				}
+			}
+		}
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
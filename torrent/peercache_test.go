@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerCacheExpiresAndOrders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.bin.peers")
+	now := time.Now()
+	cached := []cachedPeer{
+		{Addr: "10.0.0.1:6881", LastSeen: now.Add(-30 * time.Minute)},
+		{Addr: "10.0.0.2:6881", LastSeen: now.Add(-2 * time.Hour)},
+		{Addr: "10.0.0.3:6881", LastSeen: now.Add(-time.Minute)},
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := LoadPeerCache(path, time.Hour)
+	want := []string{"10.0.0.3:6881", "10.0.0.1:6881"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Saving refreshes the peers given and drops the expired one
+	if err := savePeerCache(path, []string{"10.0.0.1:6881"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	got = LoadPeerCache(path, 24*time.Hour)
+	want = []string{"10.0.0.1:6881", "10.0.0.3:6881"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after save got %q, want %q", got, want)
+	}
+
+	if peers := LoadPeerCache(filepath.Join(t.TempDir(), "missing"), time.Hour); peers != nil {
+		t.Errorf("missing cache gave %q", peers)
+	}
+}
+
+// notifyDialer dials for real and closes dialed the first time addr is
+// dialed.
+type notifyDialer struct {
+	addr   string
+	dialed chan struct{}
+	once   sync.Once
+}
+
+func (d *notifyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == d.addr {
+		d.once.Do(func() { close(d.dialed) })
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestCachedPeerUsedBeforeTracker(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	cachePath := PeerCachePath(outputPath)
+	cachedSeeder := startSeeder(t, tor, data)
+	if err := savePeerCache(cachePath, []string{cachedSeeder}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tracker holds its first request until the cached peer is dialed,
+	// which only happens if the download didn't wait for the announce
+	dialer := &notifyDialer{addr: cachedSeeder, dialed: make(chan struct{})}
+	var waited atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-dialer.dialed:
+		case <-time.After(5 * time.Second):
+			waited.Store(true)
+		}
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer server.Close()
+	tor.Announce = server.URL + "/announce"
+
+	c := newTestClient(t)
+	c.Dialer = dialer
+	cached := LoadPeerCache(cachePath, time.Hour)
+	opts := DownloadOptions{
+		Network:         "tcp",
+		PeerCachePath:   cachePath,
+		PeerCacheTTL:    time.Hour,
+		InitialAnnounce: func() ([]string, time.Duration, error) { return c.PeersWithInterval(tor) },
+	}
+	if err := c.Download(context.Background(), outputPath, tor, cached, opts); err != nil {
+		t.Fatal(err)
+	}
+	if waited.Load() {
+		t.Error("the tracker was asked and answered before the cached peer was dialed")
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the torrent's")
+	}
+	if peers := LoadPeerCache(cachePath, time.Hour); !reflect.DeepEqual(peers, []string{cachedSeeder}) {
+		t.Errorf("cache holds %q after the download", peers)
+	}
+}
+
+func TestStaleCachedPeerWaitsForTracker(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := ln.Addr().String()
+	ln.Close()
+
+	// The cached peer is gone; the pieces wait for the slow tracker's peer
+	seeder := startSeeder(t, tor, data)
+	c := newTestClient(t)
+	opts := DownloadOptions{
+		Network: "tcp",
+		InitialAnnounce: func() ([]string, time.Duration, error) {
+			time.Sleep(200 * time.Millisecond)
+			return []string{seeder}, 0, nil
+		},
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := c.Download(context.Background(), outputPath, tor, []string{gone}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the torrent's")
+	}
+}
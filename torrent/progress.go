@@ -0,0 +1,235 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etaWindow is the span of recent samples the download rate is averaged over
+// once the download has been running for a while.
+const etaWindow = 10 * time.Second
+
+type rateSample struct {
+	at   time.Time
+	done int64
+}
+
+// etaEstimator turns completed byte counts into a download rate and an
+// estimated time remaining.
+type etaEstimator struct {
+	mu      sync.Mutex
+	total   int64
+	done    int64
+	start   time.Time
+	samples []rateSample
+}
+
+func newETAEstimator(total int64, start time.Time) *etaEstimator {
+	return &etaEstimator{total: total, start: start, samples: []rateSample{{at: start}}}
+}
+
+// add records n more bytes completed at time at.
+func (e *etaEstimator) add(n int, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done += int64(n)
+	e.samples = append(e.samples, rateSample{at: at, done: e.done})
+	// Keep one sample older than the window as the baseline
+	for len(e.samples) > 2 && at.Sub(e.samples[1].at) > etaWindow {
+		e.samples = e.samples[1:]
+	}
+}
+
+// estimate returns the fraction done, the rate in bytes per second and the
+// time remaining at time now. Early on, when a few pieces make a short window
+// noisy, the rate is averaged over everything since the start instead. ok is
+// false until there is a rate to go on.
+func (e *etaEstimator) estimate(now time.Time) (fraction float64, rate float64, eta time.Duration, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.total > 0 {
+		fraction = float64(e.done) / float64(e.total)
+	}
+
+	base := e.samples[0]
+	if now.Sub(e.start) < 3*etaWindow {
+		base = rateSample{at: e.start}
+	}
+	elapsed := now.Sub(base.at).Seconds()
+	if elapsed <= 0 || e.done == base.done {
+		return fraction, 0, 0, false
+	}
+	rate = float64(e.done-base.done) / elapsed
+	eta = time.Duration(float64(e.total-e.done) / rate * float64(time.Second))
+	return fraction, rate, eta, true
+}
+
+// formatETA renders d as hh:mm:ss.
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+// reportETA prints progress, rate and ETA every interval until stop closes.
+func (c *Client) reportETA(e *etaEstimator, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			fraction, rate, eta, ok := e.estimate(now)
+			if !ok {
+				c.logf("%.0f%% — waiting for data\n", fraction*100)
+				continue
+			}
+			c.logf("%.0f%% — %.1f MB/s — ETA %s\n", fraction*100, rate/1e6, formatETA(eta))
+		}
+	}
+}
+
+// remainingWork returns how many pieces, and how many bytes, are not yet in
+// state; everything when state is nil.
+func remainingWork(torrent Torrent, state *ResumeState) (pieces int, bytes int64) {
+	for i := 0; i < torrent.PieceCount(); i++ {
+		if state == nil || !state.Pieces.HasPiece(i) {
+			pieces++
+			bytes += int64(torrent.PieceSize(i))
+		}
+	}
+	return pieces, bytes
+}
+
+// showProgress reports whether downloads should draw a progress bar: only
+// when the per-piece logs are off and the log is a terminal, where the bar
+// can redraw itself in place.
+func (c *Client) showProgress() bool {
+	if c.Verbose {
+		return false
+	}
+	f, ok := c.Log.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBarWidth is the number of cells in the progress bar.
+const progressBarWidth = 30
+
+// ProgressTracker counts verified pieces and downloaded bytes and renders
+// them as a single progress line with a moving-average download rate.
+type ProgressTracker struct {
+	mu          sync.Mutex
+	rate        *etaEstimator
+	pieces      int
+	totalPieces int
+	bytes       int64
+	totalBytes  int64
+}
+
+func newProgressTracker(totalPieces int, totalBytes int64, start time.Time) *ProgressTracker {
+	return &ProgressTracker{
+		rate:        newETAEstimator(totalBytes, start),
+		totalPieces: totalPieces,
+		totalBytes:  totalBytes,
+	}
+}
+
+// Add records a verified piece of n bytes at time at.
+func (p *ProgressTracker) Add(n int, at time.Time) {
+	p.mu.Lock()
+	p.pieces++
+	p.bytes += int64(n)
+	p.mu.Unlock()
+	p.rate.add(n, at)
+}
+
+// Rate returns the download rate in bytes per second at time now, averaged
+// over the estimator's window, or 0 before any data arrived.
+func (p *ProgressTracker) Rate(now time.Time) float64 {
+	_, rate, _, _ := p.rate.estimate(now)
+	return rate
+}
+
+// Line renders the progress at time now, e.g.
+// "[=======>      ]  25.0%  1.0/4.0 MiB  0.50 MiB/s  (1/4 pieces)".
+func (p *ProgressTracker) Line(now time.Time) string {
+	p.mu.Lock()
+	pieces, bytes := p.pieces, p.bytes
+	p.mu.Unlock()
+
+	fraction := 1.0
+	if p.totalBytes > 0 {
+		fraction = float64(bytes) / float64(p.totalBytes)
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	const mib = 1 << 20
+	return fmt.Sprintf("[%s] %5.1f%%  %.1f/%.1f MiB  %.2f MiB/s  (%d/%d pieces)",
+		bar, fraction*100, float64(bytes)/mib, float64(p.totalBytes)/mib, p.Rate(now)/mib, pieces, p.totalPieces)
+}
+
+// run redraws the progress line every interval until stop closes, then
+// draws it a last time and ends the line.
+func (p *ProgressTracker) run(w io.Writer, interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			fmt.Fprintf(w, "\r%s\n", p.Line(time.Now()))
+			return
+		case now := <-ticker.C:
+			fmt.Fprintf(w, "\r%s", p.Line(now))
+		}
+	}
+}
+
+// startProgress draws tracker to the log every half second until the
+// returned stop function is called.
+func (c *Client) startProgress(tracker *ProgressTracker) (stop func()) {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go tracker.run(c.Log, 500*time.Millisecond, stopCh, done)
+	return func() {
+		close(stopCh)
+		<-done
+	}
+}
+
+// printPeerStats prints, per peer, the pieces it supplied and how many pieces
+// it served that failed verification.
+func (c *Client) printPeerStats(pieceSources map[int]string, badPieces map[string]int) {
+	supplied := make(map[string][]int)
+	for index, peer := range pieceSources {
+		supplied[peer] = append(supplied[peer], index)
+	}
+	var peers []string
+	for peer := range supplied {
+		peers = append(peers, peer)
+	}
+	for peer := range badPieces {
+		if _, ok := supplied[peer]; !ok {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+
+	c.logf("Peer stats:\n")
+	for _, peer := range peers {
+		sort.Ints(supplied[peer])
+		c.logf("  %s: %d pieces %v, %d failed verification\n", peer, len(supplied[peer]), supplied[peer], badPieces[peer])
+	}
+}
@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestETAMonotonicAtSteadyRate(t *testing.T) {
+	const rate = 1 << 20 // bytes per second
+	const total = 120 * rate
+	start := time.Unix(1000, 0)
+	e := newETAEstimator(total, start)
+
+	if _, _, _, ok := e.estimate(start.Add(time.Second)); ok {
+		t.Error("estimate before any data arrived")
+	}
+	previous := time.Duration(math.MaxInt64)
+	for second := 1; second < 120; second++ {
+		now := start.Add(time.Duration(second) * time.Second)
+		e.add(rate, now)
+		fraction, gotRate, eta, ok := e.estimate(now)
+		if !ok {
+			t.Fatalf("second %d: no estimate", second)
+		}
+		if gotRate != rate {
+			t.Fatalf("second %d: rate %.0f, want %d", second, gotRate, rate)
+		}
+		if want := time.Duration(120-second) * time.Second; eta != want {
+			t.Fatalf("second %d: ETA %v, want %v", second, eta, want)
+		}
+		if eta >= previous {
+			t.Fatalf("second %d: ETA went from %v to %v", second, previous, eta)
+		}
+		if want := float64(second) / 120; math.Abs(fraction-want) > 1e-9 {
+			t.Fatalf("second %d: %.3f done, want %.3f", second, fraction, want)
+		}
+		previous = eta
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	if got := formatETA(2*time.Hour + 2*time.Minute + 15*time.Second + 400*time.Millisecond); got != "02:02:15" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestProgressRateOverSteps(t *testing.T) {
+	const mib = 1 << 20
+	start := time.Unix(1000, 0)
+	p := newProgressTracker(80, 80*mib, start)
+	if rate := p.Rate(start); rate != 0 {
+		t.Errorf("rate %.0f before any data", rate)
+	}
+
+	// 1 MiB/s for 40s: early on and at a steady rate, the average since the
+	// start is exact
+	for second := 1; second <= 40; second++ {
+		p.Add(mib, start.Add(time.Duration(second)*time.Second))
+	}
+	now := start.Add(40 * time.Second)
+	if rate := p.Rate(now); rate != mib {
+		t.Errorf("at 1 MiB/s got %.0f", rate)
+	}
+
+	// Then 4 MiB/s for 10s: the moving average follows the new rate, from
+	// the last sample before the window (39s, 39 MiB)
+	for second := 41; second <= 50; second++ {
+		p.Add(4*mib, start.Add(time.Duration(second)*time.Second))
+	}
+	now = start.Add(50 * time.Second)
+	if rate, want := p.Rate(now), float64(41*mib)/11; math.Abs(rate-want) > 1 {
+		t.Errorf("after speeding up got %.0f, want %.0f", rate, want)
+	}
+
+	want := "[===============>              ]  50.0%  40.0/80.0 MiB  0.00 MiB/s  (40/80 pieces)"
+	p = newProgressTracker(80, 80*mib, start)
+	for i := 0; i < 40; i++ {
+		p.Add(mib, start)
+	}
+	if got := p.Line(start); got != want {
+		t.Errorf("got line\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// socks5Dialer connects through a SOCKS5 proxy, reaching the proxy itself
+// with forward.
+type socks5Dialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("UDP is not supported through the SOCKS5 proxy")
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy dial failed: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := socks5Connect(conn, d.proxy.User, address); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect to %s failed: %v", address, err)
+	}
+	return conn, nil
+}
+
+// UseProxy routes peer and tracker connections through the
+// socks5://[user:pass@]host:port proxy at raw.
+func (c *Client) UseProxy(raw string) error {
+	proxyURL, err := parseProxyURL(raw)
+	if err != nil {
+		return err
+	}
+	c.Dialer = &socks5Dialer{proxy: proxyURL, forward: c.dialer()}
+	return nil
+}
+
+// Proxied reports whether connections go through a proxy set with UseProxy.
+// The DHT is then off limits, since its UDP traffic can't be proxied and
+// would reveal our address.
+func (c *Client) Proxied() bool {
+	_, ok := c.Dialer.(*socks5Dialer)
+	return ok
+}
+
+// parseProxyURL checks a --proxy value is a usable socks5://[user:pass@]host:port URL.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want socks5", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no port", raw)
+	}
+	return u, nil
+}
+
+// socks5Connect runs the SOCKS5 greeting, optional username/password
+// authentication (RFC 1929) and CONNECT request (RFC 1928) on conn.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{0x00} // no authentication
+	if user != nil {
+		methods = append(methods, 0x02) // username/password
+	}
+	if err := writeFull(conn, append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return fmt.Errorf("proxy requires authentication")
+		}
+		password, _ := user.Password()
+		username := user.Username()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("proxy credentials too long")
+		}
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if err := writeFull(conn, auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("proxy authentication failed")
+		}
+	default:
+		return fmt.Errorf("proxy offered no acceptable authentication method")
+	}
+
+	request := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 1)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if err := writeFull(conn, request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("proxy refused connection (reply code %d)", header[1])
+	}
+	// Skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type %d in proxy reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// socks5Server is a mock SOCKS5 proxy that relays CONNECT requests,
+// requiring username/password authentication when user is set.
+type socks5Server struct {
+	user *url.Userinfo
+	mu   sync.Mutex
+	// targets are the addresses it was asked to connect to.
+	targets []string
+}
+
+// start listens on the loopback until the test ends and returns the
+// address.
+func (s *socks5Server) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+		return
+	}
+	if s.user == nil {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !s.authenticate(conn) {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	var host string
+	switch header[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+// authenticate reads an RFC 1929 request and checks it against s.user.
+func (s *socks5Server) authenticate(conn net.Conn) bool {
+	field := func() string {
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		value := make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return false
+	}
+	username, password := field(), field()
+	want, _ := s.user.Password()
+	return username == s.user.Username() && password == want
+}
+
+func TestDownloadThroughSOCKS5Proxy(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := startSeeder(t, tor, data)
+	tor.Announce = startTracker(t, peer)
+	proxy := &socks5Server{user: url.UserPassword("alice", "s3cret")}
+	addr := proxy.start(t)
+
+	c := newTestClient(t)
+	if err := c.UseProxy("socks5://alice:s3cret@" + addr); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := c.Peers(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := c.Download(context.Background(), outputPath, tor, peers, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs from the torrent's")
+	}
+
+	tracker, _ := url.Parse(tor.Announce)
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxied := map[string]bool{}
+	for _, target := range proxy.targets {
+		proxied[target] = true
+	}
+	if !proxied[tracker.Host] || !proxied[peer] {
+		t.Errorf("proxy connected to %q, want the tracker %s and the peer %s", proxy.targets, tracker.Host, peer)
+	}
+}
+
+func TestSOCKS5ProxyWrongPassword(t *testing.T) {
+	proxy := &socks5Server{user: url.UserPassword("alice", "s3cret")}
+	addr := proxy.start(t)
+	c := newTestClient(t)
+	if err := c.UseProxy("socks5://alice:wrong@" + addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DialPeer("tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("dialed through the proxy with the wrong password")
+	}
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if len(proxy.targets) != 0 {
+		t.Errorf("proxy connected to %q without authenticating", proxy.targets)
+	}
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// idleLimiterTimeout is how long a peer's limiter goes unused before it is
+// dropped. By then its bucket is full again, so a new one behaves the same.
+const idleLimiterTimeout = time.Minute
+
+// limiterSet holds a client's rate limiters, kept across sessions since a
+// session lasts only one piece. They are rebuilt if the rates change, and
+// the per-peer ones are dropped once idle.
+type limiterSet struct {
+	sync.Mutex
+	rate     int
+	shared   *rateLimiter
+	peerRate int
+	peers    map[string]*rateLimiter
+}
+
+// downloadLimiters returns the limiters a session with peer must respect:
+// the shared one, then the peer's own, for the rates that are set.
+func (c *Client) downloadLimiters(peer string) (list []*rateLimiter) {
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+	if c.MaxDownloadRate > 0 {
+		if c.limiters.shared == nil || c.limiters.rate != c.MaxDownloadRate {
+			c.limiters.rate = c.MaxDownloadRate
+			c.limiters.shared = newRateLimiter(c.MaxDownloadRate)
+		}
+		list = append(list, c.limiters.shared)
+	}
+	if c.MaxPeerDownloadRate > 0 {
+		if c.limiters.peers == nil || c.limiters.peerRate != c.MaxPeerDownloadRate {
+			c.limiters.peerRate = c.MaxPeerDownloadRate
+			c.limiters.peers = make(map[string]*rateLimiter)
+		}
+		now := time.Now()
+		for p, l := range c.limiters.peers {
+			if l.idle(now) > idleLimiterTimeout {
+				delete(c.limiters.peers, p)
+			}
+		}
+		l, ok := c.limiters.peers[peer]
+		if !ok {
+			l = newRateLimiter(c.MaxPeerDownloadRate)
+			c.limiters.peers[peer] = l
+		}
+		list = append(list, l)
+	}
+	return list
+}
+
+// rateLimiter is a token bucket refilled at rate bytes per second, holding
+// at most a second's worth. Taking more than the bucket holds runs it into
+// debt, which later callers wait out, so a block larger than the rate is
+// still let through, just not faster than the rate on average.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens, sleeping until the bucket is out of debt or ctx is
+// done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idle returns how long it has been since tokens were last taken.
+func (l *rateLimiter) idle(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return now.Sub(l.last)
+}
+
+// throttle waits until every limiter of the session allows reading n more
+// bytes of piece data.
+func (s *PeerSession) throttle(n int) error {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for _, l := range s.limiters {
+		if err := l.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
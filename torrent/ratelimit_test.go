@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxDownloadRate(t *testing.T) {
+	tor, data := testTorrent(t, 4*32*1024, 32*1024)
+	peer := startSeeder(t, tor, data)
+	c := newTestClient(t)
+	c.MaxDownloadRate = 64 * 1024
+
+	outputPath := filepath.Join(t.TempDir(), "out")
+	start := time.Now()
+	if err := c.Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs")
+	}
+	// The bucket starts with a second's worth, so 128 KiB at 64 KiB/s takes
+	// at least a second
+	if elapsed < 900*time.Millisecond {
+		t.Errorf("downloaded %d bytes in %v at a %d bytes/s cap", len(data), elapsed, c.MaxDownloadRate)
+	}
+}
+
+func TestMaxPeerDownloadRate(t *testing.T) {
+	tor, data := testTorrent(t, 2*32*1024, 32*1024)
+	peer := startSeeder(t, tor, data)
+	c := newTestClient(t)
+	c.MaxPeerDownloadRate = 32 * 1024
+
+	start := time.Now()
+	if err := c.Download(context.Background(), filepath.Join(t.TempDir(), "out"), tor, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("downloaded %d bytes from one peer in %v at a %d bytes/s cap", len(data), elapsed, c.MaxPeerDownloadRate)
+	}
+}
+
+func TestRateLimiterAverage(t *testing.T) {
+	l := newRateLimiter(100000)
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		l.wait(context.Background(), 16*1024)
+	}
+	// 491520 bytes at 100000 bytes/s, less the initial 100000 burst
+	if elapsed := time.Since(start); elapsed < 3700*time.Millisecond || elapsed > 4500*time.Millisecond {
+		t.Errorf("took %v, want about 3.9s", elapsed)
+	}
+}
+
+func TestPeerLimitersKeyedByDialedAddress(t *testing.T) {
+	c := newTestClient(t)
+	c.MaxPeerDownloadRate = 1000
+	a := c.downloadLimiters("10.0.0.1:6881")
+	b := c.downloadLimiters("10.0.0.2:6881")
+	again := c.downloadLimiters("10.0.0.1:6881")
+	if a[0] == b[0] {
+		t.Error("two peers share a limiter")
+	}
+	if a[0] != again[0] {
+		t.Error("a peer got a new limiter while the old one was in use")
+	}
+}
+
+func TestIdlePeerLimitersEvicted(t *testing.T) {
+	c := newTestClient(t)
+	c.MaxPeerDownloadRate = 1000
+	idle := c.downloadLimiters("10.0.0.1:6881")[0]
+	idle.last = time.Now().Add(-2 * idleLimiterTimeout)
+	c.downloadLimiters("10.0.0.2:6881")
+	if _, ok := c.limiters.peers["10.0.0.1:6881"]; ok {
+		t.Error("idle limiter kept")
+	}
+	if len(c.limiters.peers) != 1 {
+		t.Errorf("%d limiters kept, want 1", len(c.limiters.peers))
+	}
+}
@@ -0,0 +1,216 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ResumeState records which pieces of a .part file are finished, and for
+// which torrent.
+type ResumeState struct {
+	InfoHash string   `json:"info_hash"`
+	Pieces   Bitfield `json:"pieces"`
+}
+
+func partPath(outputPath string) string {
+	return outputPath + ".part"
+}
+
+func resumeStatePath(outputPath string) string {
+	return partPath(outputPath) + ".resume"
+}
+
+// loadResumeState reads the resume state at path, or starts an empty one if
+// there is none. It refuses a state written for a different torrent, since
+// continuing would mix two torrents' data in the .part file.
+func loadResumeState(path string, torrent Torrent) (*ResumeState, error) {
+	infoHash := hex.EncodeToString(torrent.Info.InfoHash)
+	pieceCnt := torrent.PieceCount()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &ResumeState{InfoHash: infoHash, Pieces: NewBitfield(pieceCnt)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state ResumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("bad resume state %s: %v", path, err)
+	}
+	if state.InfoHash != infoHash {
+		return nil, fmt.Errorf("resume state %s belongs to a different torrent (info hash %s, expected %s); delete the stale .part file and its resume state to start over",
+			path, state.InfoHash, infoHash)
+	}
+	if len(state.Pieces) != len(NewBitfield(pieceCnt)) {
+		return nil, fmt.Errorf("bad resume state %s: wrong piece count", path)
+	}
+	return &state, nil
+}
+
+// reverifyResumeState hashes the pieces state claims are already in the
+// .part file at path and clears any that no longer verify, so a file damaged
+// or truncated since the last run is repaired rather than trusted.
+func (c *Client) reverifyResumeState(torrent Torrent, path string, state *ResumeState, workers int) error {
+	present, err := CheckPieces(torrent, path, workers)
+	if os.IsNotExist(err) {
+		present = make([]bool, torrent.PieceCount())
+	} else if err != nil {
+		return err
+	}
+
+	dropped := 0
+	for index, ok := range present {
+		if state.Pieces.HasPiece(index) && !ok {
+			state.Pieces.ClearPiece(index)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		c.logf("%d resumed pieces failed verification and will be downloaded again\n", dropped)
+	}
+	return nil
+}
+
+// saveResumeState writes state to a temporary file and renames it over path,
+// so a crash mid-write never leaves a torn state file.
+func saveResumeState(path string, state *ResumeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Defaults for how often a resumable download flushes its state: after this
+// many newly completed pieces or this long since the last flush, whichever
+// comes first.
+const (
+	DefaultResumeFlushPieces   = 16
+	DefaultResumeFlushInterval = 30 * time.Second
+)
+
+// finishResume moves a completed .part file to outputPath and drops its
+// resume state.
+func finishResume(outputPath string) error {
+	if err := os.Rename(partPath(outputPath), outputPath); err != nil {
+		return err
+	}
+	return os.Remove(resumeStatePath(outputPath))
+}
+
+// moveFile renames src to dst, falling back to copying and removing src when
+// they are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// FinalizePart checks that every piece of the .part file at partFile verifies
+// and renames it to its final name: partFile without the .part suffix, or the
+// torrent's name beside it. It returns the final path. An existing file at
+// the final path is never overwritten, and nothing is changed when pieces
+// are missing. Only single-file torrents are downloaded to .part files, so
+// multi-file torrents are refused.
+func FinalizePart(torrent Torrent, partFile string) (string, error) {
+	if len(torrent.Info.Files) > 0 {
+		return "", fmt.Errorf("%s is a multi-file torrent, which isn't downloaded to a .part file", torrent.Info.Name)
+	}
+	// A resume state for another torrent means partFile holds other data
+	statePath := partFile + ".resume"
+	if _, err := loadResumeState(statePath, torrent); err != nil {
+		return "", err
+	}
+
+	// The data may have come from elsewhere, so hash every piece rather than
+	// trusting the resume state alone
+	present, err := CheckPieces(torrent, partFile, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return "", err
+	}
+	var missing []int
+	for index, ok := range present {
+		if !ok {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s is incomplete: %d of %d pieces missing or corrupt %v", partFile, len(missing), len(present), missing)
+	}
+
+	finalPath := strings.TrimSuffix(partFile, ".part")
+	if finalPath == partFile {
+		if !ValidPathComponent(torrent.Info.Name) {
+			return "", fmt.Errorf("torrent name %q is not a usable file name", torrent.Info.Name)
+		}
+		finalPath = filepath.Join(filepath.Dir(partFile), torrent.Info.Name)
+	}
+	if err := renameNoClobber(partFile, finalPath); err != nil {
+		return "", err
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return finalPath, nil
+}
+
+// renameNoClobber renames src to dst unless dst already exists. Linking
+// fails atomically on an existing dst; where hard links aren't supported it
+// falls back to checking first and renaming.
+func renameNoClobber(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists; not overwriting it with %s", dst, src)
+	}
+	err := os.Link(src, dst)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists; not overwriting it with %s", dst, src)
+	}
+	if err != nil {
+		return os.Rename(src, dst)
+	}
+	return os.Remove(src)
+}
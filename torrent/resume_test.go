@@ -0,0 +1,191 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeRefusesOtherTorrent(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peer := startSeeder(t, tor, data)
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	stale := bytes.Repeat([]byte{0xee}, 1000)
+	if err := os.WriteFile(partPath(outputPath), stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := &ResumeState{InfoHash: strings.Repeat("ab", 20), Pieces: NewBitfield(tor.PieceCount())}
+	if err := saveResumeState(resumeStatePath(outputPath), other); err != nil {
+		t.Fatal(err)
+	}
+
+	err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{peer}, DownloadOptions{Network: "tcp", Resume: true})
+	if err == nil || !strings.Contains(err.Error(), "belongs to a different torrent") {
+		t.Fatalf("got %v, want a refusal naming the other torrent", err)
+	}
+	if got, _ := os.ReadFile(partPath(outputPath)); !bytes.Equal(got, stale) {
+		t.Error("the stale .part file was modified")
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("output created despite the refusal")
+	}
+}
+
+func TestFinalizePart(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	dir := t.TempDir()
+
+	// Complete data obtained out of band, with no resume state
+	complete := filepath.Join(dir, "complete.bin.part")
+	if err := os.WriteFile(complete, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	finalPath, err := FinalizePart(tor, complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finalPath != filepath.Join(dir, "complete.bin") {
+		t.Errorf("finalized to %s", finalPath)
+	}
+	if got, _ := os.ReadFile(finalPath); !bytes.Equal(got, data) {
+		t.Error("finalized file differs from the part file")
+	}
+
+	incomplete := filepath.Join(dir, "incomplete.bin.part")
+	partial := bytes.Clone(data)
+	clear(partial[32*1024 : 64*1024])
+	if err := os.WriteFile(incomplete, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FinalizePart(tor, incomplete); err == nil || !strings.Contains(err.Error(), "1 of 4 pieces missing or corrupt [1]") {
+		t.Fatalf("got %v, want piece 1 reported missing", err)
+	}
+	if _, err := os.Stat(incomplete); err != nil {
+		t.Error("incomplete part file was moved")
+	}
+	if _, err := os.Stat(incomplete + ".resume"); !os.IsNotExist(err) {
+		t.Error("a failed finalize wrote a resume state")
+	}
+
+	// An existing file at the final name is left alone
+	existing := filepath.Join(dir, "existing.bin")
+	if err := os.WriteFile(existing, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing+".part", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FinalizePart(tor, existing+".part"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("got %v, want a refusal to overwrite", err)
+	}
+	if got, _ := os.ReadFile(existing); string(got) != "keep me" {
+		t.Error("the existing file was overwritten")
+	}
+	if _, err := os.Stat(existing + ".part"); err != nil {
+		t.Error("part file was moved despite the refusal")
+	}
+
+	multi := tor
+	multi.Info.Files = []FileEntry{{Path: []string{"a"}, Length: 100000}}
+	if _, err := FinalizePart(multi, filepath.Join(dir, "multi.part")); err == nil || !strings.Contains(err.Error(), "multi-file") {
+		t.Errorf("got %v, want multi-file torrents refused", err)
+	}
+}
+
+func TestResumeStateFlushedMidDownload(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	release := make(chan struct{})
+	held := (&testSeeder{torrent: tor, data: data, held: map[int]chan struct{}{3: release}}).start(t)
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", Resume: true, ResumeFlushPieces: 1}
+	done := make(chan error, 1)
+	go func() {
+		done <- newTestClient(t).Download(context.Background(), outputPath, tor, []string{held}, opts)
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	// Take the files as a crash would leave them once the first three
+	// pieces have been flushed: "4A==" is the bitfield 0xe0
+	crashed := filepath.Join(t.TempDir(), "out.bin")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := os.ReadFile(resumeStatePath(outputPath))
+		part, _ := os.ReadFile(partPath(outputPath))
+		if err == nil && strings.Contains(string(state), `"pieces":"4A=="`) {
+			os.WriteFile(resumeStatePath(crashed), state, 0644)
+			os.WriteFile(partPath(crashed), part, 0644)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first pieces were never flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	state, err := loadResumeState(resumeStatePath(crashed), tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	present, err := CheckPieces(tor, partPath(crashed), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, ok := range present {
+		if state.Pieces.HasPiece(index) && !ok {
+			t.Errorf("flushed state claims piece %d, which isn't in the .part file", index)
+		}
+	}
+
+	if err := newTestClient(t).Download(context.Background(), crashed, tor, []string{startSeeder(t, tor, data)}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(crashed); !bytes.Equal(got, data) {
+		t.Fatal("resumed download differs from the torrent's data")
+	}
+}
+
+func TestResumeFetchesOnlyMissingPieces(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	release := make(chan struct{})
+	defer close(release)
+	held := (&testSeeder{torrent: tor, data: data, held: map[int]chan struct{}{3: release}}).start(t)
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", Resume: true, ResumeFlushPieces: 1}
+
+	// Kill the first run once pieces 0-2 are saved and piece 3 is stuck
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- newTestClient(t).Download(ctx, outputPath, tor, []string{held}, opts) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, _ := os.ReadFile(resumeStatePath(outputPath))
+		if strings.Contains(string(state), `"pieces":"4A=="`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first pieces were never saved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("cancelled download succeeded")
+	}
+
+	// This peer only has piece 3, so the second run must take the rest from
+	// the .part file
+	onlyLast := (&testSeeder{torrent: tor, data: data, missing: map[int]bool{0: true, 1: true, 2: true}}).start(t)
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, []string{onlyLast}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Fatal("resumed download differs from the torrent's data")
+	}
+}
@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Piece selection strategies for Download.
+const (
+	StrategySequential  = "sequential"
+	StrategyRarestFirst = "rarest-first"
+)
+
+// PieceScheduler hands out the pieces still to be downloaded, one per call to
+// Next. It tracks which pieces each peer has, from their bitfields and have
+// messages, so that with the rarest-first strategy the piece held by the
+// fewest known peers goes first. It is safe for concurrent use.
+type PieceScheduler struct {
+	mu           sync.Mutex
+	rarestFirst  bool
+	pending      Bitfield
+	pieceCnt     int
+	peerHave     map[string]Bitfield
+	availability []int
+}
+
+// newPieceScheduler returns a scheduler for the pieces set in pending.
+func newPieceScheduler(pending Bitfield, pieceCnt int, strategy string) *PieceScheduler {
+	return &PieceScheduler{
+		rarestFirst:  strategy == StrategyRarestFirst,
+		pending:      pending,
+		pieceCnt:     pieceCnt,
+		peerHave:     make(map[string]Bitfield),
+		availability: make([]int, pieceCnt),
+	}
+}
+
+// UpdatePeer records have as everything peer is known to have, replacing
+// what it told us before.
+func (s *PieceScheduler) UpdatePeer(peer string, have Bitfield) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.peerHave[peer]
+	for index := 0; index < s.pieceCnt; index++ {
+		if old.HasPiece(index) {
+			s.availability[index]--
+		}
+		if have.HasPiece(index) {
+			s.availability[index]++
+		}
+	}
+	s.peerHave[peer] = slices.Clone(have)
+}
+
+// Next removes and returns the next piece to download, or false once every
+// piece has been handed out. Sequential order takes the lowest index;
+// rarest-first takes the piece the fewest peers have, lowest index first on
+// ties, leaving pieces no known peer has until last.
+func (s *PieceScheduler) Next() (index int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	best := -1
+	for i := 0; i < s.pieceCnt; i++ {
+		if !s.pending.HasPiece(i) {
+			continue
+		}
+		if !s.rarestFirst {
+			best = i
+			break
+		}
+		if best == -1 || s.rarer(i, best) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	s.pending.ClearPiece(best)
+	return best, true
+}
+
+// rarer reports whether piece a should go before piece b under rarest-first.
+func (s *PieceScheduler) rarer(a, b int) bool {
+	availA, availB := s.availability[a], s.availability[b]
+	if availA == 0 || availB == 0 {
+		return availB == 0 && availA > 0
+	}
+	return availA < availB
+}
+
+// endgameRacers is how many attempts, each starting with a different peer,
+// may race for one piece at the end of a download.
+const endgameRacers = 3
+
+// defaultConcurrency is the fixed number of pieces downloaded at once when the
+// adaptive controller is off.
+const defaultConcurrency = 5
+
+// maxAdaptiveConcurrency caps how far the adaptive controller may grow.
+const maxAdaptiveConcurrency = 32
+
+// concurrencyController bounds how many pieces are downloaded at once. When
+// adaptive, it raises the limit by one while aggregate throughput keeps
+// improving and halves it when throughput drops or too many pieces fail
+// (AIMD). Otherwise it behaves like a plain semaphore.
+type concurrencyController struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	maxLimit int
+	active   int
+	adaptive bool
+	clock    clock
+
+	windowStart time.Time
+	windowBytes int
+	windowDone  int
+	windowFails int
+	lastRate    float64
+}
+
+func newConcurrencyController(limit, maxLimit int, adaptive bool) *concurrencyController {
+	c := &concurrencyController{
+		limit:       limit,
+		maxLimit:    maxLimit,
+		adaptive:    adaptive,
+		clock:       realClock{},
+		windowStart: time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire blocks until a transfer slot is free.
+func (c *concurrencyController) acquire() {
+	c.mu.Lock()
+	for c.active >= c.limit {
+		c.cond.Wait()
+	}
+	c.active++
+	c.mu.Unlock()
+}
+
+// release frees a transfer slot and feeds the outcome of the transfer to the
+// controller.
+func (c *concurrencyController) release(bytes int, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	c.active--
+	if !c.adaptive {
+		return
+	}
+
+	c.windowDone++
+	c.windowBytes += bytes
+	if failed {
+		c.windowFails++
+	}
+	// Judge the limit once a full window's worth of transfers has finished.
+	if c.windowDone < c.limit {
+		return
+	}
+
+	elapsed := c.clock.Now().Sub(c.windowStart).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(c.windowBytes) / elapsed
+	}
+
+	switch {
+	case c.windowFails*4 > c.windowDone, rate < c.lastRate*0.95:
+		c.limit = max(1, c.limit/2)
+	case rate > c.lastRate*1.05 && c.limit < c.maxLimit:
+		c.limit++
+	}
+
+	c.lastRate = rate
+	c.windowStart = c.clock.Now()
+	c.windowBytes = 0
+	c.windowDone = 0
+	c.windowFails = 0
+}
+
+// currentLimit returns the number of transfers currently allowed at once.
+func (c *concurrencyController) currentLimit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// simulateTransfers runs n transfers through controller on a fake clock. A
+// transfer started while active others run takes duration(active+1).
+func simulateTransfers(controller *concurrencyController, n int, size int, duration func(concurrent int) time.Duration) (limits []int) {
+	clock := newFakeClock()
+	controller.clock = clock
+	controller.windowStart = clock.Now()
+	var ends []time.Time
+	for started := 0; started < n || len(ends) > 0; {
+		for started < n && len(ends) < controller.currentLimit() {
+			controller.acquire()
+			ends = append(ends, clock.Now().Add(duration(len(ends)+1)))
+			slices.SortFunc(ends, func(a, b time.Time) int { return a.Compare(b) })
+			started++
+			limits = append(limits, controller.currentLimit())
+		}
+		clock.advance(ends[0].Sub(clock.Now()))
+		ends = ends[1:]
+		controller.release(size, false)
+	}
+	return limits
+}
+
+func TestAdaptiveConcurrencyConverges(t *testing.T) {
+	// Peers contend for a shared link: a transfer takes 10ms alone and
+	// longer once more than optimum run at once, so throughput peaks at
+	// optimum concurrent transfers
+	const optimum = 6
+	duration := func(concurrent int) time.Duration {
+		slowdown := max(1, float64(concurrent*concurrent)/(optimum*optimum))
+		return time.Duration(float64(10*time.Millisecond) * slowdown)
+	}
+	controller := newConcurrencyController(2, maxAdaptiveConcurrency, true)
+	limits := simulateTransfers(controller, 2000, 16*1024, duration)
+
+	// AIMD keeps probing around the best limit, so judge its average over
+	// the second half of the run
+	settled := limits[len(limits)/2:]
+	sum := 0
+	for _, limit := range settled {
+		sum += limit
+	}
+	if average := float64(sum) / float64(len(settled)); average < optimum/2 || average > optimum*2 {
+		t.Errorf("settled at %.1f concurrent transfers on average, want near %d", average, optimum)
+
+	}
+}
+
+func TestAdaptiveConcurrencyBacksOffOnFailures(t *testing.T) {
+	controller := newConcurrencyController(8, maxAdaptiveConcurrency, true)
+	for i := 0; i < 8; i++ {
+		controller.acquire()
+	}
+	for i := 0; i < 8; i++ {
+		controller.release(0, i%2 == 0)
+	}
+	if limit := controller.currentLimit(); limit != 4 {
+		t.Errorf("limit after half the transfers failed: got %d, want 4", limit)
+	}
+}
+
+func TestFixedConcurrency(t *testing.T) {
+	controller := newConcurrencyController(2, 2, false)
+	controller.acquire()
+	controller.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		controller.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a third slot of two")
+	case <-time.After(20 * time.Millisecond):
+	}
+	controller.release(0, false)
+	<-acquired
+}
+
+// bitfieldOf returns a bitfield of pieceCnt pieces with pieces set.
+func bitfieldOf(pieceCnt int, pieces ...int) Bitfield {
+	b := NewBitfield(pieceCnt)
+	for _, index := range pieces {
+		b.SetPiece(index)
+	}
+	return b
+}
+
+// drain returns every piece s hands out, in order.
+func drain(s *PieceScheduler) []int {
+	var order []int
+	for {
+		index, ok := s.Next()
+		if !ok {
+			return order
+		}
+		order = append(order, index)
+	}
+}
+
+func TestRarestFirstOrder(t *testing.T) {
+	s := newPieceScheduler(bitfieldOf(5, 0, 1, 2, 3, 4), 5, StrategyRarestFirst)
+	s.UpdatePeer("a", bitfieldOf(5, 0, 1, 2, 4))
+	s.UpdatePeer("b", bitfieldOf(5, 0, 2, 4))
+	s.UpdatePeer("c", bitfieldOf(5, 0, 4))
+	// A have message moves piece 1 from one peer to two
+	s.UpdatePeer("c", bitfieldOf(5, 0, 1, 4))
+
+	// Availability is 0:3 1:2 2:2 3:0 4:3; ties go to the lower index and
+	// the piece nobody has goes last
+	if got, want := drain(s), []int{1, 2, 0, 4, 3}; !slices.Equal(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
+
+func TestSequentialOrderSkipsDonePieces(t *testing.T) {
+	s := newPieceScheduler(bitfieldOf(5, 0, 2, 3), 5, StrategySequential)
+	s.UpdatePeer("a", bitfieldOf(5, 3))
+	if got, want := drain(s), []int{0, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
+
+func TestPieceSchedulerConcurrentNext(t *testing.T) {
+	const pieceCnt = 1000
+	pending := NewBitfield(pieceCnt)
+	for i := 0; i < pieceCnt; i++ {
+		pending.SetPiece(i)
+	}
+	s := newPieceScheduler(pending, pieceCnt, StrategyRarestFirst)
+	results := make(chan []int)
+	for w := 0; w < 4; w++ {
+		go func() { results <- drain(s) }()
+	}
+	seen := make(map[int]bool)
+	for w := 0; w < 4; w++ {
+		for _, index := range <-results {
+			if seen[index] {
+				t.Fatalf("piece %d handed out twice", index)
+			}
+			seen[index] = true
+		}
+	}
+	if len(seen) != pieceCnt {
+		t.Errorf("handed out %d of %d pieces", len(seen), pieceCnt)
+	}
+}
@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Ports tried, in order, when the chosen listen port is taken.
+const (
+	firstFallbackPort = 6881
+	lastFallbackPort  = 6889
+)
+
+// Listen opens the TCP port peers connect to: ListenPort, or else the first
+// free port in firstFallbackPort-lastFallbackPort. ListenPort is updated to
+// the port actually bound so trackers are told the right one.
+func (c *Client) Listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", c.ListenPort))
+	if err == nil {
+		return ln, nil
+	}
+	for port := firstFallbackPort; port <= lastFallbackPort; port++ {
+		if port == c.ListenPort {
+			continue
+		}
+		if fallback, fallbackErr := net.Listen("tcp", fmt.Sprintf(":%d", port)); fallbackErr == nil {
+			c.logf("Port %d unavailable (%v), listening on %d instead\n", c.ListenPort, err, port)
+			c.ListenPort = port
+			return fallback, nil
+		}
+	}
+	return nil, fmt.Errorf("no free listen port: %v", err)
+}
+
+// maxServedBlock is the largest block we serve in one piece message; bigger
+// requests are refused.
+const maxServedBlock = 128 * 1024
+
+// seedIdleTimeout is how long an inbound peer may stay silent before we drop
+// it.
+const seedIdleTimeout = 3 * time.Minute
+
+// Seed serves the complete file at path to inbound peers on ln until ln
+// is closed.
+func (c *Client) Seed(ln net.Listener, torrent Torrent, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			c.logf("Accept failed: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func() {
+			if err := c.servePeer(conn, torrent, file); err != nil && err != io.EOF {
+				c.logf("Peer %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// servePeer seeds to one inbound peer: it answers the handshake, announces
+// every piece, unchokes the peer once it is interested and serves its
+// requests from file.
+func (c *Client) servePeer(conn net.Conn, torrent Torrent, file io.ReaderAt) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(seedIdleTimeout))
+
+	received := make([]byte, 68)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return err
+	}
+	if err := validateHandshake(received, torrent.Info.InfoHash); err != nil {
+		return err
+	}
+	if err := writeFull(conn, c.buildHandshake(torrent, make([]byte, 8))); err != nil {
+		return err
+	}
+
+	pieceCnt := torrent.PieceCount()
+	have := NewBitfield(pieceCnt)
+	for i := 0; i < pieceCnt; i++ {
+		have.SetPiece(i)
+	}
+	message := make([]byte, 5, 5+len(have))
+	binary.BigEndian.PutUint32(message[0:4], uint32(1+len(have)))
+	message[4] = 5 // bitfield
+	if err := writeFull(conn, append(message, have...)); err != nil {
+		return err
+	}
+
+	unchoked := false
+	for {
+		conn.SetDeadline(time.Now().Add(seedIdleTimeout))
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case 2: // interested
+			if !unchoked {
+				if err := writeFull(conn, []byte{0, 0, 0, 1, 1}); err != nil {
+					return err
+				}
+				unchoked = true
+			}
+		case 6: // request
+			if len(payload) != 12 || !unchoked {
+				continue
+			}
+			index := int(binary.BigEndian.Uint32(payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(payload[4:8]))
+			length := int(binary.BigEndian.Uint32(payload[8:12]))
+			if index >= pieceCnt || length == 0 || length > maxServedBlock || begin+length > torrent.PieceSize(index) {
+				return fmt.Errorf("invalid request for piece %d begin %d length %d", index, begin, length)
+			}
+			piece := make([]byte, 13+length)
+			binary.BigEndian.PutUint32(piece[0:4], uint32(9+length))
+			piece[4] = 7 // piece
+			copy(piece[5:13], payload[0:8])
+			offset := int64(index)*int64(torrent.Info.PieceLength) + int64(begin)
+			if _, err := file.ReadAt(piece[13:], offset); err != nil {
+				return err
+			}
+			if err := writeFull(conn, piece); err != nil {
+				return err
+			}
+		}
+	}
+}
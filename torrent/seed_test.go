@@ -0,0 +1,48 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestListenFallsBackFromOccupiedPort(t *testing.T) {
+	busy, err := net.Listen("tcp", fmt.Sprintf(":%d", firstFallbackPort))
+	if err != nil {
+		t.Skipf("port %d unavailable: %v", firstFallbackPort, err)
+	}
+	defer busy.Close()
+
+	c := newTestClient(t)
+	c.ListenPort = firstFallbackPort
+	ln, err := c.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if c.ListenPort <= firstFallbackPort || c.ListenPort > lastFallbackPort {
+		t.Fatalf("listening on %d, want a fallback port after %d", c.ListenPort, firstFallbackPort)
+	}
+	if got := ln.Addr().(*net.TCPAddr).Port; got != c.ListenPort {
+		t.Errorf("ListenPort is %d but bound %d", c.ListenPort, got)
+	}
+
+	// The tracker is told the port actually bound
+	ports := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ports <- r.URL.Query().Get("port")
+		w.Write([]byte("d5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL + "/announce"
+	if _, err := c.Peers(tor); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ports; got != strconv.Itoa(c.ListenPort) {
+		t.Errorf("announced port %s, want %d", got, c.ListenPort)
+	}
+}
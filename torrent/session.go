@@ -0,0 +1,390 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+type RequestMessage struct {
+	lengthPrefix uint32
+	id           uint8
+	index        uint32
+	begin        uint32
+	length       uint32
+}
+
+// maxUnrequestedBlocks is how many piece messages for blocks we never asked
+// for a peer may send before we give up on it.
+const maxUnrequestedBlocks = 8
+
+// defaultPipelineDepth is how many block requests a PeerSession keeps
+// outstanding unless told otherwise.
+const defaultPipelineDepth = 5
+
+// PeerSession downloads pieces over a peer connection that is already
+// handshaked and unchoked. It keeps up to pipelineDepth block requests
+// outstanding, so throughput isn't capped by the round-trip time, and
+// matches the replies to requests by their offset, in whatever order they
+// arrive.
+type PeerSession struct {
+	conn net.Conn
+	// have is what the peer announced so far, if anything; have messages
+	// received during the session are recorded in it.
+	have          Bitfield
+	pipelineDepth int
+	// ctx, if set, is the context the connection is bound to. When a piece
+	// download fails because ctx is done, the outstanding requests are
+	// cancelled so the peer stops sending blocks nobody will read.
+	ctx context.Context
+	// limiters throttle reading block payloads: the limiter shared by every
+	// session, then the one for this peer, when the rates are set.
+	limiters []*rateLimiter
+	// extensions, if set, records the peer's extension handshake should it
+	// arrive during the session.
+	extensions *peerExtensions
+	// discovered, if set, is passed the peers the peer tells us it connected
+	// to and dropped with ut_pex.
+	discovered func(added, dropped []string)
+	// client, if set, is where the session logs.
+	client *Client
+	// fast is whether the fast extension was negotiated on the connection.
+	// A choke then doesn't drop our requests; the peer rejects the ones it
+	// won't serve instead.
+	fast bool
+}
+
+// NewPeerSession returns an unthrottled session over conn that logs nothing.
+func NewPeerSession(conn net.Conn, have Bitfield) *PeerSession {
+	return &PeerSession{
+		conn:          conn,
+		have:          have,
+		pipelineDepth: defaultPipelineDepth,
+	}
+}
+
+// newPeerSession returns a session over conn, dialed to peer, throttled by
+// c's rate limits. The limits are kept by the dialed address rather than
+// conn's remote address, which a proxy would make the same for every peer.
+func (c *Client) newPeerSession(conn net.Conn, peer string, have Bitfield) *PeerSession {
+	s := NewPeerSession(conn, have)
+	s.limiters = c.downloadLimiters(peer)
+	s.client = c
+	return s
+}
+
+// cancelWriteTimeout bounds sending cancel messages to a peer we are
+// abandoning.
+const cancelWriteTimeout = 2 * time.Second
+
+// request sends a request message for one block.
+func (s *PeerSession) request(index, begin, length int) error {
+	return s.sendBlockMessage(6, index, begin, length)
+}
+
+// Cancel sends a cancel message withdrawing an earlier request for a block.
+func (s *PeerSession) Cancel(index, begin, length int) error {
+	return s.sendBlockMessage(8, index, begin, length)
+}
+
+// sendBlockMessage sends a request or cancel message, which share a layout.
+func (s *PeerSession) sendBlockMessage(id uint8, index, begin, length int) error {
+	message := RequestMessage{
+		lengthPrefix: 13,
+		id:           id,
+		index:        uint32(index),
+		begin:        uint32(begin),
+		length:       uint32(length),
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, message)
+	return writeFull(s.conn, buf.Bytes())
+}
+
+// cancelOutstanding cancels every request in outstanding, a map from begin
+// offset to length, if the session's context is done.
+func (s *PeerSession) cancelOutstanding(index int, outstanding map[int]int) {
+	if s.ctx == nil || s.ctx.Err() == nil || len(outstanding) == 0 {
+		return
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(cancelWriteTimeout))
+	for begin, length := range outstanding {
+		if err := s.Cancel(index, begin, length); err != nil {
+			return
+		}
+	}
+}
+
+// unchokeTimeout is how long a peer that chokes us mid-piece has to unchoke
+// us again before we give up on it.
+var unchokeTimeout = time.Minute
+
+// errUnchokeTimeout is returned when a peer choked us mid-piece and didn't
+// unchoke us within unchokeTimeout.
+var errUnchokeTimeout = fmt.Errorf("peer choked us and didn't unchoke in time")
+
+// maxRejectedBlocks is how many reject_request messages for a piece a peer
+// may send before we give up on it and let another peer have the piece.
+const maxRejectedBlocks = 8
+
+// errBlocksRejected is returned when a peer keeps rejecting our requests.
+var errBlocksRejected = fmt.Errorf("peer rejected too many requests")
+
+// pieceRequests tracks the block requests of the piece being downloaded.
+type pieceRequests struct {
+	index int
+	// outstanding holds the requests awaiting a block, by begin offset, with
+	// the requested length.
+	outstanding map[int]int
+	// rejected holds the begin offsets of rejected blocks, to request again.
+	rejected []int
+	rejects  int
+	// data is the piece, filled in as blocks arrive; received counts the
+	// bytes in it so far.
+	data     []byte
+	received int
+	// unrequested counts the blocks the peer sent that we didn't ask for.
+	unrequested int
+}
+
+// deliver handles the payload of a piece message that was read whole,
+// storing the block if it is one we are waiting for.
+func (r *pieceRequests) deliver(payload []byte) error {
+	if len(payload) < 8 {
+		return fmt.Errorf("short piece message for piece %d", r.index)
+	}
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	block := payload[8:]
+	if requested, ok := r.outstanding[begin]; ok && index == r.index && len(block) == requested {
+		copy(r.data[begin:], block)
+		delete(r.outstanding, begin)
+		r.received += len(block)
+		return nil
+	}
+	return r.discard()
+}
+
+// discard counts a block we didn't request, failing once the peer has sent
+// more than maxUnrequestedBlocks of them.
+func (r *pieceRequests) discard() error {
+	r.unrequested++
+	if r.unrequested > maxUnrequestedBlocks {
+		return fmt.Errorf("peer sent too many unrequested blocks")
+	}
+	return nil
+}
+
+// reject handles the payload of a reject_request message, queueing the
+// block to be requested again if it is one we are waiting for.
+func (r *pieceRequests) reject(payload []byte) error {
+	if len(payload) != 12 || int(binary.BigEndian.Uint32(payload[0:4])) != r.index {
+		return nil
+	}
+	begin := int(binary.BigEndian.Uint32(payload[4:8]))
+	length := int(binary.BigEndian.Uint32(payload[8:12]))
+	if requested, ok := r.outstanding[begin]; !ok || requested != length {
+		return nil
+	}
+	r.rejects++
+	if r.rejects > maxRejectedBlocks {
+		return errBlocksRejected
+	}
+	delete(r.outstanding, begin)
+	r.rejected = append(r.rejected, begin)
+	return nil
+}
+
+// waitUnchoke reads messages until the peer unchokes us again, for at most
+// unchokeTimeout. Blocks and rejects that arrive meanwhile are recorded in
+// requests: a peer may still deliver requests it got before choking us.
+func (s *PeerSession) waitUnchoke(requests *pieceRequests) (err error) {
+	s.conn.SetReadDeadline(time.Now().Add(unchokeTimeout))
+	defer func() {
+		s.conn.SetReadDeadline(time.Time{})
+		// Clearing the deadline may have undone the one bindContext set when
+		// ctx finished
+		if err == nil && s.ctx != nil && s.ctx.Err() != nil {
+			err = s.ctx.Err()
+		}
+	}()
+	for {
+		id, payload, err := readMessage(s.conn)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && (s.ctx == nil || s.ctx.Err() == nil) {
+				return errUnchokeTimeout
+			}
+			return err
+		}
+		switch id {
+		case 1: // unchoke
+			return nil
+		case 7: // piece
+			if err := s.throttle(max(0, len(payload)-8)); err != nil {
+				return err
+			}
+			if err := requests.deliver(payload); err != nil {
+				return err
+			}
+		case 4: // have
+			if len(payload) == 4 {
+				s.have.SetPiece(int(binary.BigEndian.Uint32(payload)))
+			}
+		case 16: // reject_request
+			if err := requests.reject(payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DownloadPiece requests every block of the piece and returns its data.
+// Keep-alives and unrelated messages are skipped, have messages update
+// s.have, and blocks we didn't request are discarded. If the peer chokes us
+// without the fast extension, it drops our outstanding requests, so they are
+// sent again once we are unchoked. Rejected blocks are requested again, up
+// to maxRejectedBlocks times per piece. Keep-alives are sent while the
+// connection is otherwise idle, such as while we wait out a choke.
+func (s *PeerSession) DownloadPiece(torrent Torrent, index int) ([]byte, error) {
+	pieceSize := torrent.PieceSize(index)
+	blockSize := 16 * 1024
+
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	defer startKeepAlive(ctx, s.conn)()
+
+	requests := &pieceRequests{index: index, outstanding: make(map[int]int), data: make([]byte, pieceSize)}
+	outstanding := requests.outstanding
+	defer s.cancelOutstanding(index, outstanding)
+	next := 0
+	header := make([]byte, 13)
+	for requests.received < pieceSize {
+		for len(outstanding) < max(1, s.pipelineDepth) && (len(requests.rejected) > 0 || next < pieceSize) {
+			begin := next
+			if len(requests.rejected) > 0 {
+				begin = requests.rejected[0]
+				requests.rejected = requests.rejected[1:]
+			}
+			length := min(blockSize, pieceSize-begin)
+			if err := s.request(index, begin, length); err != nil {
+				return nil, err
+			}
+			outstanding[begin] = length
+			if begin == next {
+				next += length
+			}
+		}
+
+		if _, err := io.ReadFull(s.conn, header[:4]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length == 0 {
+			continue // keep-alive
+		}
+		if _, err := io.ReadFull(s.conn, header[4:5]); err != nil {
+			return nil, err
+		}
+
+		if header[4] != 7 {
+			if length > maxMessageLength {
+				return nil, fmt.Errorf("peer message too long (%d bytes)", length)
+			}
+			payload := make([]byte, length-1)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return nil, err
+			}
+			switch header[4] {
+			case 0: // choke
+				s.client.logf("Choked by peer, waiting for unchoke\n")
+				if err := s.waitUnchoke(requests); err != nil {
+					return nil, err
+				}
+				if s.fast {
+					break
+				}
+				for begin, length := range outstanding {
+					if err := s.request(index, begin, length); err != nil {
+						return nil, err
+					}
+				}
+			case 4: // have
+				if len(payload) == 4 {
+					s.have.SetPiece(int(binary.BigEndian.Uint32(payload)))
+				}
+			case 16: // reject_request
+				if err := requests.reject(payload); err != nil {
+					return nil, err
+				}
+			case 20: // extended
+				if s.extensions != nil {
+					recordExtensionHandshake(s.extensions, payload)
+				}
+				s.handlePex(payload)
+			}
+			continue
+		}
+
+		if length < 9 {
+			return nil, fmt.Errorf("short piece message for piece %d", index)
+		}
+		if _, err := io.ReadFull(s.conn, header[5:]); err != nil {
+			return nil, err
+		}
+		gotIndex := int(binary.BigEndian.Uint32(header[5:9]))
+		begin := int(binary.BigEndian.Uint32(header[9:13]))
+		blockLength := int(length - 9)
+		if requested, ok := outstanding[begin]; ok && gotIndex == index && blockLength == requested {
+			if err := s.throttle(blockLength); err != nil {
+				return nil, err
+			}
+			if _, err := io.ReadFull(s.conn, requests.data[begin:begin+blockLength]); err != nil {
+				return nil, err
+			}
+			delete(outstanding, begin)
+			requests.received += blockLength
+			continue
+		}
+
+		if _, err := io.CopyN(io.Discard, s.conn, int64(blockLength)); err != nil {
+			return nil, err
+		}
+		if err := requests.discard(); err != nil {
+			return nil, err
+		}
+	}
+	return requests.data, nil
+}
+
+// maxPexAdded is how many added peers we take from one ut_pex message; BEP
+// 11 allows no more than 50.
+const maxPexAdded = 50
+
+// handlePex passes the peers added and dropped by payload, the payload of an
+// extended message, to s.discovered if it is a ut_pex message. Added seeds
+// come first. Malformed messages are ignored.
+func (s *PeerSession) handlePex(payload []byte) {
+	if s.discovered == nil || len(payload) == 0 || payload[0] != utPexID {
+		return
+	}
+	msg, err := parsePexMessage(payload[1:])
+	if err != nil {
+		s.client.verbosef("Ignoring ut_pex message: %v\n", err)
+		return
+	}
+	added := msg.seedsFirst()
+	if len(added) > maxPexAdded {
+		added = added[:maxPexAdded]
+	}
+	if len(added) > 0 || len(msg.dropped) > 0 {
+		s.discovered(added, msg.dropped)
+	}
+}
@@ -0,0 +1,425 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sendMessage writes a peer message with the given id and payload. Write
+// errors are left to show up on the reading side.
+func sendMessage(conn net.Conn, id byte, payload []byte) {
+	message := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	message = append(message, id)
+	writeFull(conn, append(message, payload...))
+}
+
+// blockPayload returns the index, begin and length fields shared by request,
+// cancel and reject_request messages.
+func blockPayload(index, begin, length int) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(begin))
+	return binary.BigEndian.AppendUint32(payload, uint32(length))
+}
+
+// sendBlock writes the piece message carrying data[begin:begin+length].
+func sendBlock(conn net.Conn, data []byte, index, begin, length int) {
+	payload := blockPayload(index, begin, length)[:8]
+	sendMessage(conn, 7, append(payload, data[begin:begin+length]...))
+}
+
+// readRequests reads the peer messages sent to conn until it is closed and
+// passes the request payloads to requests, which it then closes.
+func readRequests(conn net.Conn, requests chan<- []byte) {
+	defer close(requests)
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if id == 6 {
+			requests <- payload
+		}
+	}
+}
+
+// singlePieceTorrent returns a torrent of one two-block piece.
+func singlePieceTorrent() Torrent {
+	return Torrent{Info: Info{Length: 32 * 1024, PieceLength: 32 * 1024}}
+}
+
+func TestDownloadPieceRerequestsRejectedBlock(t *testing.T) {
+	tor := singlePieceTorrent()
+	data := bytes.Repeat([]byte{0xab, 0xcd}, tor.Info.Length/2)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		<-requests
+		<-requests
+		sendMessage(theirs, 16, blockPayload(0, 0, 16*1024))
+		sendBlock(theirs, data, 0, 16*1024, 16*1024)
+		if again := <-requests; !bytes.Equal(again, blockPayload(0, 0, 16*1024)) {
+			t.Errorf("re-request after reject: got %x", again)
+		}
+		sendBlock(theirs, data, 0, 0, 16*1024)
+	}()
+
+	s := NewPeerSession(ours, nil)
+	s.fast = true
+	got, err := s.DownloadPiece(tor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("piece data differs from what the peer sent")
+	}
+}
+
+func TestDownloadPieceInterleavedHaveAndKeepAlive(t *testing.T) {
+	tor := singlePieceTorrent()
+	data := bytes.Repeat([]byte{0x12, 0x34}, tor.Info.Length/2)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		<-requests
+		<-requests
+		sendBlock(theirs, data, 0, 0, 16*1024)
+		sendMessage(theirs, 4, binary.BigEndian.AppendUint32(nil, 5))
+		writeFull(theirs, []byte{0, 0, 0, 0}) // keep-alive
+		sendBlock(theirs, data, 0, 16*1024, 16*1024)
+	}()
+
+	have := NewBitfield(8)
+	s := NewPeerSession(ours, have)
+	got, err := s.DownloadPiece(tor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("piece data differs from what the peer sent")
+	}
+	if !have.HasPiece(5) {
+		t.Error("have message not recorded in the peer's bitfield")
+	}
+}
+
+func TestDownloadPieceOutOfOrderBlocks(t *testing.T) {
+	tor := Torrent{Info: Info{Length: 64 * 1024, PieceLength: 64 * 1024}}
+	data := make([]byte, tor.Info.Length)
+	for i := range data {
+		data[i] = byte(i / 16 / 1024)
+	}
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		// All four requests are outstanding at once; answer them backwards
+		var begins []int
+		for len(begins) < 4 {
+			begins = append(begins, int(binary.BigEndian.Uint32((<-requests)[4:8])))
+		}
+		for i := len(begins) - 1; i >= 0; i-- {
+			sendBlock(theirs, data, 0, begins[i], 16*1024)
+		}
+	}()
+
+	got, err := NewPeerSession(ours, nil).DownloadPiece(tor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("blocks weren't placed by their offsets")
+	}
+}
+
+// latencyPeer answers the block requests sent to conn with data, each
+// after delay, like a peer a round trip of delay away.
+func latencyPeer(conn net.Conn, data []byte, delay time.Duration) {
+	type reply struct {
+		due     time.Time
+		request []byte
+	}
+	replies := make(chan reply, 64)
+	go func() {
+		for r := range replies {
+			time.Sleep(time.Until(r.due))
+			begin := int(binary.BigEndian.Uint32(r.request[4:8]))
+			length := int(binary.BigEndian.Uint32(r.request[8:12]))
+			sendBlock(conn, data, 0, begin, length)
+		}
+	}()
+	requests := make(chan []byte, 64)
+	go readRequests(conn, requests)
+	for request := range requests {
+		replies <- reply{time.Now().Add(delay), request}
+	}
+	close(replies)
+}
+
+func BenchmarkPipelining(b *testing.B) {
+	tor := Torrent{Info: Info{Length: 256 * 1024, PieceLength: 256 * 1024}}
+	data := bytes.Repeat([]byte{0x77}, tor.Info.Length)
+	for _, depth := range []int{1, defaultPipelineDepth} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			b.SetBytes(int64(tor.Info.Length))
+			for i := 0; i < b.N; i++ {
+				ours, theirs := net.Pipe()
+				go latencyPeer(theirs, data, 2*time.Millisecond)
+				s := NewPeerSession(ours, nil)
+				s.pipelineDepth = depth
+				if _, err := s.DownloadPiece(tor, 0); err != nil {
+					b.Fatal(err)
+				}
+				ours.Close()
+			}
+		})
+	}
+}
+
+func TestDownloadPieceGivesUpOnRepeatedRejects(t *testing.T) {
+	tor := singlePieceTorrent()
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		for request := range requests {
+			sendMessage(theirs, 16, request)
+		}
+	}()
+
+	s := NewPeerSession(ours, nil)
+	s.fast = true
+	if _, err := s.DownloadPiece(tor, 0); err != errBlocksRejected {
+		t.Fatalf("got %v, want %v", err, errBlocksRejected)
+	}
+	theirs.Close()
+}
+
+// TestDownloadPieceChokeResend checks that outstanding requests are sent
+// again after a choke only when the fast extension is off: with it, the
+// peer keeps them and serves them once it unchokes us.
+func TestDownloadPieceChokeResend(t *testing.T) {
+	for _, tc := range []struct {
+		fast bool
+		want int
+	}{
+		{fast: false, want: 4},
+		{fast: true, want: 2},
+	} {
+		tor := singlePieceTorrent()
+		data := bytes.Repeat([]byte{0x5a}, tor.Info.Length)
+		ours, theirs := net.Pipe()
+		requests := make(chan []byte, 16)
+		go readRequests(theirs, requests)
+		go func() {
+			<-requests
+			<-requests
+			sendMessage(theirs, 0, nil)
+			sendMessage(theirs, 1, nil)
+			sendBlock(theirs, data, 0, 0, 16*1024)
+			sendBlock(theirs, data, 0, 16*1024, 16*1024)
+		}()
+
+		s := NewPeerSession(ours, nil)
+		s.fast = tc.fast
+		if _, err := s.DownloadPiece(tor, 0); err != nil {
+			t.Fatalf("fast %v: %v", tc.fast, err)
+		}
+		ours.Close()
+		sent := 2
+		for range requests {
+			sent++
+		}
+		if sent != tc.want {
+			t.Errorf("fast %v: sent %d requests, want %d", tc.fast, sent, tc.want)
+		}
+	}
+}
+
+func TestDownloadPieceChokeBetweenBlocks(t *testing.T) {
+	tor := singlePieceTorrent()
+	data := bytes.Repeat([]byte{0x3c, 0xc3}, tor.Info.Length/2)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		<-requests
+		<-requests
+		// The choke drops the request for the second block, so it's only
+		// sent after it is asked for again
+		sendBlock(theirs, data, 0, 0, 16*1024)
+		sendMessage(theirs, 0, nil)
+		sendMessage(theirs, 1, nil)
+		if again := <-requests; !bytes.Equal(again, blockPayload(0, 16*1024, 16*1024)) {
+			t.Errorf("re-request after unchoke: got %x", again)
+		}
+		sendBlock(theirs, data, 0, 16*1024, 16*1024)
+	}()
+
+	got, err := NewPeerSession(ours, nil).DownloadPiece(tor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("piece data differs from what the peer sent")
+	}
+}
+
+func TestDownloadPieceBlockDeliveredWhileChoked(t *testing.T) {
+	tor := singlePieceTorrent()
+	data := bytes.Repeat([]byte{0x5a, 0xa5}, tor.Info.Length/2)
+	for _, fast := range []bool{true, false} {
+		ours, theirs := net.Pipe()
+		requests := make(chan []byte, 16)
+		go readRequests(theirs, requests)
+		done := make(chan struct{})
+		go func() {
+			<-requests
+			<-requests
+			// The second block was already on its way when the peer choked
+			sendBlock(theirs, data, 0, 0, 16*1024)
+			sendMessage(theirs, 0, nil)
+			sendBlock(theirs, data, 0, 16*1024, 16*1024)
+			sendMessage(theirs, 1, nil)
+			// Nothing more is sent; a session still waiting for the block
+			// would hang until the connection drops
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				theirs.Close()
+			}
+		}()
+
+		s := NewPeerSession(ours, nil)
+		s.fast = fast
+		got, err := s.DownloadPiece(tor, 0)
+		close(done)
+		ours.Close()
+		if err != nil {
+			t.Fatalf("fast %v: %v", fast, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("fast %v: piece data differs from what the peer sent", fast)
+		}
+	}
+}
+
+func TestDownloadPieceChokedWithoutUnchoke(t *testing.T) {
+	timeout := unchokeTimeout
+	unchokeTimeout = 100 * time.Millisecond
+	defer func() { unchokeTimeout = timeout }()
+	tor := singlePieceTorrent()
+	data := make([]byte, tor.Info.Length)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		<-requests
+		<-requests
+		sendBlock(theirs, data, 0, 0, 16*1024)
+		sendMessage(theirs, 0, nil)
+	}()
+
+	if _, err := NewPeerSession(ours, nil).DownloadPiece(tor, 0); err != errUnchokeTimeout {
+		t.Errorf("got %v, want %v", err, errUnchokeTimeout)
+	}
+}
+
+func TestDownloadPieceSkipsUnrequestedBlocks(t *testing.T) {
+	tor := singlePieceTorrent()
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, tor.Info.Length/4)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		<-requests
+		<-requests
+		junk := bytes.Repeat([]byte{0xff}, 32*1024)
+		sendBlock(theirs, junk, 3, 0, 16*1024) // another piece
+		sendBlock(theirs, data, 0, 0, 16*1024)
+		sendBlock(theirs, junk, 0, 100, 16*1024) // an offset never requested
+		sendBlock(theirs, junk, 0, 0, 8*1024)    // a length never requested
+		sendBlock(theirs, data, 0, 16*1024, 16*1024)
+	}()
+
+	got, err := NewPeerSession(ours, nil).DownloadPiece(tor, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("unrequested blocks were written into the piece")
+	}
+}
+
+func TestDownloadPieceGivesUpOnFloodOfUnrequestedBlocks(t *testing.T) {
+	tor := singlePieceTorrent()
+	junk := make([]byte, 16*1024)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	requests := make(chan []byte, 16)
+	go readRequests(theirs, requests)
+	go func() {
+		for i := 0; i <= maxUnrequestedBlocks; i++ {
+			sendBlock(theirs, junk, 1, 0, len(junk))
+		}
+	}()
+
+	if _, err := NewPeerSession(ours, nil).DownloadPiece(tor, 0); err == nil {
+		t.Fatal("kept reading a peer that only sends unrequested blocks")
+	}
+}
+
+func TestDownloadAllowedFastPieceWhileChoked(t *testing.T) {
+	tor, data := testTorrent(t, 32*1024, 32*1024)
+	seeder := &testSeeder{torrent: tor, data: data, allowedFast: []int{0}}
+	peer := seeder.start(t)
+	c := newTestClient(t)
+
+	output := filepath.Join(t.TempDir(), "out.bin")
+	opts := DownloadOptions{Network: "tcp", PieceTimeout: 5 * time.Second}
+	if err := c.Download(context.Background(), output, tor, []string{peer}, opts); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(output)
+	if !bytes.Equal(got, data) {
+		t.Fatal("piece data differs from what the peer sent")
+	}
+}
+
+func TestWaitForUnchokeAllowedFast(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		ours, theirs := net.Pipe()
+		go func() {
+			readMessage(theirs) // interested
+			sendMessage(theirs, 17, binary.BigEndian.AppendUint32(nil, 3))
+			sendMessage(theirs, 1, nil)
+		}()
+		_, unchoked, err := waitForUnchoke(ours, 3, 4, fast, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without the fast extension allowed fast means nothing, so only
+		// the unchoke lets us request
+		if unchoked == fast {
+			t.Errorf("fast %v: unchoked %v", fast, unchoked)
+		}
+		ours.Close()
+		theirs.Close()
+	}
+}
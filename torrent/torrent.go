@@ -0,0 +1,313 @@
+// Package torrent downloads and seeds BitTorrent data: it reads .torrent files
+// and magnet links, finds peers through trackers and the DHT, and fetches
+// and verifies pieces from them.
+//
+// Everything that talks to the network is a method of Client, which carries
+// the peer ID, connection settings and the log; parsing and verifying
+// torrents are plain functions.
+package torrent
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+type Torrent struct {
+	Announce string
+	// AnnounceList holds the announce-list tiers (BEP 12), if present.
+	AnnounceList [][]string
+	Info         Info
+}
+
+// PieceCount returns the number of pieces in the torrent.
+func (t Torrent) PieceCount() int {
+	if t.Info.PieceLength <= 0 {
+		return 0
+	}
+	return (t.Info.Length + t.Info.PieceLength - 1) / t.Info.PieceLength
+}
+
+// PieceSize returns the length of piece index. Every piece is PieceLength
+// long except a short final piece, which is full length when Length is an
+// exact multiple of PieceLength. Out of range indices have size 0.
+func (t Torrent) PieceSize(index int) int {
+	if index < 0 || index >= t.PieceCount() {
+		return 0
+	}
+	return min(t.Info.PieceLength, t.Info.Length-index*t.Info.PieceLength)
+}
+
+type Info struct {
+	Name string
+	// Length is the total length of all files.
+	Length      int
+	PieceLength int
+	Pieces      string
+	// MD5Sum is the optional hex md5 of the whole file.
+	MD5Sum string
+	// Files lists the files of a multi-file torrent in piece order; it is
+	// empty for a single-file torrent.
+	Files    []FileEntry
+	InfoHash []byte
+	// Private is set for private torrents (BEP 27), whose peers may only
+	// come from the listed trackers, never from the DHT.
+	Private bool
+}
+
+// FileEntry is one file of a multi-file torrent.
+type FileEntry struct {
+	Length int
+	// Path is the file's path components below the output directory.
+	Path []string
+	// MD5Sum is the optional hex md5 of the file.
+	MD5Sum string
+}
+
+// ReadTorrentFile reads a .torrent file, transparently decompressing it if it
+// starts with a gzip or bzip2 header.
+func ReadTorrentFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("bad gzip torrent file: %v", err)
+		}
+	case bytes.HasPrefix(data, []byte("BZh")):
+		r = bzip2.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+
+	data, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress torrent file: %v", err)
+	}
+	return data, nil
+}
+
+// Load reads and parses a .torrent file. Every key it relies on is checked,
+// so a malformed file is reported by naming the missing or mistyped key.
+func Load(torrentFilePath string) (torrent Torrent, err error) {
+	return Decoder{}.Load(torrentFilePath)
+}
+
+// Load is Load decoding the torrent file with d.
+func (d Decoder) Load(torrentFilePath string) (torrent Torrent, err error) {
+	torrentFile, err := ReadTorrentFile(torrentFilePath)
+	if err != nil {
+		return torrent, err
+	}
+	decoded, _, err := d.decodeDict(string(torrentFile), 0)
+	if err != nil {
+		return torrent, fmt.Errorf("cannot parse torrent file: %v", err)
+	}
+
+	info, ok := decoded["info"].(map[string]interface{})
+	if !ok {
+		return torrent, keyError("torrent", decoded, "info", "a dictionary")
+	}
+
+	sha1Hash, err := rawInfoHash(torrentFile)
+	if err != nil {
+		return torrent, fmt.Errorf("bad info: %v", err)
+	}
+
+	// announce may be absent when announce-list is given, or when the
+	// torrent is trackerless and relies on the DHT
+	if value, present := decoded["announce"]; present {
+		if torrent.Announce, ok = value.(string); !ok {
+			return torrent, keyError("torrent", decoded, "announce", "a string")
+		}
+	}
+	if value, present := decoded["announce-list"]; present {
+		announceList, ok := value.([]interface{})
+		if !ok {
+			return torrent, keyError("torrent", decoded, "announce-list", "a list")
+		}
+		for _, tier := range announceList {
+			tierList, ok := tier.([]interface{})
+			if !ok {
+				continue
+			}
+			var urls []string
+			for _, u := range tierList {
+				if s, ok := u.(string); ok {
+					urls = append(urls, s)
+				}
+			}
+			if len(urls) > 0 {
+				torrent.AnnounceList = append(torrent.AnnounceList, urls)
+			}
+		}
+	}
+	if _, trackerless := decoded["nodes"]; torrent.Announce == "" && len(torrent.AnnounceList) == 0 && !trackerless {
+		return torrent, keyError("torrent", decoded, "announce", "a string")
+	}
+
+	encoding, _ := decoded["encoding"].(string)
+	torrent.Info, err = infoFromDict(info, sha1Hash, encoding)
+	if err != nil {
+		return torrent, err
+	}
+	return torrent, nil
+}
+
+// keyError describes why dict's key isn't a value of type want, such as
+// "a string": either the key is missing or it holds another type. what names
+// the dictionary in the message.
+func keyError(what string, dict map[string]interface{}, key string, want string) error {
+	value, ok := dict[key]
+	if !ok {
+		return fmt.Errorf("%s has no %q key", what, key)
+	}
+	return fmt.Errorf("%s %q is %s, not %s", what, key, bencodeType(value), want)
+}
+
+// bencodeType names the bencode type of a decoded value, such as "a list".
+func bencodeType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case int:
+		return "an integer"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a dictionary"
+	}
+	return fmt.Sprintf("a %T", value)
+}
+
+// filesFromList parses the files list of a multi-file info dictionary. Path
+// components are checked so no file can land outside the output directory.
+func filesFromList(value interface{}, encoding string) ([]FileEntry, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("info has neither a length nor a files list")
+	}
+	files := make([]FileEntry, 0, len(list))
+	for i, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file %d is not a dictionary", i)
+		}
+		length, ok := entry["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file %d has no valid length", i)
+		}
+		components, ok := preferUTF8(entry, "path").([]interface{})
+		if !ok || len(components) == 0 {
+			return nil, fmt.Errorf("file %d has no path", i)
+		}
+		var path []string
+		for _, c := range components {
+			component, ok := c.(string)
+			if !ok || !ValidPathComponent(component) {
+				return nil, fmt.Errorf("file %d has an invalid path component %q", i, c)
+			}
+			path = append(path, legacyToUTF8(component, encoding))
+		}
+		md5sum, _ := entry["md5sum"].(string)
+		files = append(files, FileEntry{Length: length, Path: path, MD5Sum: strings.ToLower(md5sum)})
+	}
+	return files, nil
+}
+
+// ValidPathComponent reports whether name is safe to use as a single file or
+// directory name: not empty, not . or .., and without separators.
+func ValidPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// preferUTF8 returns dict's key.utf-8 value when present, else its key value.
+// Torrents with non-ASCII names often carry both, and only the .utf-8 one is
+// reliably UTF-8.
+func preferUTF8(dict map[string]interface{}, key string) interface{} {
+	if value, ok := dict[key+".utf-8"]; ok {
+		return value
+	}
+	return dict[key]
+}
+
+// legacyToUTF8 converts s from the torrent's declared encoding when it isn't
+// already valid UTF-8. Only Latin-1 can be converted without an encoding
+// table; anything else is left as it is.
+func legacyToUTF8(s string, encoding string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	switch strings.ToLower(encoding) {
+	case "iso-8859-1", "latin1", "latin-1":
+		runes := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			runes[i] = rune(s[i])
+		}
+		return string(runes)
+	}
+	return s
+}
+
+// infoFromDict builds an Info from a decoded info dictionary whose hash is
+// infoHash. encoding is the torrent's "encoding" hint, if any, used for names
+// that have no .utf-8 variant.
+func infoFromDict(info map[string]interface{}, infoHash []byte, encoding string) (result Info, err error) {
+	var ok bool
+	if _, single := info["length"]; single {
+		if result.Length, ok = info["length"].(int); !ok {
+			return result, keyError("info", info, "length", "an integer")
+		}
+		if result.Length < 0 {
+			return result, fmt.Errorf("info \"length\" is negative")
+		}
+	} else {
+		if result.Files, err = filesFromList(info["files"], encoding); err != nil {
+			return result, err
+		}
+		for _, file := range result.Files {
+			result.Length += file.Length
+		}
+	}
+	if result.Name, ok = preferUTF8(info, "name").(string); !ok {
+		return result, keyError("info", info, "name", "a string")
+	}
+	result.Name = legacyToUTF8(result.Name, encoding)
+	if result.PieceLength, ok = info["piece length"].(int); !ok {
+		return result, keyError("info", info, "piece length", "an integer")
+	}
+	if result.PieceLength <= 0 {
+		return result, fmt.Errorf("info \"piece length\" must be positive, got %d", result.PieceLength)
+	}
+	if result.Pieces, ok = info["pieces"].(string); !ok {
+		return result, keyError("info", info, "pieces", "a string")
+	}
+	if len(result.Pieces)%20 != 0 {
+		return result, fmt.Errorf("info pieces is %d bytes long, not a multiple of 20", len(result.Pieces))
+	}
+	if pieceCnt := (Torrent{Info: result}).PieceCount(); len(result.Pieces) != 20*pieceCnt {
+		return result, fmt.Errorf("info pieces holds %d hashes but the torrent has %d pieces", len(result.Pieces)/20, pieceCnt)
+	}
+	if value, present := info["private"]; present {
+		private, ok := value.(int)
+		if !ok {
+			return result, keyError("info", info, "private", "an integer")
+		}
+		result.Private = private == 1
+	}
+	if md5sum, ok := info["md5sum"].(string); ok {
+		result.MD5Sum = strings.ToLower(md5sum)
+	}
+	result.InfoHash = infoHash
+	return result, nil
+}
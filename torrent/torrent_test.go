@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPieceCountAndSize(t *testing.T) {
+	tests := []struct {
+		length, pieceLength int
+		count, last         int
+	}{
+		{0, 16, 0, 0},
+		{1, 16, 1, 1},
+		{15, 16, 1, 15},
+		{16, 16, 1, 16},
+		{17, 16, 2, 1},
+		{48, 16, 3, 16},
+		{49, 16, 4, 1},
+		{100, 0, 0, 0},
+	}
+	for _, test := range tests {
+		tor := Torrent{Info: Info{Length: test.length, PieceLength: test.pieceLength}}
+		if got := tor.PieceCount(); got != test.count {
+			t.Errorf("length %d in pieces of %d: got %d pieces, want %d", test.length, test.pieceLength, got, test.count)
+		}
+		if got := tor.PieceSize(test.count - 1); got != test.last {
+			t.Errorf("length %d in pieces of %d: last piece is %d bytes, want %d", test.length, test.pieceLength, got, test.last)
+		}
+	}
+}
+
+func TestPieceSizesCoverLength(t *testing.T) {
+	for pieceLength := 1; pieceLength <= 33; pieceLength++ {
+		for length := 0; length <= 5*pieceLength; length++ {
+			tor := Torrent{Info: Info{Length: length, PieceLength: pieceLength}}
+			count := tor.PieceCount()
+			total := 0
+			for index := 0; index < count; index++ {
+				size := tor.PieceSize(index)
+				if size <= 0 || size > pieceLength || (index < count-1 && size != pieceLength) {
+					t.Fatalf("length %d in pieces of %d: piece %d is %d bytes", length, pieceLength, index, size)
+				}
+				total += size
+			}
+			if total != length {
+				t.Fatalf("length %d in pieces of %d: %d pieces cover %d bytes", length, pieceLength, count, total)
+			}
+			if tor.PieceSize(-1) != 0 || tor.PieceSize(count) != 0 {
+				t.Fatalf("length %d in pieces of %d: out of range pieces have a size", length, pieceLength)
+			}
+		}
+	}
+}
+
+func TestLoadGzipTorrent(t *testing.T) {
+	raw, err := os.ReadFile("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "sample.torrent.gz")
+	if err := os.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := Load("../sample.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gzip torrent loaded as %+v, want %+v", got, want)
+	}
+
+	// A gzip header over garbage is reported, not decoded as bencode
+	if err := os.WriteFile(path, []byte{0x1f, 0x8b, 0, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("loaded a corrupt gzip file")
+	}
+}
+
+func TestLoadPrefersUTF8Names(t *testing.T) {
+	path := writeTorrent(t, "http://127.0.0.1:1/announce", map[string]interface{}{
+		"name":         "Caf\xe9",
+		"name.utf-8":   "Café",
+		"piece length": 16,
+		"pieces":       string(make([]byte, 20)),
+		"files": []interface{}{
+			map[string]interface{}{
+				"length":     5,
+				"path":       []interface{}{"r\xe9sum\xe9.txt"},
+				"path.utf-8": []interface{}{"résumé.txt"},
+			},
+			map[string]interface{}{"length": 5, "path": []interface{}{"plain.txt"}},
+		},
+	})
+	tor, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tor.Info.Name != "Café" {
+		t.Errorf("got name %q, want the utf-8 one", tor.Info.Name)
+	}
+	if got := [][]string{tor.Info.Files[0].Path, tor.Info.Files[1].Path}; !reflect.DeepEqual(got, [][]string{{"résumé.txt"}, {"plain.txt"}}) {
+		t.Errorf("got paths %q", got)
+	}
+
+	// Without a .utf-8 variant the encoding hint converts the legacy name
+	info := map[string]interface{}{"name": "Caf\xe9", "length": 5, "piece length": 16, "pieces": string(make([]byte, 20))}
+	latin1, err := infoFromDict(info, nil, "ISO-8859-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latin1.Name != "Café" {
+		t.Errorf("got Latin-1 name %q, want Café", latin1.Name)
+	}
+}
+
+func TestInfoHashKeepsUnknownKeys(t *testing.T) {
+	// An unknown key, out of order, that a decode and re-encode would
+	// drop or move
+	info := "d6:lengthi5e4:name1:x12:piece lengthi16e6:pieces20:" + strings.Repeat("h", 20) + "1:zi1e7:privatei0e8:x-sourcel3:abcee"
+	path := filepath.Join(t.TempDir(), "unknown.torrent")
+	if err := os.WriteFile(path, []byte("d8:announce27:http://127.0.0.1:1/announce4:info"+info+"e"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tor, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha1.Sum([]byte(info)); !bytes.Equal(tor.Info.InfoHash, want[:]) {
+		t.Errorf("got info hash %x, want %x", tor.Info.InfoHash, want)
+	}
+}
+
+func TestLoadRejectsTruncatedPieces(t *testing.T) {
+	// 30 bytes is one and a half hashes, which getPieceHash would slice past
+	path := writeTorrent(t, "http://127.0.0.1:1/announce", map[string]interface{}{
+		"name": "x", "length": 20, "piece length": 16, "pieces": strings.Repeat("h", 30),
+	})
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "30 bytes long, not a multiple of 20") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestLoadMalformedTorrent(t *testing.T) {
+	info := func(pieceLength interface{}) map[string]interface{} {
+		return map[string]interface{}{"name": "x", "length": 20, "piece length": pieceLength, "pieces": strings.Repeat("h", 40)}
+	}
+	for _, tc := range []struct {
+		name    string
+		torrent map[string]interface{}
+		want    string
+	}{
+		{"missing announce", map[string]interface{}{"info": info(16)}, `torrent has no "announce" key`},
+		{"string piece length", map[string]interface{}{"announce": "http://127.0.0.1:1/announce", "info": info("16")}, `info "piece length" is a string, not an integer`},
+	} {
+		data, err := encodeBencode(tc.torrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "bad.torrent")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trackerRetryDelay is the wait before the first retry; it doubles after
+// each attempt, up to trackerMaxRetryDelay.
+var (
+	trackerRetryDelay    = time.Second
+	trackerMaxRetryDelay = 30 * time.Second
+)
+
+// isRetryableStatus reports whether a tracker's HTTP status is worth
+// retrying: server errors, 408 Request Timeout and 429 Too Many Requests.
+// Other 4xx statuses mean the request itself is wrong.
+func isRetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// isTransientNetError reports whether err is a network failure worth retrying
+// rather than a permanent problem with the request.
+func isTransientNetError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// trackerTimeout bounds a single HTTP tracker request, so a tracker that
+// accepts the connection but never answers can't hang the client.
+const trackerTimeout = 30 * time.Second
+
+// trackerGet issues the announce GET, retrying transient network errors and
+// retryable statuses with exponential backoff. Permanent errors are returned
+// immediately; once the retries run out the last response or error is.
+func (c *Client) trackerGet(rawURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	delay := trackerRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.httpClient().Do(req)
+		if attempt >= c.TrackerRetries {
+			return resp, err
+		}
+		if err == nil {
+			if !isRetryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			err = fmt.Errorf("tracker returned %s", resp.Status)
+		} else if !isTransientNetError(err) {
+			return nil, err
+		}
+		c.logf("Tracker request failed (%v), retrying in %v\n", err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, trackerMaxRetryDelay)
+	}
+}
+
+// ErrNoPeers is returned when peer discovery worked but found nobody.
+var ErrNoPeers = fmt.Errorf("no peers available")
+
+// Peers asks the torrent's trackers for peers, tier by tier as BEP 12
+// describes: the URLs within a tier are tried in random order and the first
+// tracker that answers with peers wins. Without an announce-list the announce
+// URL is the only tier. If no tracker names any peers, the torrent is looked
+// up in the DHT, unless it is private. The list is never empty when err is
+// nil.
+func (c *Client) Peers(torrent Torrent) (peers []string, err error) {
+	peers, _, err = c.PeersWithInterval(torrent)
+	return peers, err
+}
+
+// PeersWithInterval is Peers that also returns how long the tracker
+// that answered wants us to wait before announcing again, or 0 if it didn't
+// say.
+func (c *Client) PeersWithInterval(torrent Torrent) (peers []string, interval time.Duration, err error) {
+	peers, interval, err = c.trackerPeers(torrent)
+	if err == nil {
+		return peers, interval, nil
+	}
+
+	if torrent.Info.Private {
+		c.logf("DHT is disabled for private torrents\n")
+		return nil, interval, err
+	}
+	if c.Proxied() {
+		c.logf("%v\n", errDHTProxied)
+		return nil, interval, err
+	}
+	c.logf("No tracker returned peers, looking the torrent up in the DHT\n")
+	peers, dhtErr := c.DHTPeers(torrent.Info.InfoHash)
+	if dhtErr != nil {
+		return nil, interval, fmt.Errorf("%w; DHT: %v", err, dhtErr)
+	}
+	return peers, interval, nil
+}
+
+// trackerPeers is PeersWithInterval without the DHT fallback. Re-announces
+// during a download use it, as a DHT lookup each time the trackers come up
+// empty would hold up the download for little gain.
+func (c *Client) trackerPeers(torrent Torrent) (peers []string, interval time.Duration, err error) {
+	err = fmt.Errorf("torrent has no trackers")
+	answered := false
+	for _, urls := range trackerTiers(torrent) {
+		for _, u := range urls {
+			found, trackerInterval, announceErr := c.announceTracked(torrent, u)
+			switch {
+			case announceErr == nil && len(found) > 0:
+				return found, trackerInterval, nil
+			case announceErr == nil:
+				// Keep asking, but a tracker that answered at all still
+				// sets the announce interval
+				c.logf("Tracker %v returned no peers\n", u)
+				if !answered {
+					interval = trackerInterval
+				}
+				answered = true
+				err = ErrNoPeers
+			default:
+				c.logf("Tracker %v failed: %v\n", u, announceErr)
+				if !answered {
+					err = announceErr
+				}
+			}
+		}
+	}
+	return nil, interval, err
+}
+
+// trackerTiers returns the torrent's tracker tiers in the order BEP 12
+// tries them, with the URLs of each tier shuffled. Without an announce-list
+// the announce URL is the only tier.
+func trackerTiers(torrent Torrent) [][]string {
+	tiers := torrent.AnnounceList
+	if len(tiers) == 0 && torrent.Announce != "" {
+		tiers = [][]string{{torrent.Announce}}
+	}
+	shuffled := make([][]string, len(tiers))
+	for i, tier := range tiers {
+		shuffled[i] = slices.Clone(tier)
+		mathrand.Shuffle(len(tier), func(a, b int) { shuffled[i][a], shuffled[i][b] = shuffled[i][b], shuffled[i][a] })
+	}
+	return shuffled
+}
+
+func trackerKey(torrent Torrent, baseURL string) string {
+	return string(torrent.Info.InfoHash) + baseURL
+}
+
+// announceTracked announces to baseURL, sending event=started the first time
+// this torrent is announced to it.
+func (c *Client) announceTracked(torrent Torrent, baseURL string) (peers []string, interval time.Duration, err error) {
+	key := trackerKey(torrent, baseURL)
+	var extra url.Values
+	if _, started := c.startedTrackers.Load(key); !started {
+		extra = url.Values{"event": {"started"}}
+	}
+	peers, interval, err = c.announceWithInterval(torrent, baseURL, extra)
+	if err == nil {
+		c.startedTrackers.Store(key, baseURL)
+	}
+	return peers, interval, err
+}
+
+// AnnounceLifecycle sends event ("completed" or "stopped") to every tracker
+// this torrent was started on. After "stopped" the trackers are forgotten, so
+// announcing again starts afresh.
+func (c *Client) AnnounceLifecycle(torrent Torrent, event string) {
+	prefix := string(torrent.Info.InfoHash)
+	c.startedTrackers.Range(func(key, value any) bool {
+		if !strings.HasPrefix(key.(string), prefix) {
+			return true
+		}
+		if err := c.AnnounceEvent(torrent, value.(string), event); err != nil {
+			c.logf("Announcing %s to %s failed: %v\n", event, value, err)
+		}
+		if event == "stopped" {
+			c.startedTrackers.Delete(key)
+		}
+		return true
+	})
+}
+
+// TrackerURLs returns the announce URL followed by every announce-list URL,
+// without duplicates.
+func TrackerURLs(torrent Torrent) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, tier := range append([][]string{{torrent.Announce}}, torrent.AnnounceList...) {
+		for _, u := range tier {
+			if u != "" && !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// PeersFromAllTrackers announces to every tracker concurrently and merges the
+// peers of those that answer within timeout. It only fails if no tracker
+// returned any peers.
+func (c *Client) PeersFromAllTrackers(torrent Torrent, timeout time.Duration) (peers []string, err error) {
+	urls := TrackerURLs(torrent)
+	type result struct {
+		url   string
+		peers []string
+		err   error
+	}
+	results := make(chan result, len(urls))
+	for _, u := range urls {
+		go func(u string) {
+			trackerPeers, _, err := c.announceTracked(torrent, u)
+			results <- result{url: u, peers: trackerPeers, err: err}
+		}(u)
+	}
+
+	deadline := time.After(timeout)
+	var lastErr error
+	for pending := len(urls); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				c.logf("Tracker %v failed: %v\n", r.url, r.err)
+				lastErr = r.err
+				continue
+			}
+			peers = MergePeers(peers, r.peers)
+		case <-deadline:
+			c.logf("Partial results: %d of %d trackers did not answer within %v\n", pending, len(urls), timeout)
+			pending = 0
+		}
+	}
+
+	if len(peers) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no tracker returned peers")
+		}
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// AllTrackersTimeout bounds how long PeersFromAllTrackers waits for answers.
+const AllTrackersTimeout = 15 * time.Second
+
+// percentEncodeBytes escapes every byte of b except the RFC 3986 unreserved
+// characters. Unlike url.QueryEscape it never turns 0x20 into '+', which some
+// trackers don't decode back into a space, so the raw info hash survives
+// for every byte value.
+func percentEncodeBytes(b []byte) string {
+	const hexDigits = "0123456789ABCDEF"
+	var sb strings.Builder
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hexDigits[c>>4])
+		sb.WriteByte(hexDigits[c&0x0f])
+	}
+	return sb.String()
+}
+
+// announceRequestURL builds the announce request for baseURL, adding extra
+// parameters such as an event.
+func (c *Client) announceRequestURL(torrent Torrent, baseURL string, extra url.Values) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("bad announce URL: %v", err)
+	}
+
+	// Keep any parameters the tracker put in the announce URL (e.g. a passkey)
+	params := u.Query()
+	params.Set("peer_id", c.PeerID)
+	params.Set("port", strconv.Itoa(c.ListenPort))
+	params.Set("uploaded", "0")
+	params.Set("downloaded", "0")
+	params.Set("left", strconv.Itoa(torrent.Info.Length))
+	params.Set("compact", "1")
+	for key, values := range extra {
+		params[key] = values
+	}
+
+	params.Del("info_hash")
+	u.RawQuery = params.Encode() + "&info_hash=" + percentEncodeBytes(torrent.Info.InfoHash)
+	return u.String(), nil
+}
+
+// AnnounceEvent tells a tracker about a state change such as "paused" without
+// asking for peers.
+func (c *Client) AnnounceEvent(torrent Torrent, baseURL string, event string) error {
+	if strings.HasPrefix(baseURL, "udp://") {
+		// BEP 15 has no "paused"; it goes out as a plain announce
+		_, _, err := c.udpTrackerAnnounce(baseURL, torrent, url.Values{"event": {event}})
+		return err
+	}
+	announceURL, err := c.announceRequestURL(torrent, baseURL, url.Values{"event": {event}, "numwant": {"0"}})
+	if err != nil {
+		return err
+	}
+	resp, err := c.trackerGet(announceURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	return nil
+}
+
+// announce sends an announce request to a single tracker.
+func (c *Client) announce(torrent Torrent, baseURL string) (peers []string, err error) {
+	peers, _, err = c.announceWithInterval(torrent, baseURL, nil)
+	return peers, err
+}
+
+// announceWithInterval announces to a single tracker with extra parameters
+// and also returns how long the tracker wants us to wait before announcing
+// again, or 0 if it didn't say.
+func (c *Client) announceWithInterval(torrent Torrent, baseURL string, extra url.Values) (peers []string, interval time.Duration, err error) {
+	if strings.HasPrefix(baseURL, "udp://") {
+		return c.udpTrackerAnnounce(baseURL, torrent, extra)
+	}
+
+	announceURL, err := c.announceRequestURL(torrent, baseURL, extra)
+	if err != nil {
+		return peers, 0, err
+	}
+
+	resp, err := c.trackerGet(announceURL)
+	if err != nil {
+		return peers, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return peers, 0, fmt.Errorf("tracker returned %s", resp.Status)
+	}
+
+	resBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return peers, 0, err
+	}
+
+	decodedResp, _, err := decodeDict(string(resBody), 0)
+	if err != nil {
+		return peers, 0, err
+	}
+	if err := c.trackerFailure(decodedResp); err != nil {
+		return peers, 0, err
+	}
+	if seconds, ok := decodedResp["interval"].(int); ok && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+
+	peers, err = peersFromResponse(decodedResp)
+	return peers, interval, err
+}
+
+// trackerFailure returns the tracker's failure reason as an error, if the
+// response has one, and prints any warning message, which doesn't stop the
+// response from being used.
+func (c *Client) trackerFailure(resp map[string]interface{}) error {
+	if reason, ok := resp["failure reason"].(string); ok {
+		return fmt.Errorf("tracker failure: %s", reason)
+	}
+	if warning, ok := resp["warning message"].(string); ok {
+		c.logf("Tracker warning: %v\n", warning)
+	}
+	return nil
+}
+
+// peersFromResponse collects the peers of a decoded tracker response. peers
+// may be a compact string of 6-byte IPv4 entries, a list of such entries, or
+// a non-compact list of dictionaries with ip and port keys; peers6 holds
+// compact 18-byte IPv6 entries.
+func peersFromResponse(resp map[string]interface{}) (peers []string, err error) {
+	switch value := resp["peers"].(type) {
+	case nil:
+	case string:
+		if peers, err = parseCompactPeers([]byte(value), 6); err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		for _, entry := range value {
+			switch entry := entry.(type) {
+			case string:
+				// Some trackers send the compact entries as a list of 6-byte strings
+				if len(entry) != 6 {
+					return nil, fmt.Errorf("invalid compact peer entry in peers list")
+				}
+				compact, _ := parseCompactPeers([]byte(entry), 6)
+				peers = append(peers, compact...)
+			case map[string]interface{}:
+				ip, ipOK := entry["ip"].(string)
+				port, portOK := entry["port"].(int)
+				if !ipOK || !portOK || port <= 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid peer dictionary in peers list")
+				}
+				p := net.JoinHostPort(ip, strconv.Itoa(port))
+				peers = append(peers, p)
+			default:
+				return nil, fmt.Errorf("invalid entry in peers list")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid peers in tracker response")
+	}
+
+	if value, ok := resp["peers6"].(string); ok {
+		peers6, err := parseCompactPeers([]byte(value), 18)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peers6...)
+	}
+
+	if resp["peers"] == nil && resp["peers6"] == nil {
+		return nil, fmt.Errorf("tracker response has no peers")
+	}
+	return peers, nil
+}
+
+// parseCompactPeers splits compact peer entries of size bytes each, an IPv4
+// (6) or IPv6 (18) address followed by a big-endian port, into host:port
+// strings, bracketing IPv6 hosts.
+func parseCompactPeers(data []byte, size int) (peers []string, err error) {
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid compact peers length %d (not a multiple of %d)", len(data), size)
+	}
+	for i := 0; i < len(data); i += size {
+		ip := net.IP(data[i : i+size-2])
+		port := binary.BigEndian.Uint16(data[i+size-2 : i+size])
+		p := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// errScrapeUnsupported is returned for trackers whose announce URL has no
+// scrape counterpart.
+var errScrapeUnsupported = fmt.Errorf("tracker does not support scrape")
+
+// ScrapeStats are a tracker's swarm counts for one torrent.
+type ScrapeStats struct {
+	Complete   int // seeders
+	Incomplete int // leechers
+	Downloaded int
+}
+
+// scrapeURL derives the scrape URL from an announce URL by replacing the
+// "announce" at the start of its last path segment with "scrape" (BEP 48).
+func scrapeURL(announceURL string) (*url.URL, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad announce URL: %v", err)
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return nil, errScrapeUnsupported
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	return u, nil
+}
+
+// Scrape asks a single tracker for the torrent's swarm counts.
+func (c *Client) Scrape(torrent Torrent, announceURL string) (stats ScrapeStats, err error) {
+	if strings.HasPrefix(announceURL, "udp://") {
+		return c.udpTrackerScrape(announceURL, torrent)
+	}
+
+	u, err := scrapeURL(announceURL)
+	if err != nil {
+		return stats, err
+	}
+	params := u.Query()
+	params.Del("info_hash")
+	u.RawQuery = params.Encode()
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += "info_hash=" + percentEncodeBytes(torrent.Info.InfoHash)
+
+	resp, err := c.trackerGet(u.String())
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("tracker returned %s", resp.Status)
+	}
+	resBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return stats, err
+	}
+	decodedResp, _, err := decodeDict(string(resBody), 0)
+	if err != nil {
+		return stats, err
+	}
+	if err := c.trackerFailure(decodedResp); err != nil {
+		return stats, err
+	}
+
+	files, ok := decodedResp["files"].(map[string]interface{})
+	if !ok {
+		return stats, fmt.Errorf("scrape response has no files")
+	}
+	entry, ok := files[string(torrent.Info.InfoHash)].(map[string]interface{})
+	if !ok {
+		return stats, fmt.Errorf("tracker has no stats for this torrent")
+	}
+	stats.Complete, _ = entry["complete"].(int)
+	stats.Incomplete, _ = entry["incomplete"].(int)
+	stats.Downloaded, _ = entry["downloaded"].(int)
+	return stats, nil
+}
+
+// FilterPeersByNetwork keeps the peers usable over network: "tcp4" keeps
+// IPv4 peers, "tcp6" keeps IPv6 peers and "tcp" keeps both. Peers given by
+// hostname are kept since the dialer resolves them for the right family.
+func FilterPeersByNetwork(peers []string, network string) ([]string, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unknown network %q (want tcp, tcp4 or tcp6)", network)
+	}
+	if network == "tcp" {
+		return peers, nil
+	}
+
+	var filtered []string
+	for _, peer := range peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || (ip.To4() != nil) == (network == "tcp4") {
+			filtered = append(filtered, peer)
+		}
+	}
+	return filtered, nil
+}
+
+// MergePeers returns first followed by the peers of second not already in
+// first.
+func MergePeers(first, second []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, p := range append(append([]string{}, first...), second...) {
+		if !seen[p] {
+			seen[p] = true
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,632 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAnnounceLifecycleEvents(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		events = append(events, r.URL.Query().Get("event"))
+		mu.Unlock()
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL
+	c := newTestClient(t)
+
+	c.Peers(tor)
+	c.Peers(tor)
+	c.AnnounceLifecycle(tor, "completed")
+	c.AnnounceLifecycle(tor, "stopped")
+	// Already stopped, so no tracker is told again
+	c.AnnounceLifecycle(tor, "stopped")
+	c.Peers(tor)
+
+	want := []string{"started", "", "completed", "stopped", "started"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+}
+
+func TestAnnouncePausedEvent(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+
+	if err := newTestClient(t).AnnounceEvent(tor, server.URL+"/announce", "paused"); err != nil {
+		t.Fatal(err)
+	}
+	query := <-queries
+	if query.Get("event") != "paused" || query.Get("numwant") != "0" {
+		t.Errorf("got event %q numwant %q, want paused and 0", query.Get("event"), query.Get("numwant"))
+	}
+}
+
+func TestFilterPeersByNetwork(t *testing.T) {
+	mixed := []string{"10.0.0.1:6881", "[2001:db8::1]:6881", "peer.example:6881", "[::ffff:10.0.0.2]:6881"}
+	tests := []struct {
+		network string
+		want    []string
+	}{
+		{"tcp4", []string{"10.0.0.1:6881", "peer.example:6881", "[::ffff:10.0.0.2]:6881"}},
+		{"tcp6", []string{"[2001:db8::1]:6881", "peer.example:6881"}},
+		{"tcp", mixed},
+	}
+	for _, test := range tests {
+		got, err := FilterPeersByNetwork(mixed, test.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.network, got, test.want)
+		}
+	}
+	if _, err := FilterPeersByNetwork(mixed, "udp"); err == nil {
+		t.Error("unknown network accepted")
+	}
+}
+
+func TestPeersAsListOfCompactEntries(t *testing.T) {
+	resp, _, err := decodeDict("d8:intervali60e5:peersl6:\x7f\x00\x00\x01\x1a\xe16:\x0a\x00\x00\x02\x00\x50ee", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := peersFromResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:6881", "10.0.0.2:80"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %q, want %q", peers, want)
+	}
+
+	resp, _, _ = decodeDict("d5:peersl5:\x7f\x00\x00\x01\x1aee", 0)
+	if _, err := peersFromResponse(resp); err == nil {
+		t.Error("accepted a 5-byte entry")
+	}
+}
+
+func TestPeersFromResponseForms(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want []string
+	}{
+		{"compact", "d5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x00\x50e", []string{"127.0.0.1:6881", "10.0.0.2:80"}},
+		{"dictionaries", "d5:peersld2:ip9:127.0.0.17:peer id20:-TS0001-1234567890124:porti6881eed2:ip3:::14:porti51413eeee", []string{"127.0.0.1:6881", "[::1]:51413"}},
+		{"peers6", "d6:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", []string{"[2001:db8::1]:6881"}},
+		{"compact and peers6", "d5:peers6:\x7f\x00\x00\x01\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1e", []string{"127.0.0.1:6881", "[2001:db8::1]:6881"}},
+	}
+	for _, test := range tests {
+		resp, _, err := decodeDict(test.resp, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := peersFromResponse(resp)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompactPeers6(t *testing.T) {
+	blob := append(net.ParseIP("2001:db8::1").To16(), 0x1a, 0xe1)
+	blob = append(blob, net.ParseIP("fe80::abcd:1").To16()...)
+	blob = append(blob, 0x00, 0x50)
+	peers, err := parseCompactPeers(blob, 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[2001:db8::1]:6881", "[fe80::abcd:1]:80"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %q, want %q", peers, want)
+	}
+	if _, err := parseCompactPeers(blob[:20], 18); err == nil {
+		t.Error("accepted a truncated entry")
+	}
+}
+
+func TestUDPTrackerOverIPv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Echo the action and transaction ID
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := append(binary.BigEndian.AppendUint32(nil, action), buf[12:16]...)
+			if action == 0 { // connect
+				resp = binary.BigEndian.AppendUint64(resp, 42)
+			} else { // announce: interval, leechers, seeders, then 18-byte peers
+				resp = binary.BigEndian.AppendUint32(resp, 60)
+				resp = binary.BigEndian.AppendUint32(resp, 0)
+				resp = binary.BigEndian.AppendUint32(resp, 1)
+				resp = append(resp, net.ParseIP("2001:db8::2").To16()...)
+				resp = binary.BigEndian.AppendUint16(resp, 6881)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	tor, _ := testTorrent(t, 1000, 1000)
+	peers, err := newTestClient(t).announce(tor, "udp://"+conn.LocalAddr().String()+"/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[2001:db8::2]:6881"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %q, want %q", peers, want)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	scraped := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			if action == 0 { // connect
+				resp := append(binary.BigEndian.AppendUint32(nil, 0), buf[12:16]...)
+				conn.WriteTo(binary.BigEndian.AppendUint64(resp, 42), addr)
+				continue
+			}
+			scraped <- append([]byte{}, buf[:n]...)
+			// A reply to another transaction comes first and must be skipped
+			stale := binary.BigEndian.AppendUint32(nil, 2)
+			stale = append(stale, buf[12]^0xff, buf[13], buf[14], buf[15])
+			stale = binary.BigEndian.AppendUint32(stale, 99)
+			stale = binary.BigEndian.AppendUint32(stale, 99)
+			conn.WriteTo(binary.BigEndian.AppendUint32(stale, 99), addr)
+			// complete, downloaded, incomplete
+			resp := append(binary.BigEndian.AppendUint32(nil, 2), buf[12:16]...)
+			resp = binary.BigEndian.AppendUint32(resp, 5)
+			resp = binary.BigEndian.AppendUint32(resp, 12)
+			conn.WriteTo(binary.BigEndian.AppendUint32(resp, 3), addr)
+		}
+	}()
+
+	stats, err := newTestClient(t).Scrape(tor, "udp://"+conn.LocalAddr().String()+"/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ScrapeStats{Complete: 5, Downloaded: 12, Incomplete: 3}); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	request := <-scraped
+	if id := binary.BigEndian.Uint64(request); id != 42 {
+		t.Errorf("scrape sent connection id %d, want 42", id)
+	}
+	if !bytes.Equal(request[16:], tor.Info.InfoHash) {
+		t.Errorf("scrape sent info hash %x, want %x", request[16:], tor.Info.InfoHash)
+	}
+}
+
+func TestDownloadFromIPv6Peer(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer ln.Close()
+	tor, data := testTorrent(t, 100000, 32*1024)
+	seeder := &testSeeder{torrent: tor, data: data}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go seeder.serve(conn)
+		}
+	}()
+	port := binary.BigEndian.AppendUint16(nil, uint16(ln.Addr().(*net.TCPAddr).Port))
+	peers, err := parseCompactPeers(append(net.IPv6loopback.To16(), port...), 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := newTestClient(t).Download(context.Background(), outputPath, tor, peers, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+		t.Error("downloaded data differs from the torrent's")
+	}
+}
+
+// withFastTrackerRetries shortens the tracker retry backoff for one test.
+func withFastTrackerRetries(t *testing.T) {
+	delay := trackerRetryDelay
+	trackerRetryDelay = time.Millisecond
+	t.Cleanup(func() { trackerRetryDelay = delay })
+}
+
+// flakyDialer fails each dial with the next of errs, then dials for real.
+type flakyDialer struct {
+	mu    sync.Mutex
+	errs  []error
+	dials int
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	var err error
+	if len(d.errs) > 0 {
+		err, d.errs = d.errs[0], d.errs[1:]
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestTrackerRetriesTransientNetErrors(t *testing.T) {
+	withFastTrackerRetries(t)
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = startTracker(t, "127.0.0.1:6881")
+	c := newTestClient(t)
+	dialer := &flakyDialer{errs: []error{
+		&net.DNSError{Err: "timeout", Name: "tracker.example", IsTimeout: true},
+		syscall.ECONNREFUSED,
+	}}
+	c.Dialer = dialer
+
+	peers, err := c.Peers(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, []string{"127.0.0.1:6881"}) || dialer.dials != 3 {
+		t.Errorf("got peers %q after %d dials, want one peer after 3", peers, dialer.dials)
+	}
+}
+
+func TestTrackerPermanentNetErrorNotRetried(t *testing.T) {
+	withFastTrackerRetries(t)
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = startTracker(t, "127.0.0.1:6881")
+	// Private, so the failed announce doesn't fall back to the DHT
+	tor.Info.Private = true
+	c := newTestClient(t)
+	dialer := &flakyDialer{errs: []error{syscall.EACCES}}
+	c.Dialer = dialer
+
+	if _, err := c.Peers(tor); err == nil {
+		t.Fatal("announce succeeded after a permanent error")
+	}
+	if dialer.dials != 1 {
+		t.Errorf("dialed %d times, want 1", dialer.dials)
+	}
+}
+
+func TestTrackerRetriesTransientStatus(t *testing.T) {
+	withFastTrackerRetries(t)
+	tor, _ := testTorrent(t, 1000, 1000)
+	tests := []struct {
+		status   int
+		failures int32
+		ok       bool
+		requests int32
+	}{
+		{http.StatusServiceUnavailable, 2, true, 3},
+		{http.StatusTooManyRequests, 1, true, 2},
+		{http.StatusRequestTimeout, 1, true, 2},
+		{http.StatusForbidden, 1, false, 1},
+		{http.StatusNotFound, 1, false, 1},
+	}
+	for _, test := range tests {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) <= test.failures {
+				w.WriteHeader(test.status)
+				return
+			}
+			w.Write([]byte("d5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+		}))
+		peers, err := newTestClient(t).announce(tor, server.URL+"/announce")
+		server.Close()
+		if test.ok && (err != nil || !reflect.DeepEqual(peers, []string{"127.0.0.1:6881"})) {
+			t.Errorf("%d: got %q, %v", test.status, peers, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%d: announce succeeded", test.status)
+		}
+		if got := requests.Load(); got != test.requests {
+			t.Errorf("%d: made %d requests, want %d", test.status, got, test.requests)
+		}
+	}
+}
+
+func TestPeersFromAllTrackersMerges(t *testing.T) {
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = startTracker(t, "10.0.0.1:6881", "10.0.0.2:6881")
+	tor.AnnounceList = [][]string{
+		{tor.Announce},
+		{startTracker(t, "10.0.0.2:6881", "10.0.0.3:6881"), "http://127.0.0.1:1/announce"},
+	}
+	c := newTestClient(t)
+	c.TrackerRetries = 0
+
+	peers, err := c.PeersFromAllTrackers(tor, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	if want := []string{"10.0.0.1:6881", "10.0.0.2:6881", "10.0.0.3:6881"}; !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %q, want %q", peers, want)
+	}
+}
+
+func TestAnnounceKeepsPasskey(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL + "/announce?passkey=abc"
+
+	if _, err := newTestClient(t).Peers(tor); err != nil {
+		t.Fatal(err)
+	}
+	query := <-queries
+	if query.Get("passkey") != "abc" {
+		t.Errorf("passkey lost: query %v", query)
+	}
+	if query.Get("info_hash") != string(tor.Info.InfoHash) || query.Get("compact") != "1" {
+		t.Errorf("announce parameters missing: query %v", query)
+	}
+}
+
+func TestPercentEncodeEveryByte(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	encoded := percentEncodeBytes(all)
+	decoded, err := url.QueryUnescape(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != string(all) {
+		t.Error("encoding doesn't decode back to every byte")
+	}
+	for _, c := range []byte(encoded) {
+		unreserved := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~%", c) >= 0
+		if !unreserved {
+			t.Fatalf("%q left unescaped", c)
+		}
+	}
+	if got := percentEncodeBytes([]byte{0x00, ' ', '+', '~', 0xff}); got != "%00%20%2B~%FF" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestPeersFromAllTrackersReturnsPartialResults(t *testing.T) {
+	hang := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer hanging.Close()
+	defer close(hang)
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = hanging.URL + "/announce"
+	tor.AnnounceList = [][]string{{tor.Announce}, {startTracker(t, "10.0.0.1:6881")}}
+	c := newTestClient(t)
+
+	start := time.Now()
+	peers, err := c.PeersFromAllTrackers(tor, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("got %q, want the fast tracker's peer", peers)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v despite the 200ms timeout", elapsed)
+	}
+}
+
+func TestTrackerRequestsSendUserAgent(t *testing.T) {
+	agents := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL
+
+	c := newTestClient(t)
+	if _, err := c.Peers(tor); err != nil {
+		t.Fatal(err)
+	}
+	if agent := <-agents; agent != DefaultUserAgent {
+		t.Errorf("got User-Agent %q, want %q", agent, DefaultUserAgent)
+	}
+	c.UserAgent = "uTorrent/3.5.5"
+	c.AnnounceLifecycle(tor, "stopped")
+	if agent := <-agents; agent != "uTorrent/3.5.5" {
+		t.Errorf("got User-Agent %q after overriding it", agent)
+	}
+}
+
+func TestPeersFallsBackToSecondTier(t *testing.T) {
+	withFastTrackerRetries(t)
+	const dead = "http://127.0.0.1:1/announce"
+	live := startTracker(t, "10.0.0.1:6881")
+	raw, err := encodeBencode(map[string]interface{}{
+		"announce":      dead,
+		"announce-list": []interface{}{[]interface{}{dead}, []interface{}{live}},
+		"info": map[string]interface{}{
+			"name": "x", "length": 1, "piece length": 16, "pieces": string(make([]byte, 20)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tiers.torrent")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tor, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{dead}, {live}}; !reflect.DeepEqual(tor.AnnounceList, want) {
+		t.Fatalf("got tiers %q, want %q", tor.AnnounceList, want)
+	}
+
+	peers, err := newTestClient(t).Peers(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("got peers %q from the second tier", peers)
+	}
+}
+
+func TestReannounceDuringDownload(t *testing.T) {
+	var announces atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces.Add(1)
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	defer server.Close()
+	tor, data := testTorrent(t, 1000, 1000)
+	tor.Announce = server.URL + "/announce"
+	release := make(chan struct{})
+	time.AfterFunc(500*time.Millisecond, func() { close(release) })
+	peer := (&testSeeder{torrent: tor, data: data, held: map[int]chan struct{}{0: release}}).start(t)
+
+	opts := DownloadOptions{Network: "tcp", AnnounceInterval: 50 * time.Millisecond}
+	if err := newTestClient(t).Download(context.Background(), filepath.Join(t.TempDir(), "out.bin"), tor, []string{peer}, opts); err != nil {
+		t.Fatal(err)
+	}
+	n := announces.Load()
+	if n < 4 {
+		t.Errorf("re-announced %d times in 500ms every 50ms", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if after := announces.Load(); after != n {
+		t.Errorf("re-announced %d more times after the download returned", after-n)
+	}
+}
+
+func TestTrackerFailureReason(t *testing.T) {
+	tracker := func(body string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL + "/announce"
+	}
+	tor, _ := testTorrent(t, 1000, 1000)
+	c := newTestClient(t)
+
+	_, err := c.announce(tor, tracker("d14:failure reason19:torrent not allowede"))
+	if err == nil || err.Error() != "tracker failure: torrent not allowed" {
+		t.Errorf("got %v, want the failure reason", err)
+	}
+
+	// A warning is logged but the peers are still used
+	var log syncBuffer
+	c.Log = &log
+	peers, err := c.announce(tor, tracker("d15:warning message9:slow down5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	if err != nil || !reflect.DeepEqual(peers, []string{"127.0.0.1:6881"}) {
+		t.Errorf("with a warning got %q, %v", peers, err)
+	}
+	if !strings.Contains(log.String(), "Tracker warning: slow down") {
+		t.Errorf("warning not logged:\n%s", log.String())
+	}
+}
+
+func TestTLSTracker(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer server.Close()
+	tor, _ := testTorrent(t, 1000, 1000)
+	announceURL := server.URL + "/announce"
+
+	untrusting := newTestClient(t)
+	untrusting.TrackerRetries = 0
+	if _, err := untrusting.announce(tor, announceURL); err == nil {
+		t.Error("accepted a certificate we don't trust")
+	}
+
+	// Trusting the server's certificate, or skipping verification as
+	// -insecure does, both reach the tracker
+	trusting := newTestClient(t)
+	trusting.TrackerTLSConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	insecure := newTestClient(t)
+	insecure.TrackerTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	for _, c := range []*Client{trusting, insecure} {
+		peers, err := c.announce(tor, announceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(peers, []string{"127.0.0.1:6881"}) {
+			t.Errorf("got peers %q over TLS", peers)
+		}
+	}
+}
+
+func TestTrackerWithEmptyPeers(t *testing.T) {
+	// "5:peers0:" is an answer, just an empty one; private keeps the DHT
+	// fallback from running
+	tor, _ := testTorrent(t, 1000, 1000)
+	tor.Announce = startTracker(t)
+	tor.Info.Private = true
+	peers, interval, err := newTestClient(t).PeersWithInterval(tor)
+	if err != ErrNoPeers || len(peers) != 0 {
+		t.Fatalf("got peers %q and error %v, want %v", peers, err, ErrNoPeers)
+	}
+	if interval != time.Minute {
+		t.Errorf("got interval %v, want the tracker's 1m0s", interval)
+	}
+}
@@ -0,0 +1,196 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// udpTrackerTimeout is the base UDP tracker timeout; attempt n waits
+// udpTrackerTimeout * 2^n, as BEP 15 prescribes.
+var udpTrackerTimeout = 15 * time.Second
+
+// udpProtocolID is the magic constant opening a UDP tracker connect request.
+const udpProtocolID = 0x41727101980
+
+// udpTrackerAnnounce announces to a udp:// tracker, retrying the connect and
+// announce exchange TrackerRetries times with exponential backoff. Only the
+// "left" and "event" extra parameters have UDP equivalents.
+func (c *Client) udpTrackerAnnounce(announce string, torrent Torrent, extra url.Values) (peers []string, interval time.Duration, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad announce URL: %v", err)
+	}
+	conn, err := c.dialer().DialContext(context.Background(), "udp", u.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	for attempt := 0; ; attempt++ {
+		timeout := udpTrackerTimeout << attempt
+		peers, interval, err = c.udpAnnounce(conn, torrent, extra, timeout)
+		var netErr net.Error
+		if err == nil || attempt >= c.TrackerRetries || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return peers, interval, err
+		}
+		c.logf("UDP tracker timed out after %v, retrying\n", timeout)
+	}
+}
+
+// udpEvents maps announce events to their BEP 15 codes.
+var udpEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+// udpAnnounce runs one connect and announce exchange, waiting up to timeout
+// for each response.
+func (c *Client) udpAnnounce(conn net.Conn, torrent Torrent, extra url.Values, timeout time.Duration) (peers []string, interval time.Duration, err error) {
+	connectionID, err := udpConnect(conn, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return nil, 0, err
+	}
+	left := uint64(torrent.Info.Length)
+	if value := extra.Get("left"); value != "" {
+		if left, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, 0, fmt.Errorf("bad left %q", value)
+		}
+	}
+	var event uint32
+	if values, ok := extra["event"]; ok {
+		event = udpEvents[values[0]]
+	}
+
+	request := append([]byte{}, torrent.Info.InfoHash...)
+	request = append(request, c.PeerID...)
+	request = binary.BigEndian.AppendUint64(request, 0)    // downloaded
+	request = binary.BigEndian.AppendUint64(request, left) // left
+	request = binary.BigEndian.AppendUint64(request, 0)    // uploaded
+	request = binary.BigEndian.AppendUint32(request, event)
+	request = binary.BigEndian.AppendUint32(request, 0) // IP: the sender's
+	request = append(request, key...)
+	request = binary.BigEndian.AppendUint32(request, 0xffffffff) // num_want: default
+	request = binary.BigEndian.AppendUint16(request, uint16(c.ListenPort))
+	response, err := udpRoundTrip(conn, connectionID, 1, request, timeout) // announce
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// interval, leechers and seeders precede the compact peers, which are
+	// IPv6 entries when we reached the tracker over IPv6
+	entrySize := 6
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		entrySize = 18
+	}
+	if len(response) < 12 || (len(response)-12)%entrySize != 0 {
+		return nil, 0, fmt.Errorf("invalid UDP announce response length %d", len(response)+8)
+	}
+	interval = time.Duration(binary.BigEndian.Uint32(response)) * time.Second
+	peers, err = parseCompactPeers(response[12:], entrySize)
+	return peers, interval, err
+}
+
+// udpConnect obtains a connection id from a UDP tracker.
+func udpConnect(conn net.Conn, timeout time.Duration) (connectionID uint64, err error) {
+	response, err := udpRoundTrip(conn, udpProtocolID, 0, nil, timeout) // connect
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 8 {
+		return 0, fmt.Errorf("short UDP connect response")
+	}
+	return binary.BigEndian.Uint64(response), nil
+}
+
+// udpTrackerScrape asks a UDP tracker for the torrent's swarm counts (BEP 15),
+// retrying timeouts like udpTrackerAnnounce.
+func (c *Client) udpTrackerScrape(announce string, torrent Torrent) (stats ScrapeStats, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return stats, fmt.Errorf("bad announce URL: %v", err)
+	}
+	conn, err := c.dialer().DialContext(context.Background(), "udp", u.Host)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	for attempt := 0; ; attempt++ {
+		timeout := udpTrackerTimeout << attempt
+		stats, err = udpScrape(conn, torrent, timeout)
+		var netErr net.Error
+		if err == nil || attempt >= c.TrackerRetries || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return stats, err
+		}
+		c.logf("UDP tracker timed out after %v, retrying\n", timeout)
+	}
+}
+
+// udpScrape runs one connect and scrape exchange, waiting up to timeout for
+// each response.
+func udpScrape(conn net.Conn, torrent Torrent, timeout time.Duration) (stats ScrapeStats, err error) {
+	connectionID, err := udpConnect(conn, timeout)
+	if err != nil {
+		return stats, err
+	}
+	response, err := udpRoundTrip(conn, connectionID, 2, torrent.Info.InfoHash, timeout) // scrape
+	if err != nil {
+		return stats, err
+	}
+	if len(response) < 12 {
+		return stats, fmt.Errorf("short UDP scrape response")
+	}
+	stats.Complete = int(binary.BigEndian.Uint32(response[0:4]))
+	stats.Downloaded = int(binary.BigEndian.Uint32(response[4:8]))
+	stats.Incomplete = int(binary.BigEndian.Uint32(response[8:12]))
+	return stats, nil
+}
+
+// udpRoundTrip sends a UDP tracker request for action with a fresh
+// transaction id and waits up to timeout for the matching response. It
+// returns the response after its action and transaction id. Datagrams for
+// other transactions are ignored.
+func udpRoundTrip(conn net.Conn, connectionID uint64, action uint32, body []byte, timeout time.Duration) ([]byte, error) {
+	tid := make([]byte, 4)
+	if _, err := rand.Read(tid); err != nil {
+		return nil, err
+	}
+	request := binary.BigEndian.AppendUint64(nil, connectionID)
+	request = binary.BigEndian.AppendUint32(request, action)
+	request = append(request, tid...)
+	request = append(request, body...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || !bytes.Equal(buf[4:8], tid) {
+			continue
+		}
+		switch got := binary.BigEndian.Uint32(buf[:4]); got {
+		case action:
+			return buf[8:n], nil
+		case 3: // error
+			return nil, fmt.Errorf("tracker error: %s", buf[8:n])
+		default:
+			return nil, fmt.Errorf("unexpected UDP tracker action %d", got)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// errFileChecksum is returned when every piece verified but an assembled file
+// doesn't match its md5sum.
+var errFileChecksum = fmt.Errorf("file checksum mismatch")
+
+// errTorrentCorrupt is returned when a piece fails its hash check from so many
+// distinct peers that the .torrent itself is more likely wrong than the peers.
+var errTorrentCorrupt = fmt.Errorf("torrent appears corrupt")
+
+// errPeerLacksPiece is returned instead of requesting a piece the peer's
+// bitfield or have messages say it doesn't have, so the caller can move on to
+// another peer rather than wait for a reply that never comes.
+var errPeerLacksPiece = fmt.Errorf("peer doesn't have piece")
+
+// corruptPieceThreshold is how many distinct peers must serve a piece that
+// fails verification before the torrent is declared corrupt.
+const corruptPieceThreshold = 3
+
+// minCorruptPeers is the fewest distinct peers that declare a torrent
+// corrupt, however small the swarm.
+const minCorruptPeers = 2
+
+// VerifyFileChecksum checks the download at path against the torrent's
+// md5sums: the file's own for a single-file torrent, and each file's below the
+// path directory for a multi-file one. Files without an md5sum are skipped.
+func VerifyFileChecksum(path string, torrent Torrent) error {
+	if len(torrent.Info.Files) == 0 {
+		return checkMD5(path, torrent.Info.MD5Sum)
+	}
+	for _, entry := range torrent.Info.Files {
+		if err := checkMD5(filepath.Join(append([]string{path}, entry.Path...)...), entry.MD5Sum); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Join(entry.Path...), err)
+		}
+	}
+	return nil
+}
+
+// hasChecksums reports whether every file of the torrent has an md5sum.
+func (info Info) hasChecksums() bool {
+	if len(info.Files) == 0 {
+		return info.MD5Sum != ""
+	}
+	for _, entry := range info.Files {
+		if entry.MD5Sum == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMD5 checks the file at path against want, a hex md5, unless want is
+// empty.
+func checkMD5(path string, want string) error {
+	if want == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("%w: md5 %s, expected %s", errFileChecksum, got, want)
+	}
+	return nil
+}
+
+// errPiecesMismatch is returned when a verify pass finds pieces on disk that
+// don't match their hashes.
+var errPiecesMismatch = fmt.Errorf("pieces on disk don't match their hashes")
+
+// VerifyDownload re-reads the downloaded torrent at outputPath from disk and
+// re-hashes every piece. The error lists the index of each one that doesn't
+// match.
+// Unlike the per-piece checks while downloading, this also catches data
+// written to the wrong offset or file.
+func VerifyDownload(outputPath string, torrent Torrent, workers int) error {
+	files, err := OpenFiles(outputPath, torrent)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	present, err := CheckPiecesAt(torrent, files, workers)
+	if err != nil {
+		return err
+	}
+	var bad []int
+	for index, ok := range present {
+		if !ok {
+			bad = append(bad, index)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%w: %v", errPiecesMismatch, bad)
+	}
+	return nil
+}
+
+// verifyAssembled checks a finished download: against the md5sums when every
+// file has one, and otherwise by re-hashing every piece on disk.
+func verifyAssembled(outputPath string, torrent Torrent) error {
+	if torrent.Info.hasChecksums() {
+		return VerifyFileChecksum(outputPath, torrent)
+	}
+	return VerifyDownload(outputPath, torrent, runtime.GOMAXPROCS(0))
+}
+
+func verifyPiece(pieceData []byte, expectedHash []byte) bool {
+	hash := sha1.New()
+	hash.Write(pieceData)
+	return bytes.Equal(hash.Sum(nil), expectedHash)
+}
+
+// getPieceHash returns the SHA-1 hash of piece index from the info's pieces
+// string.
+func getPieceHash(torrent Torrent, index int) ([]byte, error) {
+	start := index * 20
+	if index < 0 || start+20 > len(torrent.Info.Pieces) {
+		return nil, fmt.Errorf("no hash for piece %d: pieces holds %d hashes", index, len(torrent.Info.Pieces)/20)
+	}
+	return []byte(torrent.Info.Pieces[start : start+20]), nil
+}
+
+// CheckPieces reports, for every piece of the torrent, whether the file at
+// path holds data matching that piece's hash. Pieces past the end of a short
+// file count as missing. Up to workers pieces are read and hashed at once,
+// each into its own buffer; the result is always in piece order.
+func CheckPieces(torrent Torrent, path string, workers int) (present []bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return CheckPiecesAt(torrent, file, workers)
+}
+
+// CheckPiecesAt is CheckPieces over the torrent's data as read from file.
+func CheckPiecesAt(torrent Torrent, file io.ReaderAt, workers int) (present []bool, err error) {
+	pieceCnt := torrent.PieceCount()
+	present = make([]bool, pieceCnt)
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, torrent.Info.PieceLength)
+			for index := range indices {
+				offset := index * torrent.Info.PieceLength
+				pieceSize := torrent.PieceSize(index)
+
+				n, readErr := file.ReadAt(buf[:pieceSize], int64(offset))
+				if readErr != nil && readErr != io.EOF {
+					errMu.Lock()
+					err = readErr
+					errMu.Unlock()
+					continue
+				}
+				hash, hashErr := getPieceHash(torrent, index)
+				if hashErr != nil {
+					errMu.Lock()
+					err = hashErr
+					errMu.Unlock()
+					continue
+				}
+				present[index] = n == pieceSize && verifyPiece(buf[:pieceSize], hash)
+			}
+		}()
+	}
+	for index := 0; index < pieceCnt; index++ {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	return present, nil
+}
+
+// pieceHasher verifies piece hashes on a fixed pool of workers, so hashing of
+// pieces from many peers runs in parallel without oversubscribing the CPU.
+type pieceHasher struct {
+	jobs chan hashJob
+}
+
+type hashJob struct {
+	data     []byte
+	expected []byte
+	result   chan bool
+}
+
+// newPieceHasher starts workers hashing goroutines; zero or less means one
+// per CPU.
+func newPieceHasher(workers int) *pieceHasher {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	h := &pieceHasher{jobs: make(chan hashJob)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range h.jobs {
+				job.result <- verifyPiece(job.data, job.expected)
+			}
+		}()
+	}
+	return h
+}
+
+// verify hashes data on one of the workers and reports whether it matches
+// expected.
+func (h *pieceHasher) verify(data []byte, expected []byte) bool {
+	result := make(chan bool, 1)
+	h.jobs <- hashJob{data: data, expected: expected, result: result}
+	return <-result
+}
+
+func (h *pieceHasher) close() {
+	close(h.jobs)
+}
@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDownloadChecksMD5Sum(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	sum := md5.Sum(data)
+	path := writeTorrent(t, tor.Announce, map[string]interface{}{
+		"name":         "test.bin",
+		"length":       len(data),
+		"piece length": tor.Info.PieceLength,
+		"pieces":       tor.Info.Pieces,
+		"md5sum":       hex.EncodeToString(sum[:]),
+	})
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Info.MD5Sum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("got md5sum %q", loaded.Info.MD5Sum)
+	}
+	peer := startSeeder(t, loaded, data)
+	c := newTestClient(t)
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.bin")
+	if err := c.Download(context.Background(), good, loaded, []string{peer}, DownloadOptions{Network: "tcp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every piece verifies, so only the whole-file check can catch this
+	loaded.Info.MD5Sum = "00000000000000000000000000000000"
+	bad := filepath.Join(dir, "bad.bin")
+	err = c.Download(context.Background(), bad, loaded, []string{peer}, DownloadOptions{Network: "tcp"})
+	if !errors.Is(err, errFileChecksum) {
+		t.Fatalf("got %v, want %v", err, errFileChecksum)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Error("output left behind after a checksum mismatch")
+	}
+}
+
+func TestCheckPiecesPartialFile(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	// Piece 1 is zeroed as in a preallocated .part file, and the file stops
+	// partway through piece 3
+	partial := bytes.Clone(data[:99000])
+	clear(partial[32*1024 : 2*32*1024])
+	path := filepath.Join(t.TempDir(), "test.bin.part")
+	if err := os.WriteFile(path, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	present, err := CheckPieces(tor, path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false, true, false}; !reflect.DeepEqual(present, want) {
+		t.Errorf("got %v, want %v", present, want)
+	}
+}
+
+func TestCheckPiecesParallelMatchesSequential(t *testing.T) {
+	tor, data := testTorrent(t, 1000000, 16*1024)
+	// Damage a scattered handful of pieces
+	for _, index := range []int{0, 7, 30, 31, 61} {
+		data[index*16*1024+100] ^= 0xff
+	}
+	path := filepath.Join(t.TempDir(), "test.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sequential, err := CheckPieces(tor, path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 8, 100} {
+		parallel, err := CheckPieces(tor, path, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parallel, sequential) {
+			t.Errorf("%d workers: got %v, want %v", workers, parallel, sequential)
+		}
+	}
+}
+
+func BenchmarkCheckPieces(b *testing.B) {
+	length := 64 << 20
+	data := bytes.Repeat([]byte{0x42}, length)
+	hash := sha1.Sum(data[:256*1024])
+	tor := Torrent{Info: Info{
+		Length:      length,
+		PieceLength: 256 * 1024,
+		Pieces:      strings.Repeat(string(hash[:]), length/(256*1024)),
+	}}
+	path := filepath.Join(b.TempDir(), "bench.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(length))
+			for i := 0; i < b.N; i++ {
+				if _, err := CheckPieces(tor, path, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPieceHasher(b *testing.B) {
+	const pieces = 64
+	piece := bytes.Repeat([]byte{0x17}, 256*1024)
+	hash := sha1.Sum(piece)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			h := newPieceHasher(workers)
+			defer h.close()
+			b.SetBytes(pieces * int64(len(piece)))
+			for i := 0; i < b.N; i++ {
+				// Submit the pieces at once, as many peers' downloads would
+				var wg sync.WaitGroup
+				for j := 0; j < pieces; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if !h.verify(piece, hash[:]) {
+							b.Error("piece failed verification")
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestVerifyDownloadFlagsCorruptPiece(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	path := filepath.Join(t.TempDir(), "test.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDownload(path, tor, 2); err != nil {
+		t.Fatalf("intact file: %v", err)
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[2*32*1024+100] ^= 0x01
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := VerifyDownload(path, tor, 2)
+	if !errors.Is(err, errPiecesMismatch) || !strings.HasSuffix(err.Error(), ": [2]") {
+		t.Errorf("got %v, want piece 2 flagged", err)
+	}
+
+	// In a multi-file torrent the byte is found through the file it's in
+	multi, data := twoFileTorrent(t)
+	dir := filepath.Join(t.TempDir(), "multi")
+	files, err := CreateFiles(dir, multi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt = bytes.Clone(data)
+	corrupt[70000] ^= 0x01
+	if _, err := files.WriteAt(corrupt, 0); err != nil {
+		t.Fatal(err)
+	}
+	files.Close()
+	err = VerifyDownload(dir, multi, 2)
+	if !errors.Is(err, errPiecesMismatch) || !strings.HasSuffix(err.Error(), ": [2]") {
+		t.Errorf("multi-file: got %v, want piece 2 flagged", err)
+	}
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// downloadPieceFromPeer connects to peerAddress and downloads one piece,
+// abandoning the peer once ctx is done; the caller verifies its hash. It also
+// returns the pieces the peer announced, or nil if it didn't say.
+func (c *Client) downloadPieceFromPeer(ctx context.Context, torrent Torrent, network string, peerAddress string, index int) (pieceData []byte, have Bitfield, err error) {
+	pool := newWarmPool(c)
+	defer pool.close()
+	return pool.fetch(ctx, torrent, network, peerAddress, index)
+}
+
+// requestPiece fetches one piece over wc, which must already be handshaked
+// and unchoked. Peers learned through ut_pex meanwhile are passed to
+// discovered, if set, unless the torrent is private.
+func (c *Client) requestPiece(ctx context.Context, torrent Torrent, wc *warmConn, peerAddress string, index int, discovered func(added, dropped []string)) ([]byte, Bitfield, error) {
+	have := wc.have
+	if have != nil && !have.HasPiece(index) {
+		return nil, have, fmt.Errorf("%w: %s lacks piece %d", errPeerLacksPiece, peerAddress, index)
+	}
+
+	session := c.newPeerSession(wc.conn, peerAddress, have)
+	session.ctx = ctx
+	session.extensions = &wc.extensions
+	session.fast = wc.fast
+	if !torrent.Info.Private {
+		session.discovered = discovered
+	}
+	pieceData, err := session.DownloadPiece(torrent, index)
+	if err != nil {
+		return nil, have, err
+	}
+	return pieceData, have, nil
+}
+
+// MaxPrewarm bounds how many connections prewarmConnections opens.
+const MaxPrewarm = 32
+
+// prewarmTimeout bounds how long a single pre-warmed connection may take to
+// connect, handshake and be unchoked.
+const prewarmTimeout = 10 * time.Second
+
+// warmConn is a peer connection that is already handshaked and unchoked.
+type warmConn struct {
+	conn net.Conn
+	have Bitfield
+	// fast is whether both sides negotiated the fast extension.
+	fast bool
+	// extensions is what the peer advertised in its extension handshake,
+	// if it sent one.
+	extensions peerExtensions
+}
+
+// warmPool holds handshaked, unchoked connections by peer address: those set
+// up by prewarmConnections and those kept after a piece, so later pieces from
+// the same peer skip the dial, handshake and unchoke.
+type warmPool struct {
+	client *Client
+	mu     sync.Mutex
+	conns  map[string][]*warmConn
+	// discovered, if set, is passed the peers that connected peers tell us
+	// they connected to and dropped with ut_pex.
+	discovered func(added, dropped []string)
+}
+
+func newWarmPool(c *Client) *warmPool {
+	return &warmPool{client: c, conns: make(map[string][]*warmConn)}
+}
+
+// fetch downloads piece index from peer over a pooled connection, or a new
+// one if there is none. A pooled connection that fails may just have gone
+// stale while idle, so the piece is then tried once more over a new one.
+func (p *warmPool) fetch(ctx context.Context, torrent Torrent, network string, peer string, index int) (pieceData []byte, have Bitfield, err error) {
+	if wc := p.take(peer); wc != nil {
+		pieceData, have, err = p.fetchOver(ctx, torrent, wc, false, peer, index)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errPeerLacksPiece) {
+			return pieceData, have, err
+		}
+	}
+
+	conn, err := p.client.dialPeerContext(ctx, network, peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to peer %s: %v", peer, err)
+	}
+	return p.fetchOver(ctx, torrent, &warmConn{conn: conn}, true, peer, index)
+}
+
+// fetchOver downloads piece index over wc, handshaking first if it is fresh.
+// Afterwards wc goes back to the pool if we are unchoked and the exchange
+// left it in a known state; otherwise it is closed.
+func (p *warmPool) fetchOver(ctx context.Context, torrent Torrent, wc *warmConn, fresh bool, peer string, index int) (pieceData []byte, have Bitfield, err error) {
+	keep := false
+	defer func() {
+		if keep {
+			p.put(peer, wc)
+		} else {
+			wc.conn.Close()
+		}
+	}()
+	defer bindContext(ctx, wc.conn)()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("peer %s: %w", peer, ctx.Err())
+		}
+	}()
+
+	unchoked := !fresh
+	if fresh {
+		recievedHandshake, err := p.client.downloadHandshake(torrent, wc.conn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("handshake failed with peer %s: %v", peer, err)
+		}
+		wc.fast = supportsFast(recievedHandshake)
+		wc.have, unchoked, err = waitForUnchoke(wc.conn, index, torrent.PieceCount(), wc.fast, &wc.extensions)
+		if err != nil {
+			return nil, wc.have, err
+		}
+	}
+
+	pieceData, have, err = p.client.requestPiece(ctx, torrent, wc, peer, index, p.discovered)
+	keep = unchoked && (err == nil || errors.Is(err, errPeerLacksPiece))
+	return pieceData, have, err
+}
+
+// put returns a connection to the pool for the next piece from peer.
+func (p *warmPool) put(peer string, wc *warmConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[peer] = append(p.conns[peer], wc)
+}
+
+// prewarmConnections connects to, handshakes with and waits to be unchoked by
+// up to n of peers concurrently, so the first piece requests don't pay for
+// that latency. Peers that fail are skipped.
+func (c *Client) prewarmConnections(torrent Torrent, network string, peers []string, n int) *warmPool {
+	pool := newWarmPool(c)
+	n = min(n, len(peers), MaxPrewarm)
+
+	var wg sync.WaitGroup
+	for _, peer := range peers[:n] {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			conn, err := c.DialPeer(network, peer)
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(prewarmTimeout))
+			wc := &warmConn{conn: conn}
+			err = func() (err error) {
+				handshake, err := c.downloadHandshake(torrent, conn)
+				if err != nil {
+					return err
+				}
+				wc.fast = supportsFast(handshake)
+				// No piece is allowed fast yet, so only an unchoke will do
+				wc.have, _, err = waitForUnchoke(conn, -1, torrent.PieceCount(), false, &wc.extensions)
+				return err
+			}()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			pool.mu.Lock()
+			pool.conns[peer] = append(pool.conns[peer], wc)
+			pool.mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+	return pool
+}
+
+// take removes and returns a warm connection to peer, or nil if there is none.
+func (p *warmPool) take(peer string) *warmConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.conns[peer]
+	if len(conns) == 0 {
+		return nil
+	}
+	p.conns[peer] = conns[1:]
+	return conns[0]
+}
+
+// size returns how many warm connections are waiting.
+func (p *warmPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, conns := range p.conns {
+		n += len(conns)
+	}
+	return n
+}
+
+// close closes the connections nobody took.
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for peer, conns := range p.conns {
+		for _, wc := range conns {
+			wc.conn.Close()
+		}
+		delete(p.conns, peer)
+	}
+}
@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrewarmConnections(t *testing.T) {
+	tor, data := testTorrent(t, 100000, 32*1024)
+	peers := []string{startSeeder(t, tor, data), "127.0.0.1:1", startSeeder(t, tor, data), startSeeder(t, tor, data)}
+	c := newTestClient(t)
+
+	// The unreachable peer is skipped and the last isn't among the first 3
+	pool := c.prewarmConnections(tor, "tcp", peers, 3)
+	defer pool.close()
+	if pool.size() != 2 {
+		t.Fatalf("got %d warm connections, want 2", pool.size())
+	}
+	for _, peer := range peers[:3] {
+		wc := pool.take(peer)
+		if (wc != nil) != (peer != "127.0.0.1:1") {
+			t.Errorf("%s: warm connection %v", peer, wc)
+			continue
+		}
+		if wc == nil {
+			continue
+		}
+		// Already handshaked and unchoked, so a request goes straight out
+		got, _, err := c.requestPiece(context.Background(), tor, wc, peer, 1, nil)
+		wc.conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[32*1024:64*1024]) {
+			t.Errorf("%s: piece 1 differs from the torrent's", peer)
+		}
+	}
+
+	var log syncBuffer
+	c.Log = &log
+	outputPath := filepath.Join(t.TempDir(), "out.bin")
+	if err := c.Download(context.Background(), outputPath, tor, peers, DownloadOptions{Network: "tcp", Prewarm: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "Pre-warmed 3 peer connections") {
+		t.Errorf("log lacks the pre-warmed connections:\n%s", log.String())
+	}
+}
+
+func TestPooledConnectionReusedAcrossPieces(t *testing.T) {
+	tor, data := testTorrent(t, 3*32*1024, 32*1024)
+	dialer := &pipeDialer{seeder: &testSeeder{torrent: tor, data: data}}
+	c := newTestClient(t)
+	c.Dialer = dialer
+
+	pool := newWarmPool(c)
+	defer pool.close()
+	const peer = "mock.invalid:6881"
+	for index := 0; index < 3; index++ {
+		got, _, err := pool.fetch(context.Background(), tor, "tcp", peer, index)
+		if err != nil {
+			t.Fatalf("piece %d: %v", index, err)
+		}
+		if !bytes.Equal(got, data[index*32*1024:(index+1)*32*1024]) {
+			t.Errorf("piece %d differs from the torrent's", index)
+		}
+	}
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if len(dialer.dialed) != 1 {
+		t.Errorf("dialed and handshaked %d times for three pieces, want once", len(dialer.dialed))
+	}
+}